@@ -63,6 +63,7 @@ ngrok.factory("txnSvc", function() {
         } else {
             body.Text = Base64.decode(body.Text).text;
         }
+        body.RawText = body.Text;
 
         // prettify
         var transform = {
@@ -181,6 +182,13 @@ ngrok.factory("txnSvc", function() {
         },
         isActive: function(txn) {
             return !!active && txn.Id == active.Id;
+        },
+        byId: function(id) {
+            for (var i=0; i<txns.length; i++) {
+                if (txns[i].Id == id) {
+                    return txns[i];
+                }
+            }
         }
     };
 });
@@ -306,6 +314,28 @@ ngrok.controller({
         $scope.tunnels = window.data.UiState.Tunnels;
         $scope.txns = txnSvc.all();
 
+        $scope.importHar = function(input) {
+            var file = input.files[0];
+            if (!file) {
+                return;
+            }
+
+            var reader = new FileReader();
+            reader.onload = function() {
+                $.ajax({
+                    type: "POST",
+                    url: "/http/in/har/import",
+                    contentType: "application/json",
+                    data: reader.result,
+                    error: function(xhr) {
+                        alert("Failed to import HAR: " + xhr.responseText);
+                    }
+                });
+            };
+            reader.readAsText(file);
+            input.value = "";
+        };
+
         if (!!window.WebSocket) {
             var ws = new WebSocket("ws://" + location.host + "/_ws");
             ws.onopen = function() {
@@ -337,7 +367,52 @@ ngrok.controller({
                 data: { txnid: txnSvc.active().Id }
             });
         }
+
+        $scope.editReplay = function() {
+            var req = $scope.Req;
+            var headers = [];
+            for (var name in req.Header) {
+                req.Header[name].forEach(function(value) {
+                    headers.push(name + ": " + value);
+                });
+            }
+
+            // binary bodies can't be edited as text, they are replayed as
+            // they were captured unless replaced
+            $scope.editedBody = req.Binary ? "" : req.Body.RawText;
+            $scope.editor = {
+                method: req.Method,
+                url: req.Url,
+                headers: headers.join("\n"),
+                body: $scope.editedBody,
+                local_addr: "",
+                count: 1,
+                concurrency: 1
+            };
+        };
+
+        $scope.sendReplay = function() {
+            var data = angular.extend({ txnid: txnSvc.active().Id }, $scope.editor);
+            // only send the body if it was edited, so that the server keeps
+            // the captured one
+            if (data.body === $scope.editedBody) {
+                delete data.body;
+            }
+            $.ajax({
+                type: "POST",
+                url: "/http/in/replay",
+                data: data,
+                success: function() {
+                    $scope.$apply(function() { $scope.editor = null; });
+                },
+                error: function(xhr) {
+                    alert("Replay failed: " + xhr.responseText);
+                }
+            });
+        };
+
         var setReq = function() {
+            $scope.editor = null;
             var txn = txnSvc.active();
             if (!!txn && txn.Req) {
                 $scope.Req = txnSvc.active().Req;
@@ -372,6 +447,13 @@ ngrok.controller({
             $scope.Txn = txnSvc.active();
         };
 
+        $scope.showReplayed = function() {
+            var original = txnSvc.byId($scope.Txn.ConnCtx.ReplayOf);
+            if (!!original) {
+                txnSvc.active(original);
+            }
+        };
+
         $scope.ISO8601 = function(ts) {
             if (!!ts) {
                 return new Date(ts * 1000).toISOString();
@@ -15,8 +15,18 @@ const usage2 string = `
 Examples:
 	ngrok 80
 	ngrok -subdomain=example 8080
+	ngrok -domain=team-a.example.com -subdomain=example 8080
 	ngrok -proto=tcp 22
+	ngrok -proto=udp 53
+	ngrok -proto=connect -remote-addr=db.staging.internal:5432 5432
 	ngrok -hostname="example.com" -httpauth="user:password" 10.0.0.1
+	ngrok -hostname="*.feature.example.com" 8080
+	ngrok -hostname="example.com" -path=/api 9000
+	ngrok -subdomain=dev -group=dev-backends 8080
+	ngrok -subdomain=hooks -hold 8080
+	ngrok https://localhost:8443
+	ngrok unix:///var/run/docker.sock
+	ngrok file:///path/to/dir
 
 
 Advanced usage: ngrok [OPTIONS] <command> [command args] [...]
@@ -25,6 +35,8 @@ Commands:
 	ngrok start [tunnel] [...]    Start tunnels by name from config file
 	ngork start-all               Start all tunnels defined in config file
 	ngrok list                    List tunnel names from config file
+	ngrok har-export [file]       Export captured requests of a running ngrok as HAR
+	ngrok har-import <file> [url] Replay the requests of a HAR file over a running ngrok
 	ngrok help                    Print help
 	ngrok version                 Print ngrok version
 
@@ -32,6 +44,7 @@ Examples:
 	ngrok start www api blog pubsub
 	ngrok -log=stdout -config=ngrok.yml start ssh
 	ngrok start-all
+	ngrok har-export requests.har
 	ngrok version
 
 `
@@ -41,13 +54,18 @@ type Options struct {
 	logto    string
 	loglevel string
 	// authtoken string
-	httpauth  string
-	hostname  string
-	server    string
-	protocol  string
-	subdomain string
-	command   string
-	args      []string
+	httpauth   string
+	hostname   string
+	path       string
+	group      string
+	hold       bool
+	server     string
+	protocol   string
+	domain     string
+	subdomain  string
+	remoteaddr string
+	command    string
+	args       []string
 }
 
 func ParseArgs() (opts *Options, err error) {
@@ -85,7 +103,12 @@ func ParseArgs() (opts *Options, err error) {
 	server := flag.String(
 		"server",
 		"",
-		"ngrok server to connect to `hostname[:port]` (defaults to port 4443 if omitted")
+		"ngrok server to connect to `hostname[:port]` (defaults to port 4443 if omitted), wss://hostname[:port][/path] to connect over websockets or quic://hostname[:port] to connect over QUIC")
+
+	domain := flag.String(
+		"domain",
+		"",
+		"Request a tunnel on one of the ngrok server's base domains instead of your auth token's default one")
 
 	subdomain := flag.String(
 		"subdomain",
@@ -95,24 +118,49 @@ func ParseArgs() (opts *Options, err error) {
 	hostname := flag.String(
 		"hostname",
 		"",
-		"Request a custom hostname from the ngrok server. (HTTP only) (requires CNAME of your DNS)")
+		"Request a custom hostname from the ngrok server, *.example.com for all of its subdomains. (HTTP only) (requires CNAME of your DNS)")
+
+	path := flag.String(
+		"path",
+		"",
+		"Only serve the requests under this path prefix, e.g. /api, of the tunnel's hostname. (HTTP only)")
+
+	group := flag.String(
+		"group",
+		"",
+		"Share the tunnel's hostname or subdomain with the other agents of your auth token in this pooled group, balancing connections across them. (HTTP only)")
+
+	hold := flag.Bool(
+		"hold",
+		false,
+		"Keep the tunnel's url for a while when the connection to the ngrok server drops, queuing its requests until ngrok reconnects. (HTTP only)")
 
 	protocol := flag.String(
 		"proto",
 		"http+https",
-		"The protocol of the traffic over the tunnel {'http', 'https', 'tcp'} (default: 'http+https')")
+		"The protocol of the traffic over the tunnel {'http', 'https', 'tcp', 'udp', 'connect'} (default: 'http+https')")
+
+	remoteaddr := flag.String(
+		"remote-addr",
+		"",
+		"The address on the ngrok server's network to connect to `host:port` (connect only)")
 
 	flag.Parse()
 
 	opts = &Options{
-		config:    *config,
-		logto:     *logto,
-		loglevel:  *loglevel,
-		httpauth:  *httpauth,
-		subdomain: *subdomain,
-		protocol:  *protocol,
+		config:     *config,
+		logto:      *logto,
+		loglevel:   *loglevel,
+		httpauth:   *httpauth,
+		domain:     *domain,
+		subdomain:  *subdomain,
+		protocol:   *protocol,
+		remoteaddr: *remoteaddr,
 		// authtoken: *authtoken,
 		hostname: *hostname,
+		path:     *path,
+		group:    *group,
+		hold:     *hold,
 		server:   *server,
 		command:  flag.Arg(0),
 	}
@@ -126,6 +174,10 @@ func ParseArgs() (opts *Options, err error) {
 		opts.args = flag.Args()[1:]
 	case "start-all":
 		opts.args = flag.Args()[1:]
+	case "har-export":
+		opts.args = flag.Args()[1:]
+	case "har-import":
+		opts.args = flag.Args()[1:]
 	case "version":
 		fmt.Println(version.MajorMinor())
 		os.Exit(0)
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -20,6 +21,8 @@ type Configuration struct {
 	ServerAddr         string                          `yaml:"server_addr,omitempty"`
 	InspectAddr        string                          `yaml:"inspect_addr,omitempty"`
 	TrustHostRootCerts bool                            `yaml:"trust_host_root_certs,omitempty"`
+	ClientCert         string                          `yaml:"client_cert,omitempty"`
+	ClientKey          string                          `yaml:"client_key,omitempty"`
 	AuthToken          map[string]string               `yaml:"auth_token,omitempty"`
 	Tunnels            map[string]*TunnelConfiguration `yaml:"tunnels,omitempty"`
 	LogTo              string                          `yaml:"-"`
@@ -27,11 +30,37 @@ type Configuration struct {
 }
 
 type TunnelConfiguration struct {
-	Subdomain  string            `yaml:"subdomain,omitempty"`
-	Hostname   string            `yaml:"hostname,omitempty"`
-	Protocols  map[string]string `yaml:"proto,omitempty"`
-	HttpAuth   string            `yaml:"auth,omitempty"`
-	RemotePort uint16            `yaml:"remote_port,omitempty"`
+	Domain     string               `yaml:"domain,omitempty"`
+	Subdomain  string               `yaml:"subdomain,omitempty"`
+	Hostname   string               `yaml:"hostname,omitempty"`
+	Path       string               `yaml:"path,omitempty"`
+	Group      string               `yaml:"group,omitempty"`
+	Hold       bool                 `yaml:"hold,omitempty"`
+	Protocols  map[string]string    `yaml:"proto,omitempty"`
+	HttpAuth   string               `yaml:"auth,omitempty"`
+	RemotePort uint16               `yaml:"remote_port,omitempty"`
+	RemoteAddr string               `yaml:"remote_addr,omitempty"`
+	Rules      []*RuleConfiguration `yaml:"rules,omitempty"`
+
+	// reject http requests without a valid webhook signature
+	VerifyWebhook *WebhookConfiguration `yaml:"verify_webhook,omitempty"`
+
+	// load balancing across several local addresses
+	Upstreams   []*UpstreamConfiguration  `yaml:"upstreams,omitempty"`
+	Balance     string                    `yaml:"balance,omitempty"`
+	HealthCheck *HealthCheckConfiguration `yaml:"health_check,omitempty"`
+
+	// for https:// local addresses
+	UpstreamTLS *UpstreamTLSConfiguration `yaml:"upstream_tls,omitempty"`
+
+	// for file:// local addresses, list directories even if they have
+	// an index.html. Dotfiles and symlinks leaving the directory are never
+	// served.
+	DisableIndex bool `yaml:"disable_index,omitempty"`
+
+	// start connections to the local service with a PROXY protocol v2
+	// header telling the public client's address
+	ProxyProtocol bool `yaml:"proxy_protocol,omitempty"`
 }
 
 const (
@@ -111,10 +140,6 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 		config.InspectAddr = defaultInspectAddr
 	}
 
-	if config.HttpProxy == "" {
-		config.HttpProxy = os.Getenv("http_proxy")
-	}
-
 	// validate and normalize configuration
 	if config.InspectAddr != "disabled" {
 		if config.InspectAddr, err = normalizeAddress(config.InspectAddr, "inspect_addr"); err != nil {
@@ -122,22 +147,36 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 		}
 	}
 
-	if config.ServerAddr, err = normalizeAddress(config.ServerAddr, "server_addr"); err != nil {
+	if config.ServerAddr, err = normalizeServerAddress(config.ServerAddr); err != nil {
 		return
 	}
 
+	if config.HttpProxy == "" {
+		config.HttpProxy = proxyFromEnvironment(serverHostPort(config.ServerAddr))
+	}
+
 	if config.HttpProxy != "" {
 		var proxyUrl *url.URL
 		if proxyUrl, err = url.Parse(config.HttpProxy); err != nil {
 			return
 		} else {
-			if proxyUrl.Scheme != "http" && proxyUrl.Scheme != "https" {
-				err = fmt.Errorf("Proxy url scheme must be 'http' or 'https', got %v", proxyUrl.Scheme)
+			switch proxyUrl.Scheme {
+			case "http", "https", "socks5", "socks5h":
+			default:
+				err = fmt.Errorf("Proxy url scheme must be 'http', 'https', 'socks5' or 'socks5h', got %v", proxyUrl.Scheme)
 				return
 			}
 		}
 	}
 
+	// authenticate with a client certificate instead of an auth token
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if _, err = tls.LoadX509KeyPair(config.ClientCert, config.ClientKey); err != nil {
+			err = fmt.Errorf("Failed to load client_cert and client_key: %v", err)
+			return
+		}
+	}
+
 	for name, t := range config.Tunnels {
 		if t == nil || t.Protocols == nil || len(t.Protocols) == 0 {
 			err = fmt.Errorf("Tunnel %s does not specify any protocols to tunnel.", name)
@@ -146,13 +185,87 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 
 		for k, addr := range t.Protocols {
 			tunnelName := fmt.Sprintf("for tunnel %s[%s]", name, k)
-			if t.Protocols[k], err = normalizeAddress(addr, tunnelName); err != nil {
+			if t.Protocols[k], err = normalizeLocalAddress(addr, tunnelName); err != nil {
 				return
 			}
 
 			if err = validateProtocol(k, tunnelName); err != nil {
 				return
 			}
+
+			if err = validateLocalTarget(k, t.Protocols[k], tunnelName); err != nil {
+				return
+			}
+		}
+
+		if err = validateConnect(t, fmt.Sprintf("for tunnel %s", name)); err != nil {
+			return
+		}
+
+		if len(t.Upstreams) > 0 {
+			for k, addr := range t.Protocols {
+				if strings.HasPrefix(addr, "file://") {
+					err = fmt.Errorf("Tunnel %s serves a directory and may not have upstreams", name)
+					return
+				}
+
+				if k == "udp" || k == "connect" {
+					err = fmt.Errorf("Tunnel %s forwards %s and may not have upstreams", name, k)
+					return
+				}
+			}
+		}
+
+		for i, u := range t.Upstreams {
+			if u == nil {
+				err = fmt.Errorf("Tunnel %s has an empty upstream", name)
+				return
+			}
+
+			if u.Addr, err = normalizeLocalAddress(u.Addr, fmt.Sprintf("for tunnel %s upstream %d", name, i)); err != nil {
+				return
+			}
+
+			if strings.HasPrefix(u.Addr, "file://") {
+				err = fmt.Errorf("Invalid address for tunnel %s upstream %d: directories can't be balanced across", name, i)
+				return
+			}
+		}
+
+		if err = validateBalance(t.Balance, fmt.Sprintf("for tunnel %s", name)); err != nil {
+			return
+		}
+
+		if err = validateProxyProtocol(t, fmt.Sprintf("for tunnel %s", name)); err != nil {
+			return
+		}
+
+		if t.UpstreamTLS != nil {
+			if err = t.UpstreamTLS.compile(fmt.Sprintf("for tunnel %s", name)); err != nil {
+				return
+			}
+		}
+
+		if t.HealthCheck != nil {
+			if err = t.HealthCheck.compile(fmt.Sprintf("for tunnel %s", name)); err != nil {
+				return
+			}
+		}
+
+		if t.VerifyWebhook != nil {
+			if err = t.VerifyWebhook.compile(fmt.Sprintf("for tunnel %s", name)); err != nil {
+				return
+			}
+		}
+
+		for i, r := range t.Rules {
+			if r.Name == "" {
+				r.Name = fmt.Sprintf("%s[%d]", name, i)
+			}
+
+			if err = r.compile(fmt.Sprintf("for tunnel %s rule %s", name, r.Name)); err != nil {
+				return
+			}
 		}
 
 		// use the name of the tunnel as the subdomain if none is specified
@@ -176,10 +289,15 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 	case "default":
 		config.Tunnels = make(map[string]*TunnelConfiguration)
 		config.Tunnels["default"] = &TunnelConfiguration{
-			Subdomain: opts.subdomain,
-			Hostname:  opts.hostname,
-			HttpAuth:  opts.httpauth,
-			Protocols: make(map[string]string),
+			Domain:     opts.domain,
+			Subdomain:  opts.subdomain,
+			Hostname:   opts.hostname,
+			Path:       opts.path,
+			Group:      opts.group,
+			Hold:       opts.hold,
+			HttpAuth:   opts.httpauth,
+			RemoteAddr: opts.remoteaddr,
+			Protocols:  make(map[string]string),
 		}
 
 		for _, proto := range strings.Split(opts.protocol, "+") {
@@ -187,11 +305,19 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 				return
 			}
 
-			if config.Tunnels["default"].Protocols[proto], err = normalizeAddress(opts.args[0], ""); err != nil {
+			if config.Tunnels["default"].Protocols[proto], err = normalizeLocalAddress(opts.args[0], ""); err != nil {
+				return
+			}
+
+			if err = validateLocalTarget(proto, config.Tunnels["default"].Protocols[proto], "default"); err != nil {
 				return
 			}
 		}
 
+		if err = validateConnect(config.Tunnels["default"], "for tunnel default"); err != nil {
+			return
+		}
+
 	// list tunnels
 	case "list":
 		for name := range config.Tunnels {
@@ -215,6 +341,18 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 
 		os.Exit(0)
 
+	case "har-export":
+		if err = exportHar(config.InspectAddr, opts.args); err != nil {
+			return
+		}
+		os.Exit(0)
+
+	case "har-import":
+		if err = importHar(config.InspectAddr, opts.args); err != nil {
+			return
+		}
+		os.Exit(0)
+
 	case "start":
 		if len(opts.args) == 0 {
 			err = fmt.Errorf("You must specify at least one tunnel to start")
@@ -281,9 +419,61 @@ func normalizeAddress(addr string, propName string) (string, error) {
 	return fmt.Sprintf("%s:%s", host, port), nil
 }
 
+// Like normalizeAddress, but also accepts wss://host[:port][/path] to
+// reach the server over websockets on its public https listener and
+// quic://host[:port] to reach it over QUIC
+func normalizeServerAddress(addr string) (string, error) {
+	if hostPort, ok := cutPrefixFold(addr, "quic://"); ok {
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			hostPort = net.JoinHostPort(strings.Trim(hostPort, "[]"), "4443")
+		}
+		hostPort, err := normalizeAddress(hostPort, "server_addr")
+		if err != nil {
+			return "", err
+		}
+		return "quic://" + hostPort, nil
+	}
+
+	if !strings.HasPrefix(strings.ToLower(addr), "wss://") {
+		return normalizeAddress(addr, "server_addr")
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("Invalid address server_addr '%s'", addr)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	path := u.Path
+	if path == "" || path == "/" {
+		path = defaultWebsocketPath
+	}
+
+	return "wss://" + net.JoinHostPort(u.Hostname(), port) + path, nil
+}
+
+// The host:port part of a normalized server address
+func serverHostPort(addr string) string {
+	if u, err := url.Parse(addr); err == nil && (u.Scheme == "wss" || u.Scheme == "quic") {
+		return u.Host
+	}
+	return addr
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
+
 func validateProtocol(proto, propName string) (err error) {
 	switch proto {
-	case "http", "https", "http+https", "tcp":
+	case "http", "https", "http+https", "tcp", "udp", "connect":
 	default:
 		err = fmt.Errorf("Invalid protocol for %s: %s", propName, proto)
 	}
@@ -291,6 +481,22 @@ func validateProtocol(proto, propName string) (err error) {
 	return
 }
 
+// Directories are served over http, so they can't be tunneled as tcp or
+// udp, udp can only be forwarded to a plain host:port and connect tunnels
+// listen on one
+func validateLocalTarget(proto, addr, propName string) error {
+	switch {
+	case proto == "connect" && strings.Contains(addr, "://"):
+		return fmt.Errorf("Invalid address for %s: connect tunnels listen on host:port, got %s", propName, addr)
+	case proto != "tcp" && proto != "udp":
+	case strings.HasPrefix(addr, "file://"):
+		return fmt.Errorf("Invalid protocol for %s: %s can only be served over http or https", propName, addr)
+	case proto == "udp" && strings.Contains(addr, "://"):
+		return fmt.Errorf("Invalid address for %s: udp can only be forwarded to host:port, got %s", propName, addr)
+	}
+	return nil
+}
+
 func SaveAuthToken(configPath, serverAddr, authtoken string) (err error) {
 	// empty configuration by default for the case that we can't read it
 	c := new(Configuration)
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"ngrok/pkg/client/mvc"
+	"ngrok/pkg/conn"
+	"ngrok/pkg/msg"
+	"strings"
+	"time"
+)
+
+// Starts accepting local connections for a connect tunnel. The listener
+// is kept across reconnects to the server, which announce the tunnel again.
+func (c *ClientModel) listenConnect(tunnel mvc.Tunnel) error {
+	if _, ok := c.connectLns[tunnel.LocalAddr]; ok {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", tunnel.LocalAddr)
+	if err != nil {
+		return err
+	}
+	c.connectLns[tunnel.LocalAddr] = l
+	c.Info("Listening on %s for connections to %s", l.Addr(), tunnel.PublicUrl)
+
+	c.ctl.Go(func() {
+		for {
+			rawConn, err := l.Accept()
+			if err != nil {
+				c.Error("Failed to accept connection for %s: %v", tunnel.PublicUrl, err)
+				return
+			}
+
+			localConn := conn.Wrap(rawConn, "prv")
+			localConn.Info("New connection from %v", rawConn.RemoteAddr())
+			go c.connect(localConn, tunnel)
+		}
+	})
+
+	return nil
+}
+
+// Carries a local connection to the server, which connects it to the
+// tunnel's address on its network
+func (c *ClientModel) connect(localConn conn.Conn, tunnel mvc.Tunnel) {
+	defer localConn.Close()
+
+	start := time.Now()
+	remoteConn, err := c.dialServer("cnct")
+	if err != nil {
+		localConn.Error("Failed to establish connect connection: %v", err)
+		return
+	}
+	defer remoteConn.Close()
+
+	addr := strings.TrimPrefix(tunnel.PublicUrl, "connect://")
+	if err = msg.WriteMsg(remoteConn, &msg.RegConnect{ClientId: c.id, User: c.authToken, Addr: addr}); err != nil {
+		remoteConn.Error("Failed to write RegConnect: %v", err)
+		return
+	}
+
+	var resp msg.ConnectResp
+	if err = msg.ReadMsgInto(remoteConn, &resp); err != nil {
+		remoteConn.Error("Server failed to write ConnectResp: %v", err)
+		return
+	}
+
+	if resp.Error != "" {
+		remoteConn.Warn("Server failed to connect to %s: %s", addr, resp.Error)
+		return
+	}
+
+	m := c.metrics
+	m.proxySetupTimer.Update(time.Since(start))
+	m.connMeter.Mark(1)
+	c.update()
+	m.connTimer.Time(func() {
+		localConn := tunnel.Protocol.WrapConn(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: localConn.RemoteAddr().String()})
+		bytesIn, bytesOut := conn.Join(localConn, remoteConn)
+		m.bytesIn.Update(bytesIn)
+		m.bytesOut.Update(bytesOut)
+		m.bytesInCount.Inc(bytesIn)
+		m.bytesOutCount.Inc(bytesOut)
+	})
+	c.update()
+}
+
+// Connect tunnels listen on a local address for connections to an address
+// on the server's network, they can't be combined with other protocols
+func validateConnect(t *TunnelConfiguration, propName string) error {
+	if _, ok := t.Protocols["connect"]; !ok {
+		if t.RemoteAddr != "" {
+			return fmt.Errorf("Invalid remote_addr %s: only connect tunnels have a remote address", propName)
+		}
+		return nil
+	}
+
+	if len(t.Protocols) > 1 {
+		return fmt.Errorf("Invalid protocols %s: connect can't be combined with other protocols", propName)
+	}
+
+	if t.RemoteAddr == "" {
+		return fmt.Errorf("Missing remote_addr %s: connect tunnels need the address to connect to", propName)
+	}
+
+	if _, _, err := net.SplitHostPort(t.RemoteAddr); err != nil {
+		return fmt.Errorf("Invalid remote_addr %s '%s': %v", propName, t.RemoteAddr, err)
+	}
+
+	return nil
+}
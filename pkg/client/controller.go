@@ -24,6 +24,9 @@ type cmdPlayRequest struct {
 
 	// the bytes of the request to issue
 	payload []byte
+
+	// how many times and with what concurrency
+	opts mvc.PlayOptions
 }
 
 // The MVC Controller
@@ -79,8 +82,8 @@ func (ctl *Controller) Shutdown(message string) {
 	ctl.cmds <- cmdQuit{message: message}
 }
 
-func (ctl *Controller) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
-	ctl.cmds <- cmdPlayRequest{tunnel: tunnel, payload: payload}
+func (ctl *Controller) PlayRequest(tunnel mvc.Tunnel, payload []byte, opts mvc.PlayOptions) {
+	ctl.cmds <- cmdPlayRequest{tunnel: tunnel, payload: payload, opts: opts}
 }
 
 func (ctl *Controller) Go(fn func()) {
@@ -122,6 +125,42 @@ func (ctl *Controller) doShutdown() {
 	wg.Wait()
 }
 
+// Plays a request opts.Count times, with at most opts.Concurrency plays in flight
+func (ctl *Controller) playRequest(cmd cmdPlayRequest) {
+	count, concurrency := cmd.opts.Count, cmd.opts.Concurrency
+	if count < 1 {
+		count = 1
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > count {
+		concurrency = count
+	}
+
+	if count > 1 {
+		ctl.Info("Playing request %d times with concurrency %d", count, concurrency)
+	}
+
+	var wg sync.WaitGroup
+	plays := make(chan int)
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		ctl.Go(func() {
+			defer wg.Done()
+			for range plays {
+				ctl.model.PlayRequest(cmd.tunnel, cmd.payload, cmd.opts)
+			}
+		})
+	}
+
+	for i := 0; i < count; i++ {
+		plays <- i
+	}
+	close(plays)
+	wg.Wait()
+}
+
 func (ctl *Controller) AddView(v mvc.View) {
 	ctl.views = append(ctl.views, v)
 }
@@ -203,7 +242,7 @@ func (ctl *Controller) Run(config *Configuration) {
 				}()
 
 			case cmdPlayRequest:
-				ctl.Go(func() { ctl.model.PlayRequest(cmd.tunnel, cmd.payload) })
+				ctl.Go(func() { ctl.playRequest(cmd) })
 			}
 
 		case obj := <-updates:
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"ngrok/pkg/client/log"
+	"ngrok/pkg/conn"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Serves a local directory for tunnels whose local address is file://.
+// Connections are handed to an in-process http server over a pipe, so they
+// are inspected and joined exactly like connections to a real local service.
+//
+// Files and directories whose name starts with a dot, like .git or .env,
+// are neither served nor listed, and neither are symlinks which lead
+// outside of the served directory.
+type fileServer struct {
+	log.Logger
+	root  string
+	conns chan net.Conn
+	done  chan struct{}
+	close sync.Once
+}
+
+func newFileServer(name, root string, disableIndex bool) *fileServer {
+	s := &fileServer{
+		Logger: log.NewPrefixLogger("file", name),
+		root:   root,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+
+	var fs http.FileSystem = publicFileSystem{http.Dir(root), root}
+	if disableIndex {
+		fs = noIndexFileSystem{fs}
+	}
+
+	// http.FileServer takes care of directory listings, range requests
+	// and serving index.html
+	go func() {
+		err := http.Serve(s, http.FileServer(fs))
+		s.Debug("Stopped serving %s: %v", root, err)
+	}()
+
+	return s
+}
+
+// Opens a connection to the file server
+func (s *fileServer) dial() (conn.Conn, error) {
+	agentSide, serverSide := net.Pipe()
+	select {
+	case s.conns <- serverSide:
+		return conn.Wrap(agentSide, "prv"), nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// fileServer is the net.Listener of its own http server
+func (s *fileServer) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.conns:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *fileServer) Close() error {
+	s.close.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *fileServer) Addr() net.Addr {
+	return fileAddr(s.root)
+}
+
+type fileAddr string
+
+func (a fileAddr) Network() string { return "file" }
+func (a fileAddr) String() string  { return "file://" + string(a) }
+
+// Hides index.html files so that directories are always listed
+type noIndexFileSystem struct {
+	http.FileSystem
+}
+
+func (fs noIndexFileSystem) Open(name string) (http.File, error) {
+	if path.Base(name) == "index.html" {
+		return nil, os.ErrNotExist
+	}
+	return fs.FileSystem.Open(name)
+}
+
+// Refuses dot-prefixed path elements and symlinks leaving root, and leaves
+// dotfiles out of directory listings
+type publicFileSystem struct {
+	http.FileSystem
+	root string
+}
+
+func (fs publicFileSystem) Open(name string) (http.File, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+
+	if !fs.contains(filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+name)))) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return publicFile{f}, nil
+}
+
+// Whether the file at p, once its symlinks are resolved, is still inside
+// the root directory
+func (fs publicFileSystem) contains(p string) bool {
+	root, err := filepath.EvalSymlinks(fs.root)
+	if err != nil {
+		return false
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+type publicFile struct {
+	http.File
+}
+
+func (f publicFile) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := f.File.Readdir(count)
+	visible := entries[:0]
+	for _, fi := range entries {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			visible = append(visible, fi)
+		}
+	}
+	return visible, err
+}
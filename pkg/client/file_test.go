@@ -0,0 +1,61 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileServerHidesPrivateFiles(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	writeFile(t, filepath.Join(root, "public.txt"), "public")
+	writeFile(t, filepath.Join(root, ".env"), "secret")
+	writeFile(t, filepath.Join(root, ".git", "config"), "secret")
+	writeFile(t, filepath.Join(outside, "passwd"), "secret")
+	for link, target := range map[string]string{
+		"passwd": filepath.Join(outside, "passwd"),
+		"etc":    outside,
+		"alias":  filepath.Join(root, "public.txt"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := http.FileServer(publicFileSystem{http.Dir(root), root})
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	for _, target := range []string{"/public.txt", "/alias"} {
+		if w := get(target); w.Code != 200 || w.Body.String() != "public" {
+			t.Errorf("GET %s: %d %q", target, w.Code, w.Body)
+		}
+	}
+
+	for _, target := range []string{"/.env", "/.git/config", "/.git/", "/passwd", "/etc/passwd", "/etc/"} {
+		if w := get(target); w.Code != 404 {
+			t.Errorf("GET %s: %d %q", target, w.Code, w.Body)
+		}
+	}
+
+	if listing := get("/").Body.String(); !strings.Contains(listing, "public.txt") || strings.Contains(listing, ".env") || strings.Contains(listing, ".git") {
+		t.Errorf("listing %q", listing)
+	}
+}
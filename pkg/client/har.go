@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// HAR export and import talk to the web inspection interface of an
+// already running ngrok client, because that's where the captured
+// transactions and the tunnels live.
+var harClient = &http.Client{Timeout: 30 * time.Second}
+
+func inspectUrl(inspectAddr, path string) (string, error) {
+	if inspectAddr == "disabled" {
+		return "", fmt.Errorf("The web inspection interface is disabled, HAR export and import are unavailable")
+	}
+	return "http://" + inspectAddr + path, nil
+}
+
+// ngrok har-export [file]
+func exportHar(inspectAddr string, args []string) error {
+	endpoint, err := inspectUrl(inspectAddr, "/http/in/har")
+	if err != nil {
+		return err
+	}
+
+	resp, err := harClient.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("Failed to reach ngrok on %s, is it running? %v", inspectAddr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Failed to export HAR: %s", resp.Status)
+	}
+
+	out := io.Writer(os.Stdout)
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return fmt.Errorf("Failed to create %s: %v", args[0], err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// ngrok har-import <file> [tunnel url]
+func importHar(inspectAddr string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("You must specify a HAR file to import e.g.: ngrok har-import requests.har")
+	}
+
+	endpoint, err := inspectUrl(inspectAddr, "/http/in/har/import")
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 1 {
+		endpoint += "?tunnel=" + url.QueryEscape(args[1])
+	}
+
+	harBuf, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("Failed to read HAR file %s: %v", args[0], err)
+	}
+
+	resp, err := harClient.Post(endpoint, "application/json", bytes.NewReader(harBuf))
+	if err != nil {
+		return fmt.Errorf("Failed to reach ngrok on %s, is it running? %v", inspectAddr, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Failed to import HAR: %s", bytes.TrimSpace(body))
+	}
+
+	var result struct{ Replayed int }
+	if err = json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("Replaying %d requests from %s\n", result.Replayed, args[0])
+	return nil
+}
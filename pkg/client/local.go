@@ -0,0 +1,282 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/netip"
+	"ngrok/pkg/client/mvc"
+	"ngrok/pkg/conn"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TLS options for tunnels whose local address is https://
+type UpstreamTLSConfiguration struct {
+	ServerName         string `yaml:"server_name,omitempty"`
+	CA                 string `yaml:"ca,omitempty"`
+	Cert               string `yaml:"cert,omitempty"`
+	Key                string `yaml:"key,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+
+	config *tls.Config
+}
+
+func (u *UpstreamTLSConfiguration) compile(propName string) error {
+	u.config = &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CA != "" {
+		caBuf, err := os.ReadFile(u.CA)
+		if err != nil {
+			return fmt.Errorf("Failed to read CA certificate %s: %v", propName, err)
+		}
+
+		u.config.RootCAs = x509.NewCertPool()
+		if !u.config.RootCAs.AppendCertsFromPEM(caBuf) {
+			return fmt.Errorf("No PEM certificates found in CA file %s: %s", propName, u.CA)
+		}
+	}
+
+	if u.Cert != "" || u.Key != "" {
+		cert, err := tls.LoadX509KeyPair(u.Cert, u.Key)
+		if err != nil {
+			return fmt.Errorf("Failed to load client certificate %s: %v", propName, err)
+		}
+		u.config.Certificates = []tls.Certificate{cert}
+	}
+
+	return nil
+}
+
+func (t *TunnelConfiguration) upstreamTLSConfig() *tls.Config {
+	if t.UpstreamTLS == nil {
+		return nil
+	}
+	return t.UpstreamTLS.config
+}
+
+// Like normalizeAddress, but also accepts http://, https://, unix:// and
+// file:// local addresses. The http:// scheme is dropped since it's the
+// default, unix socket paths and served directories are made absolute.
+func normalizeLocalAddress(addr string, propName string) (string, error) {
+	lower := strings.ToLower(addr)
+	switch {
+	case strings.HasPrefix(lower, "file://"):
+		dir := addr[len("file://"):]
+		if dir == "" {
+			return "", fmt.Errorf("Invalid address %s '%s': missing directory", propName, addr)
+		}
+
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", fmt.Errorf("Invalid address %s '%s': %v", propName, addr, err)
+		}
+
+		if fi, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("Invalid address %s '%s': %v", propName, addr, err)
+		} else if !fi.IsDir() {
+			return "", fmt.Errorf("Invalid address %s '%s': not a directory", propName, addr)
+		}
+		return "file://" + dir, nil
+
+	case strings.HasPrefix(lower, "unix://"):
+		path := addr[len("unix://"):]
+		if path == "" {
+			return "", fmt.Errorf("Invalid address %s '%s': missing socket path", propName, addr)
+		}
+
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return "", fmt.Errorf("Invalid address %s '%s': %v", propName, addr, err)
+		}
+		return "unix://" + path, nil
+
+	case strings.HasPrefix(lower, "http://"):
+		return normalizeAddress(addr[len("http://"):], propName)
+
+	case strings.HasPrefix(lower, "https://"):
+		hostPort := strings.TrimSuffix(addr[len("https://"):], "/")
+		if _, err := strconv.Atoi(hostPort); err != nil {
+			if _, _, err := net.SplitHostPort(hostPort); err != nil {
+				hostPort += ":443"
+			}
+		}
+
+		normalized, err := normalizeAddress(hostPort, propName)
+		if err != nil {
+			return "", err
+		}
+		return "https://" + normalized, nil
+
+	default:
+		return normalizeAddress(addr, propName)
+	}
+}
+
+// How the agent reaches the local side of an established tunnel
+type localTarget struct {
+	// mocking and fault injection rules, http tunnels only
+	rules []*RuleConfiguration
+
+	// verifies the signatures of webhook requests, http tunnels only
+	webhook *WebhookConfiguration
+
+	// set if the tunnel balances across several upstreams
+	pool *upstreamPool
+
+	// for https:// local addresses
+	tlsConfig *tls.Config
+
+	// for file:// local addresses, served by the agent itself
+	files *fileServer
+
+	// whether connections to the local service start with a PROXY
+	// protocol header
+	proxyProtocol bool
+}
+
+// Opens the private leg of a tunnel connection to the local service, for
+// a connection from the public client at clientAddr
+func (c *ClientModel) dialLocal(tunnel mvc.Tunnel, clientAddr string) (conn.Conn, error) {
+	registered, target := c.lookupTunnel(tunnel.PublicUrl)
+	if target == nil {
+		target = new(localTarget)
+	}
+
+	if tunnel.Protocol.GetName() == "udp" {
+		return conn.DialUDP(tunnel.LocalAddr, "prv")
+	}
+
+	dial := func() (conn.Conn, error) {
+		return dialLocalAddr(tunnel.LocalAddr, target.tlsConfig)
+	}
+
+	// balance across upstreams unless the caller asked for a specific
+	// local address, like when replaying to a different port
+	if target.pool != nil && registered.LocalAddr == tunnel.LocalAddr {
+		dial = target.pool.dial
+	}
+
+	if target.files != nil && registered.LocalAddr == tunnel.LocalAddr {
+		dial = target.files.dial
+	}
+
+	if target.proxyProtocol {
+		dial = dialProxyProtocol(dial, clientAddr)
+	}
+
+	if len(target.rules) > 0 || target.webhook != nil {
+		return dialRules(tunnel.PublicUrl, tunnel.LocalAddr, dial, target.rules, target.webhook), nil
+	}
+
+	return dial()
+}
+
+// Wraps dial to start connections with a PROXY protocol v2 header telling
+// that they come from the public client at clientAddr. Replayed requests
+// have no client, their header tells so.
+func dialProxyProtocol(dial func() (conn.Conn, error), clientAddr string) func() (conn.Conn, error) {
+	var src net.Addr
+	if addrPort, err := netip.ParseAddrPort(clientAddr); err == nil {
+		src = net.TCPAddrFromAddrPort(addrPort)
+	}
+
+	return func() (conn.Conn, error) {
+		c, err := dial()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = c.Write(conn.ProxyHeaderV2(src, c.RemoteAddr())); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// The header goes in front of the plain connection to the local service,
+// which rules out the ones the agent makes over TLS or serves itself
+func validateProxyProtocol(t *TunnelConfiguration, propName string) error {
+	if !t.ProxyProtocol {
+		return nil
+	}
+
+	addrs := make([]string, 0, len(t.Protocols)+len(t.Upstreams))
+	for proto, addr := range t.Protocols {
+		if proto == "udp" || proto == "connect" {
+			return fmt.Errorf("Invalid proxy_protocol %s: %s tunnels don't support it", propName, proto)
+		}
+		addrs = append(addrs, addr)
+	}
+	for _, u := range t.Upstreams {
+		addrs = append(addrs, u.Addr)
+	}
+
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "https://") || strings.HasPrefix(addr, "file://") {
+			return fmt.Errorf("Invalid proxy_protocol %s: the local address %s doesn't support it", propName, addr)
+		}
+	}
+	return nil
+}
+
+// Splits a normalized local address into what net.Dial needs and whether
+// the local service speaks TLS
+func splitLocalAddr(addr string) (network, address string, isTLS bool) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return "unix", path, false
+	}
+
+	if hostPort, ok := strings.CutPrefix(addr, "https://"); ok {
+		return "tcp", hostPort, true
+	}
+
+	return "tcp", addr, false
+}
+
+// Dials a local address: host:port for plaintext, https://host:port for
+// services that only speak TLS or unix:///path for unix domain sockets
+func dialLocalAddr(addr string, tlsCfg *tls.Config) (conn.Conn, error) {
+	if strings.HasPrefix(addr, "file://") {
+		return nil, fmt.Errorf("%s is served by the tunnel's file server and can't be dialed", addr)
+	}
+
+	hostPort, ok := strings.CutPrefix(addr, "https://")
+	if !ok {
+		return conn.Dial(addr, "prv", nil)
+	}
+
+	if tlsCfg == nil {
+		tlsCfg = new(tls.Config)
+	}
+
+	if tlsCfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ServerName = host
+	}
+
+	return conn.Dial(hostPort, "prv", tlsCfg)
+}
+
+// The response written to the public side when the local service is
+// unreachable, a human is likely to see it in HTTP mode
+func badGatewayResponse(publicUrl, localAddr string) []byte {
+	badGatewayBody := fmt.Sprintf(BadGateway, publicUrl, localAddr, localAddr)
+	return []byte(fmt.Sprintf(`HTTP/1.0 502 Bad Gateway
+Content-Type: text/html
+Content-Length: %d
+
+%s`, len(badGatewayBody), badGatewayBody))
+}
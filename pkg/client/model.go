@@ -1,11 +1,14 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"net/http"
 	"ngrok/pkg/client/log"
 	"ngrok/pkg/client/mvc"
 	"ngrok/pkg/conn"
@@ -15,6 +18,7 @@ import (
 	"ngrok/pkg/version"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -22,12 +26,14 @@ import (
 )
 
 const (
-	defaultServerAddr   = "ngrokd.ngrok.com:443"
-	defaultInspectAddr  = "127.0.0.1:4040"
-	pingInterval        = 20 * time.Second
-	maxPongLatency      = 15 * time.Second
-	updateCheckInterval = 6 * time.Hour
-	BadGateway          = `<html>
+	defaultServerAddr    = "ngrokd.ngrok.com:443"
+	defaultInspectAddr   = "127.0.0.1:4040"
+	defaultWebsocketPath = "/_ngrok/tunnel"
+	pingInterval         = 20 * time.Second
+	maxPongLatency       = 15 * time.Second
+	updateCheckInterval  = 6 * time.Hour
+	tunnelWaitTimeout    = 5 * time.Second
+	BadGateway           = `<html>
 <body style="background-color: #97a8b9">
     <div style="margin:auto; width:400px;padding: 20px 60px; background-color: #D3D3D3; border: 5px solid maroon;">
         <h2>Tunnel %s unavailable</h2>
@@ -40,7 +46,10 @@ type ClientModel struct {
 
 	id            string
 	tunnels       map[string]mvc.Tunnel
+	tunnelsLock   *sync.Mutex // guards tunnels and targets
+	tunnelAdded   *sync.Cond  // on tunnelsLock
 	serverVersion string
+	serverCaps    []string
 	metrics       *ClientMetrics
 	updateStatus  mvc.UpdateStatus
 	connStatus    mvc.ConnStatus
@@ -52,7 +61,12 @@ type ClientModel struct {
 	authToken     string
 	tlsConfig     *tls.Config
 	tunnelConfig  map[string]*TunnelConfiguration
+	targets       map[string]*localTarget
+	upstreamPools map[string]*upstreamPool
+	fileServers   map[string]*fileServer
+	connectLns    map[string]net.Listener
 	configPath    string
+	quic          *quicTransport
 }
 
 func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
@@ -60,7 +74,9 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 	protoMap["http"] = proto.NewHttp()
 	protoMap["https"] = protoMap["http"]
 	protoMap["tcp"] = proto.NewTcp()
-	protocols := []proto.Protocol{protoMap["http"], protoMap["tcp"]}
+	protoMap["udp"] = proto.NewUdp()
+	protoMap["connect"] = proto.NewConnect()
+	protocols := []proto.Protocol{protoMap["http"], protoMap["tcp"], protoMap["udp"], protoMap["connect"]}
 
 	m := &ClientModel{
 		Logger: log.NewPrefixLogger("client"),
@@ -90,7 +106,8 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 		protocols: protocols,
 
 		// open tunnels
-		tunnels: make(map[string]mvc.Tunnel),
+		tunnels:     make(map[string]mvc.Tunnel),
+		tunnelsLock: new(sync.Mutex),
 
 		// controller
 		ctl: ctl,
@@ -98,8 +115,44 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 		// tunnel configuration
 		tunnelConfig: config.Tunnels,
 
+		// how to reach the local side of each tunnel by public url
+		targets: make(map[string]*localTarget),
+
+		// upstream pools by tunnel name and local address
+		upstreamPools: make(map[string]*upstreamPool),
+
+		// file servers by tunnel name and local address
+		fileServers: make(map[string]*fileServer),
+
+		// local listeners of connect tunnels by local address
+		connectLns: make(map[string]net.Listener),
+
 		// config path
 		configPath: config.Path,
+
+		// QUIC session of quic:// servers
+		quic: new(quicTransport),
+	}
+	m.tunnelAdded = sync.NewCond(m.tunnelsLock)
+
+	for name, t := range config.Tunnels {
+		for _, addr := range t.Protocols {
+			key := name + "|" + addr
+			if root, ok := strings.CutPrefix(addr, "file://"); ok {
+				if _, ok := m.fileServers[key]; !ok {
+					m.fileServers[key] = newFileServer(name, root, t.DisableIndex)
+				}
+				continue
+			}
+
+			if len(t.Upstreams) == 0 {
+				continue
+			}
+
+			if _, ok := m.upstreamPools[key]; !ok {
+				m.upstreamPools[key] = newUpstreamPool(name, addr, t)
+			}
+		}
 	}
 
 	// configure TLS
@@ -114,8 +167,21 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 		}
 	}
 
+	// present the client certificate, reloaded for every connection so
+	// that short-lived certificates can be renewed on disk
+	if config.ClientCert != "" {
+		m.tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+			if err != nil {
+				m.Error("Failed to load client certificate: %v", err)
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+
 	// configure TLS SNI
-	m.tlsConfig.ServerName = serverName(m.serverAddr)
+	m.tlsConfig.ServerName = serverName(serverHostPort(m.serverAddr))
 	m.tlsConfig.InsecureSkipVerify = useInsecureSkipVerify()
 
 	return m
@@ -137,7 +203,10 @@ func serverName(addr string) string {
 func (c ClientModel) GetProtocols() []proto.Protocol { return c.protocols }
 func (c ClientModel) GetClientVersion() string       { return version.MajorMinor() }
 func (c ClientModel) GetServerVersion() string       { return c.serverVersion }
-func (c ClientModel) GetTunnels() []mvc.Tunnel {
+func (c *ClientModel) GetTunnels() []mvc.Tunnel {
+	c.tunnelsLock.Lock()
+	defer c.tunnelsLock.Unlock()
+
 	tunnels := make([]mvc.Tunnel, 0)
 	for _, t := range c.tunnels {
 		tunnels = append(tunnels, t)
@@ -164,18 +233,36 @@ func (c ClientModel) SetUpdateStatus(updateStatus mvc.UpdateStatus) {
 }
 
 // mvc.Model interface
-func (c *ClientModel) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
+func (c *ClientModel) PlayRequest(tunnel mvc.Tunnel, payload []byte, opts mvc.PlayOptions) {
 	var localConn conn.Conn
-	localConn, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
+	localConn, err := c.dialLocal(tunnel, "")
 	if err != nil {
 		c.Warn("Failed to open private leg to %s: %v", tunnel.LocalAddr, err)
 		return
 	}
 
 	defer localConn.Close()
-	localConn = tunnel.Protocol.WrapConn(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: "127.0.0.1"})
-	localConn.Write(payload)
-	io.ReadAll(localConn)
+	localConn = tunnel.Protocol.WrapConn(localConn, connContext(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: "127.0.0.1", ReplayOf: opts.ReplayOf}))
+	if _, err = localConn.Write(payload); err != nil {
+		localConn.Warn("Failed to write request: %v", err)
+		return
+	}
+
+	// read exactly one response so that we don't wait for a kept-alive
+	// connection to be closed by the local server
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		io.ReadAll(localConn)
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(localConn), req)
+	if err != nil {
+		localConn.Warn("Failed to read response: %v", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
 }
 
 func (c *ClientModel) Shutdown() {
@@ -190,6 +277,10 @@ func (c *ClientModel) Run() {
 	maxWait := 30 * time.Second
 	wait := 1 * time.Second
 
+	for _, pool := range c.upstreamPools {
+		c.ctl.Go(pool.checkHealth)
+	}
+
 	for {
 		// run the control channel
 		c.control()
@@ -217,17 +308,11 @@ func (c *ClientModel) control() {
 		}
 	}()
 
+	// every control session tries QUIC again
+	c.quic.reset()
+
 	// establish control channel
-	var (
-		ctlConn conn.Conn
-		err     error
-	)
-	if c.proxyUrl == "" {
-		// simple non-proxied case, just connect to the server
-		ctlConn, err = conn.Dial(c.serverAddr, "ctl", c.tlsConfig)
-	} else {
-		ctlConn, err = conn.DialHttpProxy(c.proxyUrl, c.serverAddr, "ctl", c.tlsConfig)
-	}
+	ctlConn, err := c.dialServer("ctl")
 	if err != nil {
 		panic(err)
 	}
@@ -241,6 +326,8 @@ func (c *ClientModel) control() {
 		Version:   version.Proto,
 		MmVersion: version.MajorMinor(),
 		User:      c.authToken,
+
+		Capabilities: msg.Capabilities,
 	}
 
 	if err = msg.WriteMsg(ctlConn, auth); err != nil {
@@ -262,14 +349,24 @@ func (c *ClientModel) control() {
 	c.id = authResp.ClientId
 	c.serverVersion = authResp.MmVersion
 	c.Info("Authenticated with server, client id: %v", c.id)
+
+	// older servers send no capabilities and keep the legacy codec
+	c.serverCaps = authResp.Capabilities
+	codec := msg.CodecFor(authResp.Capabilities)
+	c.Debug("Server capabilities %v, using the %v codec", authResp.Capabilities, codec)
 	c.update()
-	if err = SaveAuthToken(c.configPath, c.serverAddr, c.authToken); err != nil {
-		c.Error("Failed to save auth token: %v", err)
+
+	// agents authenticating with a client certificate have no token
+	if c.authToken != "" {
+		if err = SaveAuthToken(c.configPath, c.serverAddr, c.authToken); err != nil {
+			c.Error("Failed to save auth token: %v", err)
+		}
 	}
 
 	// request tunnels
 	reqIdToTunnelConfig := make(map[string]*TunnelConfiguration)
-	for _, config := range c.tunnelConfig {
+	reqIdToTunnelName := make(map[string]string)
+	for name, config := range c.tunnelConfig {
 		// create the protocol list to ask for
 		var protocols []string
 		for proto := range config.Protocols {
@@ -279,30 +376,36 @@ func (c *ClientModel) control() {
 		reqTunnel := &msg.ReqTunnel{
 			ReqId:      util.RandId(8),
 			Protocol:   strings.Join(protocols, "+"),
+			Domain:     config.Domain,
 			Hostname:   config.Hostname,
 			Subdomain:  config.Subdomain,
+			Path:       config.Path,
+			Group:      config.Group,
+			Hold:       config.Hold,
 			HttpAuth:   config.HttpAuth,
 			RemotePort: config.RemotePort,
+			RemoteAddr: config.RemoteAddr,
 		}
 
 		// send the tunnel request
-		if err = msg.WriteMsg(ctlConn, reqTunnel); err != nil {
+		if err = codec.WriteMsg(ctlConn, reqTunnel); err != nil {
 			panic(err)
 		}
 
 		// save request id association so we know which local address
 		// to proxy to later
 		reqIdToTunnelConfig[reqTunnel.ReqId] = config
+		reqIdToTunnelName[reqTunnel.ReqId] = name
 	}
 
 	// start the heartbeat
 	lastPong := time.Now().UnixNano()
-	c.ctl.Go(func() { c.heartbeat(&lastPong, ctlConn) })
+	c.ctl.Go(func() { c.heartbeat(&lastPong, ctlConn, codec) })
 
 	// main control loop
 	for {
 		var rawMsg msg.Message
-		if rawMsg, err = msg.ReadMsg(ctlConn); err != nil {
+		if rawMsg, err = codec.ReadMsg(ctlConn); err != nil {
 			panic(err)
 		}
 
@@ -321,36 +424,72 @@ func (c *ClientModel) control() {
 				continue
 			}
 
+			config := reqIdToTunnelConfig[m.ReqId]
 			tunnel := mvc.Tunnel{
 				PublicUrl: m.Url,
-				LocalAddr: reqIdToTunnelConfig[m.ReqId].Protocols[m.Protocol],
+				LocalAddr: config.Protocols[m.Protocol],
 				Protocol:  c.protoMap[m.Protocol],
 			}
 
+			key := reqIdToTunnelName[m.ReqId] + "|" + tunnel.LocalAddr
+			target := &localTarget{
+				pool:      c.upstreamPools[key],
+				tlsConfig: config.upstreamTLSConfig(),
+				files:     c.fileServers[key],
+
+				proxyProtocol: config.ProxyProtocol,
+			}
+			if tunnel.Protocol.GetName() == "http" {
+				target.rules = config.Rules
+				target.webhook = config.VerifyWebhook
+			}
+
+			c.tunnelsLock.Lock()
 			c.tunnels[tunnel.PublicUrl] = tunnel
+			c.targets[tunnel.PublicUrl] = target
+			c.tunnelAdded.Broadcast()
+			c.tunnelsLock.Unlock()
 			c.connStatus = mvc.ConnOnline
 			c.Info("Tunnel established at %v", tunnel.PublicUrl)
 			c.update()
 
+			if tunnel.Protocol.GetName() == "connect" {
+				if err := c.listenConnect(tunnel); err != nil {
+					c.Error("Failed to listen for connect tunnel %s on %s: %v", tunnel.PublicUrl, tunnel.LocalAddr, err)
+					c.ctl.Shutdown(err.Error())
+				}
+			}
+
 		default:
 			ctlConn.Warn("Ignoring unknown control message %v ", m)
 		}
 	}
 }
 
-// Establishes and manages a tunnel proxy connection with the server
-func (c *ClientModel) proxy() {
-	var (
-		remoteConn conn.Conn
-		err        error
-	)
+// Opens a new connection to the server, through the proxy if one is
+// configured, over websockets if the server address is a wss:// url and as
+// a stream of a QUIC session if it is a quic:// url
+func (c *ClientModel) dialServer(typ string) (conn.Conn, error) {
+	if strings.HasPrefix(c.serverAddr, "wss://") {
+		return conn.DialWebsocket(c.serverAddr, typ, c.tlsConfig, c.proxyUrl)
+	}
+
+	addr := serverHostPort(c.serverAddr)
+	if strings.HasPrefix(c.serverAddr, "quic://") {
+		if quicConn, err := c.quic.dial(typ, addr, c.tlsConfig, c.proxyUrl); err == nil {
+			return quicConn, nil
+		}
+	}
 
 	if c.proxyUrl == "" {
-		remoteConn, err = conn.Dial(c.serverAddr, "pxy", c.tlsConfig)
-	} else {
-		remoteConn, err = conn.DialHttpProxy(c.proxyUrl, c.serverAddr, "pxy", c.tlsConfig)
+		return conn.Dial(addr, typ, c.tlsConfig)
 	}
+	return conn.DialProxy(c.proxyUrl, addr, typ, c.tlsConfig)
+}
 
+// Establishes and manages a tunnel proxy connection with the server
+func (c *ClientModel) proxy() {
+	remoteConn, err := c.dialServer("pxy")
 	if err != nil {
 		log.Error("Failed to establish proxy connection: %v", err)
 		return
@@ -370,37 +509,49 @@ func (c *ClientModel) proxy() {
 		return
 	}
 
-	tunnel, ok := c.tunnels[startPxy.Url]
-	if !ok {
+	tunnel, target := c.waitTunnel(startPxy.Url)
+	if target == nil {
 		remoteConn.Error("Couldn't find tunnel for proxy: %s", startPxy.Url)
 		return
 	}
 
 	// start up the private connection
 	start := time.Now()
-	localConn, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
+	localConn, err := c.dialLocal(tunnel, startPxy.ClientAddr)
+	if err == nil {
+		defer localConn.Close()
+	}
+
+	// servers that know ProxyResp answer the public request themselves
+	// when the local service is unreachable
+	proxyResp := msg.HasCapability(c.serverCaps, msg.CapProxyResp)
+	if proxyResp {
+		resp := new(msg.ProxyResp)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if werr := msg.WriteMsg(remoteConn, resp); werr != nil {
+			remoteConn.Error("Failed to write ProxyResp: %v", werr)
+			return
+		}
+	}
+
 	if err != nil {
 		remoteConn.Warn("Failed to open private leg %s: %v", tunnel.LocalAddr, err)
 
-		if tunnel.Protocol.GetName() == "http" {
+		if tunnel.Protocol.GetName() == "http" && !proxyResp {
 			// try to be helpful when you're in HTTP mode and a human might see the output
-			badGatewayBody := fmt.Sprintf(BadGateway, tunnel.PublicUrl, tunnel.LocalAddr, tunnel.LocalAddr)
-			remoteConn.Write([]byte(fmt.Sprintf(`HTTP/1.0 502 Bad Gateway
-Content-Type: text/html
-Content-Length: %d
-
-%s`, len(badGatewayBody), badGatewayBody)))
+			remoteConn.Write(badGatewayResponse(tunnel.PublicUrl, tunnel.LocalAddr))
 		}
 		return
 	}
-	defer localConn.Close()
 
 	m := c.metrics
 	m.proxySetupTimer.Update(time.Since(start))
 	m.connMeter.Mark(1)
 	c.update()
 	m.connTimer.Time(func() {
-		localConn := tunnel.Protocol.WrapConn(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: startPxy.ClientAddr})
+		localConn := tunnel.Protocol.WrapConn(localConn, connContext(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: startPxy.ClientAddr}))
 		bytesIn, bytesOut := conn.Join(localConn, remoteConn)
 		m.bytesIn.Update(bytesIn)
 		m.bytesOut.Update(bytesOut)
@@ -410,8 +561,38 @@ Content-Length: %d
 	c.update()
 }
 
+// The tunnel of url and how to reach its local side
+func (c *ClientModel) lookupTunnel(url string) (mvc.Tunnel, *localTarget) {
+	c.tunnelsLock.Lock()
+	defer c.tunnelsLock.Unlock()
+	return c.tunnels[url], c.targets[url]
+}
+
+// The tunnel of url, like lookupTunnel. The server may start proxying for
+// a tunnel before its NewTunnel is handled here, e.g. the requests it held
+// while the client reconnected, so this waits for it a little.
+func (c *ClientModel) waitTunnel(url string) (mvc.Tunnel, *localTarget) {
+	expired := false
+	timer := time.AfterFunc(tunnelWaitTimeout, func() {
+		c.tunnelsLock.Lock()
+		expired = true
+		c.tunnelAdded.Broadcast()
+		c.tunnelsLock.Unlock()
+	})
+	defer timer.Stop()
+
+	c.tunnelsLock.Lock()
+	defer c.tunnelsLock.Unlock()
+	for {
+		if target := c.targets[url]; target != nil || expired {
+			return c.tunnels[url], target
+		}
+		c.tunnelAdded.Wait()
+	}
+}
+
 // Hearbeating to ensure our connection ngrokd is still live
-func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn) {
+func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn, codec *msg.Codec) {
 	lastPing := time.Unix(atomic.LoadInt64(lastPongAddr)-1, 0)
 	ping := time.NewTicker(pingInterval)
 	pongCheck := time.NewTicker(time.Second)
@@ -436,7 +617,7 @@ func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn) {
 			}
 
 		case <-ping.C:
-			err := msg.WriteMsg(conn, &msg.Ping{})
+			err := codec.WriteMsg(conn, &msg.Ping{})
 			if err != nil {
 				conn.Debug("Got error %v when writing PingMsg", err)
 				return
@@ -5,5 +5,5 @@ type Model interface {
 
 	Shutdown()
 
-	PlayRequest(tunnel Tunnel, payload []byte)
+	PlayRequest(tunnel Tunnel, payload []byte, opts PlayOptions)
 }
@@ -31,6 +31,22 @@ type Tunnel struct {
 type ConnectionContext struct {
 	Tunnel     Tunnel
 	ClientAddr string
+
+	// id of the inspected transaction this connection is replaying, if any
+	ReplayOf string
+
+	// the name of the rule that dropped the connection, if one did
+	DroppedBy func() string `json:"-"`
+}
+
+// Options for playing a request over a tunnel
+type PlayOptions struct {
+	// how many times to play the request, and how many plays may run at once
+	Count       int
+	Concurrency int
+
+	// id of the inspected transaction being replayed, if any
+	ReplayOf string
 }
 
 type State interface {
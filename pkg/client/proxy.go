@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Picks the proxy to reach the server through from the standard
+// environment variables. The connection to the server is TLS, so
+// HTTPS_PROXY takes precedence over ALL_PROXY and HTTP_PROXY. Returns the
+// empty string if no proxy is set or NO_PROXY matches the server address.
+func proxyFromEnvironment(serverAddr string) string {
+	proxyUrl := getenvAny("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "HTTP_PROXY", "http_proxy")
+	if proxyUrl == "" || noProxyMatches(getenvAny("NO_PROXY", "no_proxy"), serverAddr) {
+		return ""
+	}
+
+	// like curl, treat proxies given without a scheme as http proxies
+	if !strings.Contains(proxyUrl, "://") {
+		proxyUrl = "http://" + proxyUrl
+	}
+
+	return proxyUrl
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Whether addr should be reached directly according to a NO_PROXY list.
+// Entries are separated by commas and may be "*", a host name which also
+// matches its subdomains (optionally written .example.com or
+// *.example.com), an IP address or a CIDR block, each optionally followed
+// by a port.
+func noProxyMatches(noProxy, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if entry == "*" {
+			return true
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		if _, cidr, err := net.ParseCIDR(entryHost); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if entryIp := net.ParseIP(entryHost); entryIp != nil {
+			if ip != nil && entryIp.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
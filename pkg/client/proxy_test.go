@@ -0,0 +1,68 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestNoProxyMatches(t *testing.T) {
+	cases := []struct {
+		noProxy string
+		addr    string
+		want    bool
+	}{
+		{"", "ngrok.example.com:4443", false},
+		{"*", "ngrok.example.com:4443", true},
+		{"example.com", "example.com:4443", true},
+		{"example.com", "ngrok.example.com:4443", true},
+		{"example.com", "notexample.com:4443", false},
+		{".example.com", "ngrok.example.com:4443", true},
+		{"*.example.com", "ngrok.example.com:4443", true},
+		{"EXAMPLE.com", "Ngrok.Example.COM:4443", true},
+		{"other.com, example.com", "ngrok.example.com:4443", true},
+		{"example.com:4443", "ngrok.example.com:4443", true},
+		{"example.com:443", "ngrok.example.com:4443", false},
+		{"10.0.0.0/8", "10.1.2.3:4443", true},
+		{"10.0.0.0/8", "11.1.2.3:4443", false},
+		{"10.0.0.0/8", "ten.example.com:4443", false},
+		{"127.0.0.1", "127.0.0.1:4443", true},
+		{"::1", "[::1]:4443", true},
+		{"[::1]:4443", "[::1]:4443", true},
+	}
+
+	for _, c := range cases {
+		if got := noProxyMatches(c.noProxy, c.addr); got != c.want {
+			t.Errorf("noProxyMatches(%q, %q) = %v, want %v", c.noProxy, c.addr, got, c.want)
+		}
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+
+	const serverAddr = "ngrok.example.com:4443"
+	if got := proxyFromEnvironment(serverAddr); got != "" {
+		t.Fatalf("expected no proxy, got %q", got)
+	}
+
+	t.Setenv("http_proxy", "http://plain:3128")
+	if got := proxyFromEnvironment(serverAddr); got != "http://plain:3128" {
+		t.Fatalf("expected http_proxy to be used, got %q", got)
+	}
+
+	t.Setenv("ALL_PROXY", "socks5h://gateway:1080")
+	if got := proxyFromEnvironment(serverAddr); got != "socks5h://gateway:1080" {
+		t.Fatalf("expected ALL_PROXY to take precedence over http_proxy, got %q", got)
+	}
+
+	t.Setenv("HTTPS_PROXY", "corp-proxy:8080")
+	if got := proxyFromEnvironment(serverAddr); got != "http://corp-proxy:8080" {
+		t.Fatalf("expected HTTPS_PROXY with an http:// scheme, got %q", got)
+	}
+
+	t.Setenv("no_proxy", "localhost,.example.com")
+	if got := proxyFromEnvironment(serverAddr); got != "" {
+		t.Fatalf("expected no_proxy to bypass the proxy, got %q", got)
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"ngrok/pkg/client/log"
+	"ngrok/pkg/conn"
+	"sync"
+)
+
+// The QUIC session with a quic:// server, shared by the control connection
+// and all proxy connections of a control session
+type quicTransport struct {
+	sync.Mutex
+	session *conn.QuicSession
+
+	// set when the session couldn't be established, connections go over
+	// TLS/TCP instead until the next control session
+	fallback bool
+}
+
+// Opens a stream of the QUIC session, dialing the session first if needed
+func (q *quicTransport) dial(typ, addr string, tlsCfg *tls.Config, proxyUrl string) (conn.Conn, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// proxies only carry TCP
+	if q.fallback || proxyUrl != "" {
+		return nil, fmt.Errorf("QUIC is unavailable")
+	}
+
+	if q.session == nil || q.session.Closed() {
+		session, err := conn.DialQuic(addr, tlsCfg)
+		if err != nil {
+			log.Warn("Failed to establish QUIC session with %s, falling back to TLS over TCP: %v", addr, err)
+			q.fallback = true
+			return nil, err
+		}
+		q.session = session
+	}
+
+	return q.session.OpenConn(typ)
+}
+
+// Closes the session, the next dial tries QUIC again
+func (q *quicTransport) reset() {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.session != nil {
+		q.session.Close()
+		q.session = nil
+	}
+	q.fallback = false
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"ngrok/pkg/conn"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// When no QUIC session can be established, connections go over TLS/TCP to
+// the same port until the transport is reset
+func TestDialServerQuicFallback(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../../assets/server/tls/snakeoil.crt", "../../assets/server/tls/snakeoil.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	tcp, err := conn.Listen("127.0.0.1:0", "tun", tlsCfg, conn.ProxyNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a QUIC server on the same port which doesn't speak ngrok's protocol
+	// fails the handshake at once
+	other := tlsCfg.Clone()
+	other.NextProtos = []string{"h3"}
+	udp, err := quic.ListenAddr(tcp.Addr.String(), other, nil)
+	if err != nil {
+		t.Skipf("UDP port of the TCP listener is taken: %v", err)
+	}
+	defer udp.Close()
+
+	// reading completes the TLS handshake the client waits for
+	accepted := make(chan struct{}, 2)
+	go func() {
+		for c := range tcp.Conns {
+			accepted <- struct{}{}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	c := &ClientModel{
+		serverAddr: "quic://" + tcp.Addr.String(),
+		tlsConfig:  &tls.Config{InsecureSkipVerify: true},
+		quic:       new(quicTransport),
+	}
+
+	for i := 0; i < 2; i++ {
+		remote, err := c.dialServer("ctl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer remote.Close()
+		if _, ok := remote.RemoteAddr().(*net.TCPAddr); !ok {
+			t.Fatalf("connected over %v", remote.RemoteAddr())
+		}
+
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("TCP listener didn't accept the fallback connection")
+		}
+	}
+
+	if !c.quic.fallback {
+		t.Fatal("transport not marked as fallen back")
+	}
+	c.quic.reset()
+	if c.quic.fallback {
+		t.Fatal("fallback kept after reset")
+	}
+}
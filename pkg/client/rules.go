@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"ngrok/pkg/client/log"
+	"ngrok/pkg/client/mvc"
+	"ngrok/pkg/conn"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Response header added to every response that a rule acted on, so that
+// rule hits are visible in the inspector
+const ruleHeader = "X-Ngrok-Rule"
+
+// A mocking / fault injection rule for an http tunnel. Rules are evaluated
+// in order against every request and the first one that matches is applied.
+//
+// A rule matches when all of the Method, Path and Header conditions that
+// are set match. Path and header values are regular expressions. A header
+// condition only matches requests which have the header, except an empty
+// one, which matches the requests without it.
+//
+// The matching rule first waits for Latency, then either drops the
+// connection, answers with Status/Headers/Body without contacting the local
+// service, or, if neither Drop nor Status is set, passes the request through.
+type RuleConfiguration struct {
+	Name   string            `yaml:"name,omitempty"`
+	Method string            `yaml:"method,omitempty"`
+	Path   string            `yaml:"path,omitempty"`
+	Header map[string]string `yaml:"header,omitempty"`
+
+	Latency  string            `yaml:"latency,omitempty"`
+	Drop     bool              `yaml:"drop,omitempty"`
+	Status   int               `yaml:"status,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Body     string            `yaml:"body,omitempty"`
+	BodyFile string            `yaml:"body_file,omitempty"`
+
+	path    *regexp.Regexp
+	header  map[string]*regexp.Regexp
+	latency time.Duration
+	body    []byte
+}
+
+// Validates the rule and prepares it for matching
+func (r *RuleConfiguration) compile(propName string) (err error) {
+	if r.Path != "" {
+		if r.path, err = regexp.Compile(r.Path); err != nil {
+			return fmt.Errorf("Invalid path pattern %s '%s': %v", propName, r.Path, err)
+		}
+	}
+
+	r.header = make(map[string]*regexp.Regexp)
+	for name, pattern := range r.Header {
+		if r.header[name], err = regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("Invalid header pattern %s '%s': %v", propName, pattern, err)
+		}
+	}
+
+	if r.Latency != "" {
+		if r.latency, err = time.ParseDuration(r.Latency); err != nil {
+			return fmt.Errorf("Invalid latency %s '%s': %v", propName, r.Latency, err)
+		}
+	}
+
+	if r.Status != 0 && (r.Status < 100 || r.Status > 599) {
+		return fmt.Errorf("Invalid status %s: %d", propName, r.Status)
+	}
+
+	if r.Drop && r.Status != 0 {
+		return fmt.Errorf("Rule %s may not both drop connections and set a status", propName)
+	}
+
+	r.body = []byte(r.Body)
+	if r.BodyFile != "" {
+		if r.body, err = os.ReadFile(r.BodyFile); err != nil {
+			return fmt.Errorf("Failed to read body file %s: %v", propName, err)
+		}
+	}
+
+	return
+}
+
+func (r *RuleConfiguration) matches(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+
+	if r.path != nil && !r.path.MatchString(req.URL.RequestURI()) {
+		return false
+	}
+
+	for name, pattern := range r.header {
+		present := len(req.Header.Values(name)) > 0
+		if r.Header[name] == "" {
+			if present {
+				return false
+			}
+		} else if !present || !pattern.MatchString(req.Header.Get(name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Answers req with the rule's response, which carries the notes headers
+func (r *RuleConfiguration) respond(w io.Writer, req *http.Request, notes http.Header) error {
+	body := r.body
+	if len(body) == 0 && r.Status >= 400 {
+		body = []byte(http.StatusText(r.Status) + "\n")
+	}
+
+	resp := &http.Response{
+		StatusCode:    r.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+	}
+
+	for name, value := range r.Headers {
+		resp.Header.Set(name, value)
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	for name, values := range notes {
+		resp.Header[name] = values
+	}
+
+	return resp.Write(w)
+}
+
+func matchRule(rules []*RuleConfiguration, req *http.Request) *RuleConfiguration {
+	for _, r := range rules {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// The agent's side of a connection to the rules server
+type rulesConn struct {
+	conn.Conn
+
+	// the name of the rule that dropped the connection, if one did
+	dropped atomic.Pointer[string]
+}
+
+func (c *rulesConn) droppedBy() string {
+	if name := c.dropped.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+// The context of the inspected transactions of localConn. Rules that drop
+// a connection leave no response to tell about them, so the inspector asks
+// the rules server instead.
+func connContext(localConn conn.Conn, ctx mvc.ConnectionContext) mvc.ConnectionContext {
+	if c, ok := localConn.(*rulesConn); ok {
+		ctx.DroppedBy = c.droppedBy
+	}
+	return ctx
+}
+
+// Returns a connection to an in-process http server that verifies webhook
+// signatures if webhook is set, applies the tunnel's rules and forwards
+// everything else to the local service. The returned connection can be
+// inspected and joined exactly like a connection to the local service
+// itself.
+func dialRules(publicUrl, localAddr string, dial func() (conn.Conn, error), rules []*RuleConfiguration, webhook *WebhookConfiguration) conn.Conn {
+	agentSide, rulesSide := net.Pipe()
+	c := &rulesConn{Conn: conn.Wrap(agentSide, "prv")}
+	go serveRules(rulesSide, c, publicUrl, localAddr, dial, rules, webhook)
+	return c
+}
+
+func serveRules(c net.Conn, agent *rulesConn, publicUrl, localAddr string, dial func() (conn.Conn, error), rules []*RuleConfiguration, webhook *WebhookConfiguration) {
+	l := log.NewPrefixLogger("rules", publicUrl)
+	defer c.Close()
+
+	var (
+		local   conn.Conn
+		localRd *bufio.Reader
+	)
+	defer func() {
+		if local != nil {
+			local.Close()
+		}
+	}()
+
+	rd := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+
+		// headers added to the response, telling the inspector what was
+		// done with the request
+		notes := make(http.Header)
+
+		if webhook != nil {
+			if err = webhook.verify(req, publicUrl); err != nil {
+				l.Warn("Rejecting %s %s: %v", req.Method, req.URL.RequestURI(), err)
+				webhook.reject(c, req, fmt.Sprintf("%s invalid: %v", webhook.Provider, err))
+				return
+			}
+			notes.Set(webhookHeader, webhook.Provider+" valid")
+		}
+
+		rule := matchRule(rules, req)
+		if rule != nil {
+			l.Info("Rule %s matched %s %s", rule.Name, req.Method, req.URL.RequestURI())
+			notes.Set(ruleHeader, rule.Name)
+			if rule.latency > 0 {
+				time.Sleep(rule.latency)
+			}
+
+			if rule.Drop {
+				agent.dropped.Store(&rule.Name)
+				return
+			}
+
+			if rule.Status != 0 {
+				io.Copy(io.Discard, req.Body)
+				if err = rule.respond(c, req, notes); err != nil || req.Close {
+					return
+				}
+				continue
+			}
+		}
+
+		// pass the request through to the local service
+		if local == nil {
+			if local, err = dial(); err != nil {
+				l.Warn("Failed to open private leg %s: %v", localAddr, err)
+				c.Write(badGatewayResponse(publicUrl, localAddr))
+				return
+			}
+			localRd = bufio.NewReader(local)
+		}
+
+		// don't let Request.Write add a default User-Agent
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+
+		if err = req.Write(local); err != nil {
+			l.Warn("Failed to write request to %s: %v", localAddr, err)
+			return
+		}
+
+		resp, err := http.ReadResponse(localRd, req)
+		if err != nil {
+			l.Warn("Failed to read response from %s: %v", localAddr, err)
+			return
+		}
+
+		for name, values := range notes {
+			resp.Header[name] = values
+		}
+
+		err = resp.Write(c)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+
+		// upgraded connections (e.g. websockets) are just piped from here on
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			go io.Copy(local, rd)
+			io.Copy(c, localRd)
+			return
+		}
+
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
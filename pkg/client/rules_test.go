@@ -0,0 +1,217 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"ngrok/pkg/client/mvc"
+	"ngrok/pkg/conn"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Starts a local service echoing request bodies. Returns a dial function
+// for it and the number of requests that reached it.
+func startEchoService(t *testing.T) (func() (conn.Conn, error), *atomic.Int32) {
+	t.Helper()
+	reached := new(atomic.Int32)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(local.Close)
+
+	dial := func() (conn.Conn, error) {
+		c, err := net.Dial("tcp", local.Listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return conn.Wrap(c, "prv"), nil
+	}
+	return dial, reached
+}
+
+// Sends req over c and reads the response with its body, nil if the
+// connection was closed without one
+func roundTrip(t *testing.T, c conn.Conn, req *http.Request) *http.Response {
+	t.Helper()
+	if err := req.Write(c); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+func compileRules(t *testing.T, rules ...*RuleConfiguration) []*RuleConfiguration {
+	t.Helper()
+	for _, r := range rules {
+		if err := r.compile("for test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rules
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule    RuleConfiguration
+		method  string
+		target  string
+		header  map[string]string
+		matches bool
+	}{
+		{RuleConfiguration{}, "GET", "/", nil, true},
+		{RuleConfiguration{Method: "post"}, "POST", "/", nil, true},
+		{RuleConfiguration{Method: "POST"}, "GET", "/", nil, false},
+		{RuleConfiguration{Path: "^/api/"}, "GET", "/api/users?page=2", nil, true},
+		{RuleConfiguration{Path: `page=\d`}, "GET", "/api/users?page=2", nil, true},
+		{RuleConfiguration{Path: "^/api/"}, "GET", "/web/api/", nil, false},
+		{RuleConfiguration{Header: map[string]string{"X-Test": "^yes$"}}, "GET", "/", map[string]string{"X-Test": "yes"}, true},
+		{RuleConfiguration{Header: map[string]string{"X-Test": "^yes$"}}, "GET", "/", map[string]string{"X-Test": "no"}, false},
+		{RuleConfiguration{Header: map[string]string{"X-Test": "^$"}}, "GET", "/", nil, false},
+		{RuleConfiguration{Header: map[string]string{"X-Test": ".*"}}, "GET", "/", nil, false},
+		{RuleConfiguration{Header: map[string]string{"X-Test": ".*"}}, "GET", "/", map[string]string{"X-Test": ""}, true},
+		{RuleConfiguration{Header: map[string]string{"X-Test": ""}}, "GET", "/", nil, true},
+		{RuleConfiguration{Header: map[string]string{"X-Test": ""}}, "GET", "/", map[string]string{"X-Test": "yes"}, false},
+		{RuleConfiguration{Method: "GET", Path: "^/api/", Header: map[string]string{"Accept": "json"}}, "GET", "/api/",
+			map[string]string{"Accept": "text/html"}, false},
+	}
+
+	for _, tt := range tests {
+		rule := compileRules(t, &tt.rule)[0]
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		for name, value := range tt.header {
+			req.Header.Set(name, value)
+		}
+		if got := rule.matches(req); got != tt.matches {
+			t.Errorf("rule %+v matching %s %s %v: %v, expected %v", tt.rule, tt.method, tt.target, tt.header, got, tt.matches)
+		}
+	}
+
+	// the first matching rule is applied
+	rules := compileRules(t, &RuleConfiguration{Name: "api", Path: "^/api/"}, &RuleConfiguration{Name: "any"})
+	if r := matchRule(rules, httptest.NewRequest("GET", "/api/x", nil)); r == nil || r.Name != "api" {
+		t.Errorf("matched %+v, expected api", r)
+	}
+	if r := matchRule(rules, httptest.NewRequest("GET", "/x", nil)); r == nil || r.Name != "any" {
+		t.Errorf("matched %+v, expected any", r)
+	}
+}
+
+func TestCompileRule(t *testing.T) {
+	invalid := []RuleConfiguration{
+		{Path: "("},
+		{Header: map[string]string{"X-Test": "["}},
+		{Latency: "soon"},
+		{Status: 99},
+		{Status: 600},
+		{Drop: true, Status: 500},
+		{BodyFile: "/nonexistent/body"},
+	}
+	for _, r := range invalid {
+		if err := r.compile("for test"); err == nil {
+			t.Errorf("%+v accepted", r)
+		}
+	}
+
+	r := RuleConfiguration{Latency: "250ms", Status: 200, Body: "mocked"}
+	if err := r.compile("for test"); err != nil {
+		t.Fatal(err)
+	}
+	if r.latency != 250*time.Millisecond || string(r.body) != "mocked" {
+		t.Errorf("compiled latency %s and body %q", r.latency, r.body)
+	}
+}
+
+func TestServeRules(t *testing.T) {
+	dial, reached := startEchoService(t)
+	rules := compileRules(t,
+		&RuleConfiguration{Name: "drop", Path: "^/drop", Drop: true},
+		&RuleConfiguration{Name: "mock", Path: "^/mock", Status: 503, Headers: map[string]string{"Retry-After": "3"}, Body: "down"},
+		&RuleConfiguration{Name: "slow", Path: "^/slow", Latency: "100ms"},
+	)
+
+	dialTest := func() conn.Conn {
+		c := dialRules("http://foo.example.com", "127.0.0.1:80", dial, rules, nil)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	t.Run("pass through", func(t *testing.T) {
+		before := reached.Load()
+		resp := roundTrip(t, dialTest(), httptest.NewRequest("POST", "/echo", strings.NewReader("hello")))
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "hello" || reached.Load() != before+1 || resp.Header.Get(ruleHeader) != "" {
+			t.Fatalf("response %q with rule %q, local service reached %d times", body, resp.Header.Get(ruleHeader), reached.Load()-before)
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		before := reached.Load()
+		resp := roundTrip(t, dialTest(), httptest.NewRequest("GET", "/mock/x", nil))
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != 503 || string(body) != "down" || resp.Header.Get("Retry-After") != "3" || resp.Header.Get(ruleHeader) != "mock" {
+			t.Fatalf("response %d %q %v", resp.StatusCode, body, resp.Header)
+		}
+		if reached.Load() != before {
+			t.Fatalf("mocked request reached the local service")
+		}
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		before := reached.Load()
+		start := time.Now()
+		resp := roundTrip(t, dialTest(), httptest.NewRequest("POST", "/slow", strings.NewReader("late")))
+		body, _ := io.ReadAll(resp.Body)
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("answered after %s", elapsed)
+		}
+		if string(body) != "late" || reached.Load() != before+1 || resp.Header.Get(ruleHeader) != "slow" {
+			t.Fatalf("response %q with rule %q", body, resp.Header.Get(ruleHeader))
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		before := reached.Load()
+		c := dialTest()
+		if resp := roundTrip(t, c, httptest.NewRequest("GET", "/drop", nil)); resp != nil {
+			t.Fatalf("dropped request answered with %s", resp.Status)
+		}
+		if reached.Load() != before {
+			t.Fatalf("dropped request reached the local service")
+		}
+
+		// the inspector learns about the rule from the connection context
+		ctx := connContext(c, mvc.ConnectionContext{})
+		if ctx.DroppedBy == nil || ctx.DroppedBy() != "drop" {
+			t.Fatalf("drop not recorded on the connection")
+		}
+	})
+
+	t.Run("keep alive", func(t *testing.T) {
+		c := dialTest()
+		for _, target := range []string{"/mock", "/echo", "/mock"} {
+			if resp := roundTrip(t, c, httptest.NewRequest("GET", target, nil)); resp == nil {
+				t.Fatalf("no response to %s", target)
+			}
+		}
+		if ctx := connContext(c, mvc.ConnectionContext{}); ctx.DroppedBy() != "" {
+			t.Fatalf("connection recorded as dropped by %s", ctx.DroppedBy())
+		}
+	})
+}
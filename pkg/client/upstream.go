@@ -0,0 +1,289 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"ngrok/pkg/client/log"
+	"ngrok/pkg/conn"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+	balanceWeighted   = "weighted"
+
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+)
+
+// An additional local address for a tunnel. The address given in proto is
+// always the first upstream, list it here too to give it a weight.
+type UpstreamConfiguration struct {
+	Addr   string `yaml:"addr"`
+	Weight int    `yaml:"weight,omitempty"`
+}
+
+// Active health checking of a tunnel's upstreams. Type is "tcp" to check
+// that a connection can be opened or "http" to check that Path answers
+// with a non-5xx status.
+type HealthCheckConfiguration struct {
+	Type     string `yaml:"type,omitempty"`
+	Path     string `yaml:"path,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty"`
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (hc *HealthCheckConfiguration) compile(propName string) (err error) {
+	switch hc.Type {
+	case "", "tcp":
+		hc.Type = "tcp"
+	case "http":
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+	default:
+		return fmt.Errorf("Invalid health check type %s: %s", propName, hc.Type)
+	}
+
+	hc.interval, hc.timeout = defaultHealthInterval, defaultHealthTimeout
+	if hc.Interval != "" {
+		if hc.interval, err = time.ParseDuration(hc.Interval); err != nil || hc.interval <= 0 {
+			return fmt.Errorf("Invalid health check interval %s: '%s'", propName, hc.Interval)
+		}
+	}
+	if hc.Timeout != "" {
+		if hc.timeout, err = time.ParseDuration(hc.Timeout); err != nil || hc.timeout <= 0 {
+			return fmt.Errorf("Invalid health check timeout %s: '%s'", propName, hc.Timeout)
+		}
+	}
+
+	return nil
+}
+
+func validateBalance(balance, propName string) error {
+	switch balance {
+	case "", balanceRoundRobin, balanceLeastConn, balanceWeighted:
+		return nil
+	default:
+		return fmt.Errorf("Invalid balance %s: %s", propName, balance)
+	}
+}
+
+type upstream struct {
+	addr    string
+	weight  int
+	healthy int32
+	active  int64
+
+	// running score for smooth weighted round-robin
+	current int
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+// A connection to an upstream which tracks the number of active
+// connections for least-conn balancing
+type upstreamConn struct {
+	conn.Conn
+	u     *upstream
+	close sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.close.Do(func() { atomic.AddInt64(&c.u.active, -1) })
+	return c.Conn.Close()
+}
+
+// The set of local addresses a tunnel forwards to
+type upstreamPool struct {
+	log.Logger
+	sync.Mutex
+
+	balance     string
+	upstreams   []*upstream
+	healthCheck *HealthCheckConfiguration
+	tlsConfig   *tls.Config
+	next        int
+}
+
+func newUpstreamPool(name, primary string, config *TunnelConfiguration) *upstreamPool {
+	p := &upstreamPool{
+		Logger:      log.NewPrefixLogger("upstream", name),
+		balance:     config.Balance,
+		healthCheck: config.HealthCheck,
+		tlsConfig:   config.upstreamTLSConfig(),
+	}
+
+	if p.balance == "" {
+		p.balance = balanceRoundRobin
+	}
+
+	byAddr := make(map[string]*upstream)
+	add := func(addr string, weight int) {
+		if weight <= 0 {
+			weight = 1
+		}
+
+		if u, ok := byAddr[addr]; ok {
+			u.weight = weight
+			return
+		}
+
+		u := &upstream{addr: addr, weight: weight, healthy: 1}
+		byAddr[addr] = u
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	add(primary, 1)
+	for _, u := range config.Upstreams {
+		add(u.Addr, u.Weight)
+	}
+
+	return p
+}
+
+// Returns the upstreams in the order they should be tried: the one picked
+// by the balancing strategy first, then the remaining ones as fallbacks.
+// Unhealthy upstreams are only returned if none are healthy.
+func (p *upstreamPool) candidates() []*upstream {
+	p.Lock()
+	defer p.Unlock()
+
+	healthy := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		healthy = append(healthy, p.upstreams...)
+	}
+
+	var first *upstream
+	switch p.balance {
+	case balanceLeastConn:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return atomic.LoadInt64(&healthy[i].active) < atomic.LoadInt64(&healthy[j].active)
+		})
+		return healthy
+
+	case balanceWeighted:
+		// smooth weighted round-robin, as done by nginx
+		total := 0
+		for _, u := range healthy {
+			u.current += u.weight
+			total += u.weight
+			if first == nil || u.current > first.current {
+				first = u
+			}
+		}
+		first.current -= total
+
+	default:
+		first = healthy[p.next%len(healthy)]
+		p.next++
+	}
+
+	ordered := []*upstream{first}
+	for _, u := range healthy {
+		if u != first {
+			ordered = append(ordered, u)
+		}
+	}
+	return ordered
+}
+
+// Dials the upstreams in order until one accepts the connection
+func (p *upstreamPool) dial() (conn.Conn, error) {
+	var err error
+	for _, u := range p.candidates() {
+		var c conn.Conn
+		if c, err = dialLocalAddr(u.addr, p.tlsConfig); err != nil {
+			p.Warn("Failed to open private leg to upstream %s: %v", u.addr, err)
+			continue
+		}
+
+		atomic.AddInt64(&u.active, 1)
+		return &upstreamConn{Conn: c, u: u}, nil
+	}
+
+	return nil, fmt.Errorf("All upstreams failed, last error: %v", err)
+}
+
+// Periodically checks the health of every upstream, forever
+func (p *upstreamPool) checkHealth() {
+	hc := p.healthCheck
+	if hc == nil {
+		return
+	}
+
+	check := func(u *upstream) bool {
+		network, address, isTLS := splitLocalAddr(u.addr)
+		if hc.Type == "http" {
+			// always dial the upstream's own address, so that unix
+			// sockets can be checked too
+			dialer := &net.Dialer{Timeout: hc.timeout}
+			client := &http.Client{
+				Timeout: hc.timeout,
+				Transport: &http.Transport{
+					TLSClientConfig:   p.tlsConfig,
+					DisableKeepAlives: true,
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return dialer.DialContext(ctx, network, address)
+					},
+				},
+			}
+
+			checkUrl := "http://" + address + hc.Path
+			if isTLS {
+				checkUrl = "https://" + address + hc.Path
+			} else if network == "unix" {
+				checkUrl = "http://localhost" + hc.Path
+			}
+
+			resp, err := client.Get(checkUrl)
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode < 500
+		}
+
+		c, err := net.DialTimeout(network, address, hc.timeout)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+
+	for {
+		for _, u := range p.upstreams {
+			healthy := check(u)
+			if healthy != u.isHealthy() {
+				if healthy {
+					p.Info("Upstream %s is healthy again", u.addr)
+					atomic.StoreInt32(&u.healthy, 1)
+				} else {
+					p.Warn("Upstream %s failed its %s health check", u.addr, hc.Type)
+					atomic.StoreInt32(&u.healthy, 0)
+				}
+			}
+		}
+
+		time.Sleep(hc.interval)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"net"
+	"ngrok/pkg/client/mvc"
+	"ngrok/pkg/proto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func testPool(balance string, upstreams ...*UpstreamConfiguration) *upstreamPool {
+	return newUpstreamPool("test", "127.0.0.1:8000", &TunnelConfiguration{Balance: balance, Upstreams: upstreams})
+}
+
+// The address the pool would try first for each of n connections
+func picks(p *upstreamPool, n int) string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = strings.TrimPrefix(p.candidates()[0].addr, "127.0.0.1:")
+	}
+	return strings.Join(addrs, ",")
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	p := testPool("", &UpstreamConfiguration{Addr: "127.0.0.1:8001"}, &UpstreamConfiguration{Addr: "127.0.0.1:8002"})
+	if got := picks(p, 6); got != "8000,8001,8002,8000,8001,8002" {
+		t.Fatalf("picked %s", got)
+	}
+
+	// the others follow as fallbacks
+	if c := p.candidates(); len(c) != 3 || c[0] == c[1] || c[1] == c[2] || c[0] == c[2] {
+		t.Fatalf("candidates %v", c)
+	}
+}
+
+func TestUpstreamPoolPrimaryListedAgain(t *testing.T) {
+	p := testPool("", &UpstreamConfiguration{Addr: "127.0.0.1:8000", Weight: 3}, &UpstreamConfiguration{Addr: "127.0.0.1:8001"})
+	if len(p.upstreams) != 2 || p.upstreams[0].weight != 3 {
+		t.Fatalf("upstreams %+v", p.upstreams)
+	}
+}
+
+func TestUpstreamPoolWeighted(t *testing.T) {
+	p := testPool(balanceWeighted, &UpstreamConfiguration{Addr: "127.0.0.1:8000", Weight: 3}, &UpstreamConfiguration{Addr: "127.0.0.1:8001"})
+
+	// smooth weighted round-robin spreads the heavier upstream's picks
+	if got := picks(p, 8); got != "8000,8000,8001,8000,8000,8000,8001,8000" {
+		t.Fatalf("picked %s", got)
+	}
+}
+
+func TestUpstreamPoolLeastConn(t *testing.T) {
+	p := testPool(balanceLeastConn, &UpstreamConfiguration{Addr: "127.0.0.1:8001"}, &UpstreamConfiguration{Addr: "127.0.0.1:8002"})
+	atomic.StoreInt64(&p.upstreams[0].active, 3)
+	atomic.StoreInt64(&p.upstreams[1].active, 1)
+	atomic.StoreInt64(&p.upstreams[2].active, 2)
+
+	c := p.candidates()
+	if c[0].addr != "127.0.0.1:8001" || c[1].addr != "127.0.0.1:8002" || c[2].addr != "127.0.0.1:8000" {
+		t.Fatalf("candidates %s %s %s", c[0].addr, c[1].addr, c[2].addr)
+	}
+}
+
+func TestUpstreamPoolSkipsUnhealthy(t *testing.T) {
+	for _, balance := range []string{balanceRoundRobin, balanceLeastConn, balanceWeighted} {
+		p := testPool(balance, &UpstreamConfiguration{Addr: "127.0.0.1:8001"}, &UpstreamConfiguration{Addr: "127.0.0.1:8002"})
+		atomic.StoreInt32(&p.upstreams[1].healthy, 0)
+
+		for i := 0; i < 4; i++ {
+			for _, u := range p.candidates() {
+				if u.addr == "127.0.0.1:8001" {
+					t.Fatalf("%s: unhealthy upstream picked", balance)
+				}
+			}
+		}
+
+		// with none healthy, all of them are tried anyway
+		for _, u := range p.upstreams {
+			atomic.StoreInt32(&u.healthy, 0)
+		}
+		if c := p.candidates(); len(c) != 3 {
+			t.Fatalf("%s: %d candidates with no upstream healthy", balance, len(c))
+		}
+	}
+}
+
+// Listens on a local port accepting and closing connections, returns its
+// address
+func listenLocal(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestUpstreamPoolDial(t *testing.T) {
+	up := listenLocal(t)
+
+	// the primary address refuses connections, the pool falls back
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+
+	p := newUpstreamPool("test", downAddr, &TunnelConfiguration{Upstreams: []*UpstreamConfiguration{{Addr: up}}})
+	for i := 0; i < 2; i++ {
+		c, err := p.dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.RemoteAddr().String() != up {
+			t.Fatalf("dialed %s", c.RemoteAddr())
+		}
+		if active := atomic.LoadInt64(&p.upstreams[1].active); active != 1 {
+			t.Fatalf("%d active connections", active)
+		}
+		c.Close()
+		c.Close()
+		if active := atomic.LoadInt64(&p.upstreams[1].active); active != 0 {
+			t.Fatalf("%d active connections after closing", active)
+		}
+	}
+}
+
+// Replays to another local address dial it rather than the pool
+func TestDialLocalReplayOverride(t *testing.T) {
+	primary := listenLocal(t)
+	other := listenLocal(t)
+	replay := listenLocal(t)
+
+	tunnel := mvc.Tunnel{PublicUrl: "http://foo.example.com", LocalAddr: primary, Protocol: proto.NewHttp()}
+	pool := newUpstreamPool("test", primary, &TunnelConfiguration{Upstreams: []*UpstreamConfiguration{{Addr: other}}})
+	c := newTestModel(tunnel, &localTarget{pool: pool})
+
+	// through the pool, round-robin
+	for _, expected := range []string{primary, other} {
+		lc, err := c.dialLocal(tunnel, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc.Close()
+		if lc.RemoteAddr().String() != expected {
+			t.Fatalf("dialed %s, expected %s", lc.RemoteAddr(), expected)
+		}
+	}
+
+	replayed := tunnel
+	replayed.LocalAddr = replay
+	for i := 0; i < 2; i++ {
+		lc, err := c.dialLocal(replayed, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc.Close()
+		if lc.RemoteAddr().String() != replay {
+			t.Fatalf("replay dialed %s, expected %s", lc.RemoteAddr(), replay)
+		}
+	}
+}
+
+// A model serving tunnel through target
+func newTestModel(tunnel mvc.Tunnel, target *localTarget) *ClientModel {
+	c := &ClientModel{
+		tunnels:     map[string]mvc.Tunnel{tunnel.PublicUrl: tunnel},
+		tunnelsLock: new(sync.Mutex),
+		targets:     map[string]*localTarget{tunnel.PublicUrl: target},
+	}
+	c.tunnelAdded = sync.NewCond(c.tunnelsLock)
+	return c
+}
@@ -58,7 +58,7 @@ func (v *HttpView) Run() {
 		select {
 		case txn := <-updates:
 			v.Debug("Got HTTP update")
-			if txn.(*proto.HttpTxn).Resp == nil {
+			if txn := txn.(*proto.HttpTxn); txn.Resp == nil && txn.RespErr == nil {
 				v.HttpRequests.Add(txn)
 			}
 			v.Render()
@@ -0,0 +1,143 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"ngrok/pkg/client/mvc"
+	"ngrok/pkg/proto"
+	"ngrok/pkg/util"
+	"strings"
+)
+
+// Builds a HAR document from the captured transactions. If txnIds is not
+// empty, only those transactions are exported.
+func (whv *WebHttpView) exportHar(txnIds []string) *proto.Har {
+	selected := make(map[string]bool)
+	for _, id := range txnIds {
+		selected[id] = true
+	}
+
+	har := proto.NewHar()
+	txns := whv.HttpRequests.Slice()
+
+	// the ring is ordered newest first, HAR entries are ordered oldest first
+	for i := len(txns) - 1; i >= 0; i-- {
+		txn := txns[i].(*SerializedTxn)
+		if len(selected) > 0 && !selected[txn.Id] {
+			continue
+		}
+
+		scheme := "http"
+		if u, err := url.Parse(txn.ConnCtx.Tunnel.PublicUrl); err == nil && u.Scheme != "" {
+			scheme = u.Scheme
+		}
+
+		har.Log.Entries = append(har.Log.Entries, proto.NewHarEntry(txn.HttpTxn, scheme, txn.ConnCtx.ClientAddr))
+	}
+
+	return har
+}
+
+// Replays every request in a HAR document. Entries are matched to the tunnel
+// serving their URL, falling back to the tunnel with the public url
+// defaultUrl, or the first http tunnel if none was given.
+func (whv *WebHttpView) importHar(har *proto.Har, defaultUrl string) (replayed int, err error) {
+	byUrl := make(map[string]mvc.Tunnel)
+	var fallback *mvc.Tunnel
+	for _, t := range whv.ctl.State().GetTunnels() {
+		if t.Protocol.GetName() != "http" {
+			continue
+		}
+		t := t
+		byUrl[t.PublicUrl] = t
+		if fallback == nil || t.PublicUrl == defaultUrl {
+			fallback = &t
+		}
+	}
+
+	if defaultUrl != "" && fallback != nil && fallback.PublicUrl != defaultUrl {
+		return 0, fmt.Errorf("No http tunnel with public url %s", defaultUrl)
+	}
+
+	for i := range har.Log.Entries {
+		e := &har.Log.Entries[i]
+
+		tunnel := fallback
+		if u, err := url.Parse(e.Request.Url); err == nil {
+			if t, ok := byUrl[u.Scheme+"://"+u.Host]; ok {
+				tunnel = &t
+			}
+		}
+
+		if tunnel == nil {
+			return replayed, fmt.Errorf("No http tunnel is available to replay requests")
+		}
+
+		payload, err := e.RawRequest()
+		if err != nil {
+			return replayed, fmt.Errorf("Failed to build request for entry %d (%s %s): %v", i, e.Request.Method, e.Request.Url, err)
+		}
+
+		whv.ctl.PlayRequest(*tunnel, payload, mvc.PlayOptions{})
+		replayed++
+	}
+
+	return
+}
+
+func (whv *WebHttpView) registerHar() {
+	http.HandleFunc("/http/in/har", func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				err := util.MakePanicTrace(r)
+				whv.Error("HAR export failed: %v", err)
+				http.Error(w, err, 500)
+			}
+		}()
+
+		r.ParseForm()
+		har := whv.exportHar(r.Form["txnid"])
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="ngrok.har"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(har); err != nil {
+			panic(err)
+		}
+	})
+
+	http.HandleFunc("/http/in/har/import", func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				err := util.MakePanicTrace(r)
+				whv.Error("HAR import failed: %v", err)
+				http.Error(w, err, 500)
+			}
+		}()
+
+		if r.Method != "POST" {
+			http.Error(w, http.StatusText(405), 405)
+			return
+		}
+
+		var har proto.Har
+		if err := json.NewDecoder(r.Body).Decode(&har); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid HAR document: %v", err), 400)
+			return
+		}
+
+		replayed, err := whv.importHar(&har, strings.TrimSpace(r.URL.Query().Get("tunnel")))
+		if err != nil {
+			whv.Warn("HAR import stopped after %d requests: %v", replayed, err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		whv.Info("Replaying %d requests from HAR import", replayed)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"Replayed": replayed})
+	})
+}
@@ -26,6 +26,12 @@ type SerializedTxn struct {
 	*proto.HttpTxn `json:"-"`
 	Req            SerializedRequest
 	Resp           SerializedResponse
+
+	// the agent's rule that acted on the request, if any
+	Rule string
+
+	// the result of the agent's webhook verification, if the tunnel has it
+	Webhook string
 }
 
 type SerializedBody struct {
@@ -41,6 +47,8 @@ type SerializedBody struct {
 type SerializedRequest struct {
 	Raw        string
 	MethodPath string
+	Method     string
+	Url        string
 	Params     url.Values
 	Header     http.Header
 	Body       SerializedBody
@@ -86,6 +94,7 @@ func newWebHttpView(ctl mvc.Controller, wv *WebView, proto *proto.Http) *WebHttp
 	}
 	ctl.Go(whv.updateHttp)
 	whv.register()
+	whv.registerHar()
 	return whv
 }
 
@@ -166,6 +175,8 @@ func (whv *WebHttpView) updateHttp() {
 				HttpTxn: htxn,
 				Req: SerializedRequest{
 					MethodPath: htxn.Req.Method + " " + htxn.Req.URL.Path,
+					Method:     htxn.Req.Method,
+					Url:        htxn.Req.URL.RequestURI(),
 					Raw:        base64.StdEncoding.EncodeToString(rawReq),
 					Params:     htxn.Req.URL.Query(),
 					Header:     htxn.Req.Header,
@@ -181,6 +192,17 @@ func (whv *WebHttpView) updateHttp() {
 			whv.idToTxn[whtxn.Id] = whtxn
 			// XXX: use return value to delete from map so we don't leak memory
 			whv.HttpRequests.Add(whtxn)
+		} else if htxn.Resp == nil {
+			// the connection ended without a response
+			txn := htxn.UserCtx.(*SerializedTxn)
+			txn.Duration = htxn.Duration.Nanoseconds()
+			txn.Resp = SerializedResponse{Status: "no response"}
+			if droppedBy := txn.ConnCtx.DroppedBy; droppedBy != nil {
+				if txn.Rule = droppedBy(); txn.Rule != "" {
+					txn.Resp.Status = "dropped"
+				}
+			}
+			whv.send(txn)
 		} else {
 			rawResp, err := httputil.DumpResponse(htxn.Resp.Response, true)
 			if err != nil {
@@ -191,6 +213,10 @@ func (whv *WebHttpView) updateHttp() {
 			txn := htxn.UserCtx.(*SerializedTxn)
 			body := makeBody(htxn.Resp.Header, htxn.Resp.BodyBytes)
 			txn.Duration = htxn.Duration.Nanoseconds()
+
+			// set by the agent's rules and webhook verification
+			txn.Rule = htxn.Resp.Header.Get("X-Ngrok-Rule")
+			txn.Webhook = htxn.Resp.Header.Get("X-Ngrok-Webhook-Verification")
 			txn.Resp = SerializedResponse{
 				Status: htxn.Resp.Status,
 				Raw:    base64.StdEncoding.EncodeToString(rawResp),
@@ -198,16 +224,20 @@ func (whv *WebHttpView) updateHttp() {
 				Body:   body,
 				Binary: !utf8.Valid(rawResp),
 			}
-
-			payload, err := json.Marshal(txn)
-			if err != nil {
-				whv.Error("Failed to serialized txn payload for websocket: %v", err)
-			}
-			whv.webview.wsMessages.In() <- payload
+			whv.send(txn)
 		}
 	}
 }
 
+// Sends a completed transaction to the open inspector pages
+func (whv *WebHttpView) send(txn *SerializedTxn) {
+	payload, err := json.Marshal(txn)
+	if err != nil {
+		whv.Error("Failed to serialized txn payload for websocket: %v", err)
+	}
+	whv.webview.wsMessages.In() <- payload
+}
+
 func (whv *WebHttpView) register() {
 	http.HandleFunc("/http/in/replay", func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -225,7 +255,26 @@ func (whv *WebHttpView) register() {
 			if err != nil {
 				panic(err)
 			}
-			whv.ctl.PlayRequest(txn.ConnCtx.Tunnel, reqBytes)
+
+			if reqBytes, err = editRequest(reqBytes, r.Form); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			tunnel := txn.ConnCtx.Tunnel
+			if tunnel.LocalAddr, err = replayAddr(tunnel.LocalAddr, r.Form.Get("local_addr")); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+
+			opts, err := replayOptions(r.Form)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			opts.ReplayOf = txn.Id
+
+			whv.ctl.PlayRequest(tunnel, reqBytes, opts)
 			w.Write([]byte(http.StatusText(200)))
 		} else {
 			http.Error(w, http.StatusText(400), 400)
@@ -0,0 +1,155 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"ngrok/pkg/client/mvc"
+	"ngrok/pkg/proto"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxReplayCount       = 1000
+	maxReplayConcurrency = 50
+)
+
+// Applies the edits from the replay form to a captured raw request. Only
+// the fields present in the form are changed:
+//
+//	method      request method
+//	url         request path and query
+//	headers     replaces all headers, one "Name: value" per line
+//	body        replaces the body, Content-Length is recomputed
+func editRequest(raw []byte, form url.Values) ([]byte, error) {
+	_, hasMethod := form["method"]
+	_, hasUrl := form["url"]
+	_, hasHeaders := form["headers"]
+	_, hasBody := form["body"]
+	if !hasMethod && !hasUrl && !hasHeaders && !hasBody {
+		return raw, nil
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse captured request: %v", err)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read captured request body: %v", err)
+	}
+
+	if method := strings.TrimSpace(form.Get("method")); method != "" {
+		req.Method = strings.ToUpper(method)
+	}
+
+	if reqUrl := strings.TrimSpace(form.Get("url")); reqUrl != "" {
+		u, err := url.ParseRequestURI(reqUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid url %s: %v", reqUrl, err)
+		}
+		req.URL.Path, req.URL.RawPath, req.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	}
+
+	if hasHeaders {
+		tp := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.TrimSpace(form.Get("headers")) + "\r\n\r\n")))
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid headers: %v", err)
+		}
+
+		req.Header = http.Header(header)
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+		}
+		req.Header.Del("Host")
+		req.Header.Del("Content-Length")
+		req.Header.Del("Transfer-Encoding")
+		req.TransferEncoding = nil
+	}
+
+	if hasBody {
+		body = []byte(form.Get("body"))
+	}
+
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+	req.ContentLength = int64(len(body))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		// otherwise the body is sent chunked, as if its length was unknown
+		req.Body = nil
+	}
+	return proto.DumpRequestOut(req, true)
+}
+
+// Returns the local address a replay should be sent to. override may be a
+// port or a host:port, the tunnel's own address is used if it is empty.
+// The scheme of the tunnel's address is kept unless override has one.
+func replayAddr(localAddr, override string) (string, error) {
+	override = strings.TrimSpace(override)
+	if override == "" || override == localAddr {
+		return localAddr, nil
+	}
+
+	if strings.HasPrefix(override, "unix://") {
+		if len(override) == len("unix://") {
+			return "", fmt.Errorf("Invalid local address '%s': missing socket path", override)
+		}
+		return override, nil
+	}
+
+	scheme := ""
+	if strings.HasPrefix(localAddr, "https://") {
+		scheme = "https://"
+	}
+	if strings.HasPrefix(override, "https://") {
+		scheme, override = "https://", override[len("https://"):]
+	} else if strings.HasPrefix(override, "http://") {
+		scheme, override = "", override[len("http://"):]
+	}
+
+	if _, err := strconv.Atoi(override); err == nil {
+		override = ":" + override
+	}
+
+	host, port, err := net.SplitHostPort(override)
+	if err != nil {
+		return "", fmt.Errorf("Invalid local address '%s': %v", override, err)
+	}
+
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	return scheme + net.JoinHostPort(host, port), nil
+}
+
+func replayOptions(form url.Values) (opts mvc.PlayOptions, err error) {
+	parse := func(name string, max int) (int, error) {
+		v := strings.TrimSpace(form.Get(name))
+		if v == "" {
+			return 1, nil
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > max {
+			return 0, fmt.Errorf("%s must be a number between 1 and %d, got '%s'", name, max, v)
+		}
+		return n, nil
+	}
+
+	if opts.Count, err = parse("count", maxReplayCount); err != nil {
+		return
+	}
+
+	opts.Concurrency, err = parse("concurrency", maxReplayConcurrency)
+	return
+}
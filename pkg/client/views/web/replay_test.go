@@ -0,0 +1,73 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestEditRequest(t *testing.T) {
+	binary := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe, 0x00, 0x01}
+	captured := append([]byte("POST /upload?v=1 HTTP/1.1\r\nHost: foo.example.com\r\nContent-Type: application/octet-stream\r\n"+
+		"X-Old: yes\r\nContent-Length: 8\r\n\r\n"), binary...)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		method string
+		uri    string
+		header map[string]string
+		body   []byte
+	}{
+		{"unedited", url.Values{}, "POST", "/upload?v=1", map[string]string{"X-Old": "yes"}, binary},
+		{"method and url", url.Values{"method": {"put"}, "url": {"/other?v=2"}}, "PUT", "/other?v=2", map[string]string{"X-Old": "yes"}, binary},
+
+		// the inspector leaves out bodies that weren't edited, binary
+		// ones are then replayed as they were captured
+		{"headers of binary request", url.Values{"headers": {"Content-Type: application/octet-stream\nX-New: 1"}},
+			"POST", "/upload?v=1", map[string]string{"X-New": "1", "X-Old": ""}, binary},
+		{"replaced body", url.Values{"body": {"hello"}}, "POST", "/upload?v=1", nil, []byte("hello")},
+		{"emptied body", url.Values{"body": {""}}, "POST", "/upload?v=1", nil, []byte{}},
+		{"host header", url.Values{"headers": {"Host: bar.example.com"}}, "POST", "/upload?v=1", nil, binary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := editRequest(captured, tt.form)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+			if err != nil {
+				t.Fatalf("edited request doesn't parse: %v\n%q", err, raw)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.Method != tt.method || req.URL.RequestURI() != tt.uri {
+				t.Errorf("request is %s %s, expected %s %s", req.Method, req.URL.RequestURI(), tt.method, tt.uri)
+			}
+			for name, value := range tt.header {
+				if got := req.Header.Get(name); got != value {
+					t.Errorf("header %s is %q, expected %q", name, got, value)
+				}
+			}
+			if !bytes.Equal(body, tt.body) || req.ContentLength != int64(len(tt.body)) {
+				t.Errorf("body is %q with length %d, expected %q\n%q", body, req.ContentLength, tt.body, raw)
+			}
+		})
+	}
+
+	if raw, _ := editRequest(captured, url.Values{"headers": {"Host: bar.example.com"}}); !bytes.Contains(raw, []byte("Host: bar.example.com\r\n")) {
+		t.Errorf("host header not replaced:\n%q", raw)
+	}
+	if _, err := editRequest(captured, url.Values{"url": {"not a path"}}); err == nil {
+		t.Errorf("invalid url accepted")
+	}
+}
@@ -0,0 +1,314 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response header telling the result of the webhook verification of a
+// request, so that it is visible in the inspector
+const webhookHeader = "X-Ngrok-Webhook-Verification"
+
+const (
+	webhookGithub = "github"
+	webhookStripe = "stripe"
+	webhookSlack  = "slack"
+	webhookTwilio = "twilio"
+	webhookHmac   = "hmac"
+
+	// how old the timestamps of signed stripe and slack requests may be
+	defaultWebhookTolerance = 5 * time.Minute
+
+	// webhook bodies are read into memory to check their signature
+	maxWebhookBody = 10 << 20
+)
+
+// Verifies the signatures that webhook providers add to their requests
+// with the secret they share with the receiver. Requests of an http tunnel
+// with a wrong or missing signature are answered with 403 Forbidden
+// without contacting the local service.
+//
+// The hmac provider checks a hex or base64 HMAC-SHA256 of the body, with an
+// optional prefix like sha256=, in Header.
+type WebhookConfiguration struct {
+	Provider  string `yaml:"provider,omitempty"`
+	Secret    string `yaml:"secret,omitempty"`
+	Tolerance string `yaml:"tolerance,omitempty"`
+
+	// hmac provider only
+	Header   string `yaml:"header,omitempty"`
+	Encoding string `yaml:"encoding,omitempty"`
+	Prefix   string `yaml:"prefix,omitempty"`
+
+	tolerance time.Duration
+}
+
+// Validates the configuration and prepares it for verifying requests
+func (w *WebhookConfiguration) compile(propName string) (err error) {
+	switch w.Provider {
+	case webhookGithub, webhookStripe, webhookSlack, webhookTwilio:
+	case webhookHmac:
+		if w.Header == "" {
+			return fmt.Errorf("Missing webhook signature header %s", propName)
+		}
+		switch w.Encoding {
+		case "":
+			w.Encoding = "hex"
+		case "hex", "base64":
+		default:
+			return fmt.Errorf("Invalid webhook signature encoding %s: %s", propName, w.Encoding)
+		}
+	default:
+		return fmt.Errorf("Invalid webhook provider %s: '%s'", propName, w.Provider)
+	}
+
+	if w.Secret == "" {
+		return fmt.Errorf("Missing webhook secret %s", propName)
+	}
+
+	w.tolerance = defaultWebhookTolerance
+	if w.Tolerance != "" {
+		if w.tolerance, err = time.ParseDuration(w.Tolerance); err != nil || w.tolerance <= 0 {
+			return fmt.Errorf("Invalid webhook tolerance %s: '%s'", propName, w.Tolerance)
+		}
+	}
+
+	return nil
+}
+
+// Checks the signature of req, which came in on the tunnel of publicUrl.
+// The body is read and replaced with an in-memory copy for passing the
+// request on.
+func (w *WebhookConfiguration) verify(req *http.Request, publicUrl string) error {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookBody+1))
+	if err != nil {
+		return fmt.Errorf("Failed to read body: %v", err)
+	} else if len(body) > maxWebhookBody {
+		return fmt.Errorf("Body is larger than %d bytes", maxWebhookBody)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	switch w.Provider {
+	case webhookGithub:
+		return w.verifyGithub(req, body)
+	case webhookStripe:
+		return w.verifyStripe(req, body)
+	case webhookSlack:
+		return w.verifySlack(req, body)
+	case webhookTwilio:
+		return w.verifyTwilio(req, body, publicUrl)
+	default:
+		return w.verifyHmac(req, body)
+	}
+}
+
+// The X-Hub-Signature-256 header of GitHub is the hex HMAC-SHA256 of the
+// body, prefixed with sha256=
+func (w *WebhookConfiguration) verifyGithub(req *http.Request, body []byte) error {
+	sig, err := signatureHeader(req, "X-Hub-Signature-256")
+	if err != nil {
+		return err
+	}
+	sig, ok := strings.CutPrefix(sig, "sha256=")
+	if !ok {
+		return fmt.Errorf("Unsupported signature '%s'", sig)
+	}
+	return checkHex(sig, hmacSum(sha256.New, w.Secret, body))
+}
+
+// The Stripe-Signature header lists the timestamp t and the v1 signatures,
+// hex HMAC-SHA256s of t.body, there is more than one while secrets are
+// rolled
+func (w *WebhookConfiguration) verifyStripe(req *http.Request, body []byte) error {
+	header, err := signatureHeader(req, "Stripe-Signature")
+	if err != nil {
+		return err
+	}
+
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if ts == "" || len(sigs) == 0 {
+		return fmt.Errorf("Malformed Stripe-Signature header")
+	}
+	if err = w.checkTimestamp(ts); err != nil {
+		return err
+	}
+
+	expected := hmacSum(sha256.New, w.Secret, []byte(ts), []byte("."), body)
+	for _, sig := range sigs {
+		if checkHex(sig, expected) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Signature mismatch")
+}
+
+// The X-Slack-Signature header is the hex HMAC-SHA256 of
+// v0:timestamp:body, prefixed with v0=
+func (w *WebhookConfiguration) verifySlack(req *http.Request, body []byte) error {
+	sig, err := signatureHeader(req, "X-Slack-Signature")
+	if err != nil {
+		return err
+	}
+	ts, err := signatureHeader(req, "X-Slack-Request-Timestamp")
+	if err != nil {
+		return err
+	}
+	if err = w.checkTimestamp(ts); err != nil {
+		return err
+	}
+
+	sig, ok := strings.CutPrefix(sig, "v0=")
+	if !ok {
+		return fmt.Errorf("Unsupported signature '%s'", sig)
+	}
+	return checkHex(sig, hmacSum(sha256.New, w.Secret, []byte("v0:"+ts+":"), body))
+}
+
+// The X-Twilio-Signature header is the base64 HMAC-SHA1 of the url the
+// request was sent to followed by the names and values of its form
+// parameters, sorted by name. Requests with other bodies sign just the url
+// and carry the hex SHA256 of the body in its bodySHA256 parameter.
+func (w *WebhookConfiguration) verifyTwilio(req *http.Request, body []byte, publicUrl string) error {
+	sig, err := signatureHeader(req, "X-Twilio-Signature")
+	if err != nil {
+		return err
+	}
+
+	scheme := "https"
+	if u, err := url.Parse(publicUrl); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+	signed := scheme + "://" + req.Host + req.URL.RequestURI()
+
+	if bodySum := req.URL.Query().Get("bodySHA256"); bodySum != "" {
+		sum := sha256.Sum256(body)
+		if err = checkHex(bodySum, sum[:]); err != nil {
+			return fmt.Errorf("Body doesn't match bodySHA256")
+		}
+	} else if contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); contentType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Errorf("Malformed form body: %v", err)
+		}
+
+		names := make([]string, 0, len(form))
+		for name := range form {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			values := form[name]
+			sort.Strings(values)
+			for _, value := range values {
+				signed += name + value
+			}
+		}
+	}
+
+	expected := hmacSum(sha1.New, w.Secret, []byte(signed))
+	if decoded, err := base64.StdEncoding.DecodeString(sig); err != nil || !hmac.Equal(decoded, expected) {
+		return fmt.Errorf("Signature mismatch")
+	}
+	return nil
+}
+
+func (w *WebhookConfiguration) verifyHmac(req *http.Request, body []byte) error {
+	sig, err := signatureHeader(req, w.Header)
+	if err != nil {
+		return err
+	}
+	sig, ok := strings.CutPrefix(sig, w.Prefix)
+	if !ok {
+		return fmt.Errorf("Signature doesn't start with '%s'", w.Prefix)
+	}
+
+	expected := hmacSum(sha256.New, w.Secret, body)
+	if w.Encoding == "base64" {
+		if decoded, err := base64.StdEncoding.DecodeString(sig); err != nil || !hmac.Equal(decoded, expected) {
+			return fmt.Errorf("Signature mismatch")
+		}
+		return nil
+	}
+	return checkHex(sig, expected)
+}
+
+// Rejects unix timestamps further than the tolerance from now, so that
+// captured requests can't be replayed later
+func (w *WebhookConfiguration) checkTimestamp(ts string) error {
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Malformed timestamp '%s'", ts)
+	}
+	if age := time.Since(time.Unix(secs, 0)); math.Abs(float64(age)) > float64(w.tolerance) {
+		return fmt.Errorf("Timestamp is %s off, more than the tolerance of %s", age.Round(time.Second), w.tolerance)
+	}
+	return nil
+}
+
+// Answers a request that failed verification and asks to close the
+// connection, since the body may not have been read
+func (w *WebhookConfiguration) reject(out io.Writer, req *http.Request, result string) error {
+	body := "Invalid webhook signature: " + result + "\n"
+	resp := &http.Response{
+		StatusCode:    http.StatusForbidden,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set(webhookHeader, result)
+	return resp.Write(out)
+}
+
+func signatureHeader(req *http.Request, name string) (string, error) {
+	v := strings.TrimSpace(req.Header.Get(name))
+	if v == "" {
+		return "", fmt.Errorf("Missing %s header", name)
+	}
+	return v, nil
+}
+
+func hmacSum(h func() hash.Hash, secret string, parts ...[]byte) []byte {
+	mac := hmac.New(h, []byte(secret))
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+// Compares a hex signature with the expected sum in constant time
+func checkHex(sig string, expected []byte) error {
+	if decoded, err := hex.DecodeString(sig); err != nil || !hmac.Equal(decoded, expected) {
+		return fmt.Errorf("Signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"ngrok/pkg/conn"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func webhookRequest(t *testing.T, target, body string, header map[string]string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	const secret = "It's a Secret to Everybody"
+	body := "Hello, World!"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	hexSum := func(parts ...string) string {
+		b := make([][]byte, len(parts))
+		for i, p := range parts {
+			b[i] = []byte(p)
+		}
+		return hex.EncodeToString(hmacSum(sha256.New, secret, b...))
+	}
+
+	form := "To=%2B18005551212&From=%2B12349013030&CallSid=CA1234567890ABCDE"
+	twilioSig := base64.StdEncoding.EncodeToString(hmacSum(sha1.New, secret,
+		[]byte("https://hooks.example.com/voice?x=1CallSidCA1234567890ABCDEFrom+12349013030To+18005551212")))
+	bodySum := sha256.Sum256([]byte(body))
+	jsonTarget := "https://hooks.example.com/voice?bodySHA256=" + hex.EncodeToString(bodySum[:])
+	twilioJsonSig := base64.StdEncoding.EncodeToString(hmacSum(sha1.New, secret, []byte(jsonTarget)))
+
+	tests := []struct {
+		name   string
+		config WebhookConfiguration
+		target string
+		body   string
+		header map[string]string
+		valid  bool
+	}{
+		// the example of GitHub's documentation
+		{"github", WebhookConfiguration{Provider: "github"}, "/", body,
+			map[string]string{"X-Hub-Signature-256": "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"}, true},
+		{"github tampered", WebhookConfiguration{Provider: "github"}, "/", body + "!",
+			map[string]string{"X-Hub-Signature-256": "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"}, false},
+		{"github missing", WebhookConfiguration{Provider: "github"}, "/", body, nil, false},
+
+		{"stripe", WebhookConfiguration{Provider: "stripe"}, "/", body,
+			map[string]string{"Stripe-Signature": "t=" + now + ",v1=" + hexSum(now, ".", body)}, true},
+		{"stripe rolled secret", WebhookConfiguration{Provider: "stripe"}, "/", body,
+			map[string]string{"Stripe-Signature": "t=" + now + ",v1=00ff,v1=" + hexSum(now, ".", body) + ",v0=00"}, true},
+		{"stripe expired", WebhookConfiguration{Provider: "stripe"}, "/", body,
+			map[string]string{"Stripe-Signature": "t=" + old + ",v1=" + hexSum(old, ".", body)}, false},
+		{"stripe tolerance", WebhookConfiguration{Provider: "stripe", Tolerance: "2h"}, "/", body,
+			map[string]string{"Stripe-Signature": "t=" + old + ",v1=" + hexSum(old, ".", body)}, true},
+		{"stripe other timestamp", WebhookConfiguration{Provider: "stripe"}, "/", body,
+			map[string]string{"Stripe-Signature": "t=" + now + ",v1=" + hexSum(old, ".", body)}, false},
+
+		{"slack", WebhookConfiguration{Provider: "slack"}, "/", body,
+			map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": "v0=" + hexSum("v0:", now, ":", body)}, true},
+		{"slack expired", WebhookConfiguration{Provider: "slack"}, "/", body,
+			map[string]string{"X-Slack-Request-Timestamp": old, "X-Slack-Signature": "v0=" + hexSum("v0:", old, ":", body)}, false},
+		{"slack missing timestamp", WebhookConfiguration{Provider: "slack"}, "/", body,
+			map[string]string{"X-Slack-Signature": "v0=" + hexSum("v0:", now, ":", body)}, false},
+
+		{"twilio form", WebhookConfiguration{Provider: "twilio"}, "https://hooks.example.com/voice?x=1", form,
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded", "X-Twilio-Signature": twilioSig}, true},
+		{"twilio form tampered", WebhookConfiguration{Provider: "twilio"}, "https://hooks.example.com/voice?x=1", form + "&Digits=1",
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded", "X-Twilio-Signature": twilioSig}, false},
+		{"twilio json", WebhookConfiguration{Provider: "twilio"}, jsonTarget, body,
+			map[string]string{"Content-Type": "application/json", "X-Twilio-Signature": twilioJsonSig}, true},
+		{"twilio json tampered", WebhookConfiguration{Provider: "twilio"}, jsonTarget, body + "!",
+			map[string]string{"Content-Type": "application/json", "X-Twilio-Signature": twilioJsonSig}, false},
+
+		{"hmac hex", WebhookConfiguration{Provider: "hmac", Header: "X-Signature"}, "/", body,
+			map[string]string{"X-Signature": hexSum(body)}, true},
+		{"hmac base64 prefix", WebhookConfiguration{Provider: "hmac", Header: "X-Signature", Encoding: "base64", Prefix: "sha256="}, "/", body,
+			map[string]string{"X-Signature": "sha256=" + base64.StdEncoding.EncodeToString(hmacSum(sha256.New, secret, []byte(body)))}, true},
+		{"hmac missing prefix", WebhookConfiguration{Provider: "hmac", Header: "X-Signature", Prefix: "sha256="}, "/", body,
+			map[string]string{"X-Signature": hexSum(body)}, false},
+		{"hmac wrong secret", WebhookConfiguration{Provider: "hmac", Header: "X-Signature"}, "/", body,
+			map[string]string{"X-Signature": hex.EncodeToString(hmacSum(sha256.New, "other", []byte(body)))}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Secret = secret
+			if err := tt.config.compile("for test"); err != nil {
+				t.Fatal(err)
+			}
+
+			req := webhookRequest(t, tt.target, tt.body, tt.header)
+			err := tt.config.verify(req, "https://hooks.example.com")
+			if tt.valid && err != nil {
+				t.Fatalf("valid request rejected: %v", err)
+			} else if !tt.valid && err == nil {
+				t.Fatalf("invalid request accepted")
+			}
+
+			// the body can still be passed on
+			if rest, _ := io.ReadAll(req.Body); string(rest) != tt.body {
+				t.Fatalf("body is %q after verifying, expected %q", rest, tt.body)
+			}
+		})
+	}
+}
+
+func TestCompileWebhook(t *testing.T) {
+	invalid := []WebhookConfiguration{
+		{Provider: "gitlab", Secret: "s"},
+		{Provider: "github"},
+		{Provider: "hmac", Secret: "s"},
+		{Provider: "hmac", Secret: "s", Header: "X-Signature", Encoding: "base32"},
+		{Provider: "slack", Secret: "s", Tolerance: "-1m"},
+	}
+	for _, w := range invalid {
+		if err := w.compile("for test"); err == nil {
+			t.Errorf("%+v accepted", w)
+		}
+	}
+}
+
+// Invalid requests are answered by the agent, valid ones reach the local
+// service, and the result is added to the response either way
+func TestDialRulesWebhook(t *testing.T) {
+	reached := 0
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer local.Close()
+
+	dial := func() (conn.Conn, error) {
+		c, err := net.Dial("tcp", local.Listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return conn.Wrap(c, "prv"), nil
+	}
+
+	webhook := &WebhookConfiguration{Provider: "hmac", Secret: "secret", Header: "X-Signature"}
+	if err := webhook.compile("for test"); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(sig string) *http.Response {
+		t.Helper()
+		c := dialRules("http://hooks.example.com", local.Listener.Addr().String(), dial, nil, webhook)
+		t.Cleanup(func() { c.Close() })
+
+		req := webhookRequest(t, "/hook", "payload", map[string]string{"X-Signature": sig})
+		if err := req.Write(c); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := send("00ff")
+	if resp.StatusCode != http.StatusForbidden || reached != 0 {
+		t.Fatalf("invalid request answered with %d, local service reached %d times", resp.StatusCode, reached)
+	}
+	if result := resp.Header.Get(webhookHeader); result != "hmac invalid: Signature mismatch" {
+		t.Fatalf("rejection tells %q", result)
+	}
+
+	resp = send(hex.EncodeToString(hmacSum(sha256.New, "secret", []byte("payload"))))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "payload" || reached != 1 {
+		t.Fatalf("valid request answered with %d %q, local service reached %d times", resp.StatusCode, body, reached)
+	}
+	if result := resp.Header.Get(webhookHeader); result != "hmac valid" {
+		t.Fatalf("response tells %q", result)
+	}
+}
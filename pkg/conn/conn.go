@@ -1,16 +1,14 @@
 package conn
 
 import (
-	"bufio"
 	"crypto/tls"
-	"encoding/base64"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
-	"net/http"
-	"net/url"
 	"ngrok/pkg/server/log"
+	"strings"
 	"sync"
 
 	vhost "github.com/inconshreveable/go-vhost"
@@ -48,12 +46,19 @@ func wrapConn(conn net.Conn, typ string) *loggedConn {
 		wrapped := &loggedConn{c, conn, log.NewPrefixLogger(), rand.Int31(), typ}
 		wrapped.AddLogPrefix(wrapped.Id())
 		return wrapped
+	case net.Conn:
+		// connections that aren't backed by a socket, like in-memory pipes
+		wrapped := &loggedConn{nil, conn, log.NewPrefixLogger(), rand.Int31(), typ}
+		wrapped.AddLogPrefix(wrapped.Id())
+		return wrapped
 	}
 
 	return nil
 }
 
-func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
+// Listens on addr, for connections which start with a PROXY protocol
+// header according to proxyMode, see ReadProxyHeader
+func Listen(addr, typ string, tlsCfg *tls.Config, proxyMode ProxyMode) (l *Listener, err error) {
 	// listen for incoming connections
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -65,6 +70,14 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
 		Conns: make(chan *loggedConn),
 	}
 
+	accept := func(c *loggedConn) {
+		if tlsCfg != nil {
+			c.Conn = tls.Server(c.Conn, tlsCfg)
+		}
+		c.Info("New connection from %v", c.RemoteAddr())
+		l.Conns <- c
+	}
+
 	go func() {
 		for {
 			rawConn, err := listener.Accept()
@@ -74,11 +87,20 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
 			}
 
 			c := wrapConn(rawConn, typ)
-			if tlsCfg != nil {
-				c.Conn = tls.Server(c.Conn, tlsCfg)
+			if proxyMode == ProxyNone {
+				accept(c)
+				continue
 			}
-			c.Info("New connection from %v", c.RemoteAddr())
-			l.Conns <- c
+
+			// waiting for the header must not hold up other connections
+			go func() {
+				if err := ReadProxyHeader(c, proxyMode); err != nil {
+					c.Warn("Rejecting connection from %v: %v", c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+				accept(c)
+			}()
 		}
 	}()
 	return
@@ -88,9 +110,15 @@ func Wrap(conn net.Conn, typ string) *loggedConn {
 	return wrapConn(conn, typ)
 }
 
+// Dial a TCP address, or a unix domain socket given as unix:///path
 func Dial(addr, typ string, tlsCfg *tls.Config) (conn *loggedConn, err error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		network, addr = "unix", path
+	}
+
 	var rawConn net.Conn
-	if rawConn, err = net.Dial("tcp", addr); err != nil {
+	if rawConn, err = net.Dial(network, addr); err != nil {
 		return
 	}
 
@@ -99,66 +127,15 @@ func Dial(addr, typ string, tlsCfg *tls.Config) (conn *loggedConn, err error) {
 
 	if tlsCfg != nil {
 		conn.StartTLS(tlsCfg)
-	}
 
-	return
-}
-
-func DialHttpProxy(proxyUrl, addr, typ string, tlsCfg *tls.Config) (conn *loggedConn, err error) {
-	// parse the proxy address
-	var parsedUrl *url.URL
-	if parsedUrl, err = url.Parse(proxyUrl); err != nil {
-		return
-	}
-
-	var proxyAuth string
-	if parsedUrl.User != nil {
-		proxyAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(parsedUrl.User.String()))
-	}
-
-	var proxyTlsConfig *tls.Config
-	switch parsedUrl.Scheme {
-	case "http":
-		proxyTlsConfig = nil
-	case "https":
-		proxyTlsConfig = new(tls.Config)
-	default:
-		err = fmt.Errorf("Proxy URL scheme must be http or https, got: %s", parsedUrl.Scheme)
-		return
-	}
-
-	// dial the proxy
-	if conn, err = Dial(parsedUrl.Host, typ, proxyTlsConfig); err != nil {
-		return
-	}
-
-	// send an HTTP proxy CONNECT message
-	req, err := http.NewRequest("CONNECT", "https://"+addr, nil)
-	if err != nil {
-		return
-	}
-
-	if proxyAuth != "" {
-		req.Header.Set("Proxy-Authorization", proxyAuth)
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; ngrok)")
-	req.Write(conn)
-
-	// read the proxy's response
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
-	if err != nil {
-		return
-	}
-	resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("Non-200 response from proxy server: %s", resp.Status)
-		return
+		// handshake now so that TLS failures are reported as dial errors
+		if err = conn.Conn.(*tls.Conn).Handshake(); err != nil {
+			conn.Close()
+			conn = nil
+			return
+		}
 	}
 
-	// upgrade to TLS
-	conn.StartTLS(tlsCfg)
-
 	return
 }
 
@@ -185,12 +162,53 @@ func (c *loggedConn) SetType(typ string) {
 	c.Info("Renamed connection %s", oldId)
 }
 
+// The certificates the peer presented in the TLS handshake of c, or over
+// the QUIC session c is a stream of, if any
+func PeerCertificates(c Conn) []*x509.Certificate {
+	lc, ok := c.(*loggedConn)
+	if !ok {
+		return nil
+	}
+
+	switch raw := lc.Conn.(type) {
+	case *tls.Conn:
+		return raw.ConnectionState().PeerCertificates
+	case *quicStreamConn:
+		return raw.session.ConnectionState().TLS.PeerCertificates
+	}
+	return nil
+}
+
 func (c *loggedConn) CloseRead() error {
 	// XXX: use CloseRead() in Conn.Join() and in Control.shutdown() for cleaner
 	// connection termination. Unfortunately, when I've tried that, I've observed
 	// failures where the connection was closed *before* flushing its write buffer,
 	// set with SetLinger() set properly (which it is by default).
-	return c.tcp.CloseRead()
+	if c.tcp != nil {
+		return c.tcp.CloseRead()
+	}
+
+	if unixConn, ok := c.Conn.(*net.UnixConn); ok {
+		return unixConn.CloseRead()
+	}
+
+	return fmt.Errorf("CloseRead is not supported on %s", c.Id())
+}
+
+// A connection whose reads are served by r
+type readerConn struct {
+	Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Reads c through r, which usually reads from c itself after some bytes of
+// its own, e.g. a rewritten request head
+func WithReader(c Conn, r io.Reader) Conn {
+	return &readerConn{c, r}
 }
 
 func Join(c Conn, c2 Conn) (int64, int64) {
@@ -0,0 +1,293 @@
+package conn
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const proxyHandshakeTimeout = 30 * time.Second
+
+var defaultProxyPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// Dial addr through the proxy at proxyUrl and start TLS with tlsCfg, if
+// it isn't nil, once the tunnel through the proxy is established. HTTP(S) proxies are asked
+// to CONNECT, socks5:// proxies are sent the resolved IP address of addr
+// and socks5h:// proxies are left to resolve it themselves.
+func DialProxy(proxyUrl, addr, typ string, tlsCfg *tls.Config) (conn *loggedConn, err error) {
+	// parse the proxy address
+	var parsedUrl *url.URL
+	if parsedUrl, err = url.Parse(proxyUrl); err != nil {
+		return
+	}
+
+	defaultPort, ok := defaultProxyPorts[parsedUrl.Scheme]
+	if !ok {
+		err = fmt.Errorf("Proxy URL scheme must be http, https, socks5 or socks5h, got: %s", parsedUrl.Scheme)
+		return
+	}
+
+	proxyAddr := parsedUrl.Host
+	if parsedUrl.Port() == "" {
+		proxyAddr = net.JoinHostPort(parsedUrl.Hostname(), defaultPort)
+	}
+
+	var proxyTlsConfig *tls.Config
+	if parsedUrl.Scheme == "https" {
+		proxyTlsConfig = &tls.Config{ServerName: parsedUrl.Hostname()}
+	}
+
+	// dial the proxy
+	if conn, err = Dial(proxyAddr, typ, proxyTlsConfig); err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	switch parsedUrl.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, parsedUrl, addr)
+	default:
+		err = httpConnect(conn, parsedUrl, addr)
+	}
+
+	if err != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// upgrade to TLS
+	if tlsCfg != nil {
+		conn.StartTLS(tlsCfg)
+	}
+
+	return
+}
+
+// The user info of a proxy URL is percent-encoded, the credentials sent to
+// the proxy must not be
+func proxyCredentials(u *url.URL) (username, password string, ok bool) {
+	if u.User == nil {
+		return
+	}
+	password, _ = u.User.Password()
+	return u.User.Username(), password, true
+}
+
+func httpConnect(conn *loggedConn, proxyUrl *url.URL, addr string) error {
+	// send an HTTP proxy CONNECT message
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if username, password, ok := proxyCredentials(proxyUrl); ok {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; ngrok)")
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// read the proxy's response, byte by byte so that nothing that
+	// follows it is consumed by a buffer
+	resp, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Non-200 response from proxy server: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Reads at most one byte at a time
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.Reader.Read(p)
+}
+
+// SOCKS5 as described by RFC 1928, with username/password authentication
+// as described by RFC 1929
+const (
+	socks5Version        = 5
+	socks5AuthNone       = 0
+	socks5AuthPassword   = 2
+	socks5NoAcceptable   = 0xff
+	socks5CmdConnect     = 1
+	socks5AddrIPv4       = 1
+	socks5AddrDomain     = 3
+	socks5AddrIPv6       = 4
+	socks5PasswordVer    = 1
+	socks5ReplySucceeded = 0
+)
+
+var socks5Replies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func socks5Connect(conn *loggedConn, proxyUrl *url.URL, addr string) (err error) {
+	username, password, withAuth := proxyCredentials(proxyUrl)
+
+	// negotiate the authentication method
+	methods := []byte{socks5AuthNone}
+	if withAuth {
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS5 proxy username and password must be at most 255 bytes")
+		}
+		methods = append(methods, socks5AuthPassword)
+	}
+
+	if _, err = conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return
+	}
+
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+
+	if buf[0] != socks5Version {
+		return fmt.Errorf("Proxy server is not a SOCKS5 server, version %d", buf[0])
+	}
+
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if !withAuth {
+			return fmt.Errorf("SOCKS5 proxy requires a username and password")
+		}
+
+		req := []byte{socks5PasswordVer, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err = conn.Write(req); err != nil {
+			return
+		}
+
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return
+		}
+
+		if buf[1] != 0 {
+			return fmt.Errorf("SOCKS5 proxy authentication failed")
+		}
+	case socks5NoAcceptable:
+		return fmt.Errorf("SOCKS5 proxy accepts none of the offered authentication methods")
+	default:
+		return fmt.Errorf("SOCKS5 proxy chose unsupported authentication method %d", buf[1])
+	}
+
+	// ask the proxy to connect
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port in address %s", addr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil && proxyUrl.Scheme == "socks5" {
+		// socks5:// resolves locally, socks5h:// lets the proxy do it
+		var ips []net.IP
+		if ips, err = net.LookupIP(host); err != nil {
+			return
+		}
+		ip = ips[0]
+		for _, candidate := range ips {
+			if candidate.To4() != nil {
+				ip = candidate
+				break
+			}
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("Host name too long for SOCKS5: %s", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+
+	// read the reply, including the bound address which isn't used
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+
+	if reply[1] != socks5ReplySucceeded {
+		reason, ok := socks5Replies[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("unknown error %d", reply[1])
+		}
+		return fmt.Errorf("SOCKS5 proxy failed to connect to %s: %s", addr, reason)
+	}
+
+	var boundLen int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		boundLen = net.IPv4len
+	case socks5AddrIPv6:
+		boundLen = net.IPv6len
+	case socks5AddrDomain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		boundLen = int(buf[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy replied with unknown address type %d", reply[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, boundLen+2))
+	return
+}
@@ -0,0 +1,336 @@
+package conn
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// What a test proxy saw of a client's handshake
+type proxyRequest struct {
+	username string
+	password string
+	target   string
+	domain   bool
+}
+
+type testProxy struct {
+	net.Listener
+	mu       sync.Mutex
+	requests []proxyRequest
+	username string
+	password string
+}
+
+func (p *testProxy) record(r proxyRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, r)
+}
+
+func (p *testProxy) last(t *testing.T) proxyRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.requests) == 0 {
+		t.Fatal("proxy saw no requests")
+	}
+	return p.requests[len(p.requests)-1]
+}
+
+func (p *testProxy) serve(handshake func(c net.Conn) (string, bool)) {
+	for {
+		c, err := p.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer c.Close()
+			target, ok := handshake(c)
+			if !ok {
+				return
+			}
+
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+
+			go io.Copy(upstream, c)
+			io.Copy(c, upstream)
+		}()
+	}
+}
+
+// A minimal SOCKS5 server which requires username/password authentication
+// if the proxy has a username
+func newSocks5Proxy(t *testing.T, username, password string) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{Listener: l, username: username, password: password}
+	t.Cleanup(func() { l.Close() })
+
+	go p.serve(func(c net.Conn) (string, bool) {
+		var r proxyRequest
+		rd := bufio.NewReader(c)
+		hdr := make([]byte, 2)
+		io.ReadFull(rd, hdr)
+		methods := make([]byte, hdr[1])
+		io.ReadFull(rd, methods)
+
+		if p.username == "" {
+			c.Write([]byte{5, 0})
+		} else {
+			c.Write([]byte{5, 2})
+			io.ReadFull(rd, hdr)
+			user := make([]byte, hdr[1])
+			io.ReadFull(rd, user)
+			plen, _ := rd.ReadByte()
+			pass := make([]byte, plen)
+			io.ReadFull(rd, pass)
+			r.username, r.password = string(user), string(pass)
+
+			if r.username != p.username || r.password != p.password {
+				p.record(r)
+				c.Write([]byte{1, 1})
+				return "", false
+			}
+			c.Write([]byte{1, 0})
+		}
+
+		req := make([]byte, 4)
+		io.ReadFull(rd, req)
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(rd, ip)
+			host = net.IP(ip).String()
+		case 4:
+			ip := make([]byte, 16)
+			io.ReadFull(rd, ip)
+			host = net.IP(ip).String()
+		case 3:
+			n, _ := rd.ReadByte()
+			name := make([]byte, n)
+			io.ReadFull(rd, name)
+			host, r.domain = string(name), true
+		}
+		port := make([]byte, 2)
+		io.ReadFull(rd, port)
+		r.target = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		p.record(r)
+
+		if r.domain && host != "localhost" {
+			c.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return "", false
+		}
+		if r.domain {
+			r.target = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		}
+
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		return r.target, true
+	})
+
+	return p
+}
+
+// A minimal HTTP CONNECT proxy which requires basic auth if the proxy has
+// a username
+func newConnectProxy(t *testing.T, username, password string) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{Listener: l, username: username, password: password}
+	t.Cleanup(func() { l.Close() })
+
+	go p.serve(func(c net.Conn) (string, bool) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil || req.Method != "CONNECT" {
+			return "", false
+		}
+
+		r := proxyRequest{target: req.Host}
+		if auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic "); ok {
+			creds, _ := base64.StdEncoding.DecodeString(auth)
+			r.username, r.password, _ = strings.Cut(string(creds), ":")
+		}
+		p.record(r)
+
+		if p.username != "" && (r.username != p.username || r.password != p.password) {
+			fmt.Fprint(c, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return "", false
+		}
+
+		fmt.Fprint(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, true
+	})
+
+	return p
+}
+
+func newTLSTarget(t *testing.T) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "through the proxy")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func checkTunnel(t *testing.T, c *loggedConn) {
+	t.Helper()
+	defer c.Close()
+
+	fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: target\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("failed to read response through the proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "through the proxy" {
+		t.Fatalf("unexpected response body %q", body)
+	}
+}
+
+var insecureTLS = &tls.Config{InsecureSkipVerify: true}
+
+func TestDialProxySocks5(t *testing.T) {
+	target := newTLSTarget(t)
+	targetAddr := target.Listener.Addr().String()
+	_, targetPort, _ := net.SplitHostPort(targetAddr)
+
+	t.Run("no auth", func(t *testing.T) {
+		p := newSocks5Proxy(t, "", "")
+		c, err := DialProxy("socks5://"+p.Addr().String(), targetAddr, "test", insecureTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTunnel(t, c)
+
+		if r := p.last(t); r.target != targetAddr || r.domain {
+			t.Fatalf("proxy was asked for %+v, want IP address %s", r, targetAddr)
+		}
+	})
+
+	t.Run("percent-encoded credentials", func(t *testing.T) {
+		p := newSocks5Proxy(t, "corp\\user", "p@ss:w/rd%")
+		proxyUrl := "socks5://corp%5Cuser:p%40ss%3Aw%2Frd%25@" + p.Addr().String()
+		c, err := DialProxy(proxyUrl, targetAddr, "test", insecureTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTunnel(t, c)
+	})
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		p := newSocks5Proxy(t, "user", "secret")
+		_, err := DialProxy("socks5://user:wrong@"+p.Addr().String(), targetAddr, "test", insecureTLS)
+		if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+			t.Fatalf("expected an authentication error, got %v", err)
+		}
+	})
+
+	t.Run("missing credentials", func(t *testing.T) {
+		p := newSocks5Proxy(t, "user", "secret")
+		_, err := DialProxy("socks5://"+p.Addr().String(), targetAddr, "test", insecureTLS)
+		if err == nil {
+			t.Fatal("expected an error without credentials")
+		}
+	})
+
+	t.Run("socks5 resolves locally", func(t *testing.T) {
+		p := newSocks5Proxy(t, "", "")
+		c, err := DialProxy("socks5://"+p.Addr().String(), "localhost:"+targetPort, "test", insecureTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTunnel(t, c)
+
+		if r := p.last(t); r.domain {
+			t.Fatalf("socks5 sent the host name %s instead of an IP address", r.target)
+		}
+	})
+
+	t.Run("socks5h resolves remotely", func(t *testing.T) {
+		p := newSocks5Proxy(t, "", "")
+		c, err := DialProxy("socks5h://"+p.Addr().String(), "localhost:"+targetPort, "test", insecureTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTunnel(t, c)
+
+		if r := p.last(t); !r.domain || r.target != "localhost:"+targetPort {
+			t.Fatalf("socks5h should send the host name, proxy saw %+v", r)
+		}
+	})
+
+	t.Run("connect failure", func(t *testing.T) {
+		p := newSocks5Proxy(t, "", "")
+		_, err := DialProxy("socks5h://"+p.Addr().String(), "unreachable.invalid:443", "test", insecureTLS)
+		if err == nil || !strings.Contains(err.Error(), "host unreachable") {
+			t.Fatalf("expected a host unreachable error, got %v", err)
+		}
+	})
+}
+
+func TestDialProxyHttpConnect(t *testing.T) {
+	target := newTLSTarget(t)
+	targetAddr := target.Listener.Addr().String()
+
+	t.Run("no auth", func(t *testing.T) {
+		p := newConnectProxy(t, "", "")
+		c, err := DialProxy("http://"+p.Addr().String(), targetAddr, "test", insecureTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTunnel(t, c)
+
+		if r := p.last(t); r.target != targetAddr {
+			t.Fatalf("proxy was asked to connect to %s, want %s", r.target, targetAddr)
+		}
+	})
+
+	t.Run("percent-encoded credentials", func(t *testing.T) {
+		p := newConnectProxy(t, "user", "p@ss:w/rd%")
+		c, err := DialProxy("http://user:p%40ss%3Aw%2Frd%25@"+p.Addr().String(), targetAddr, "test", insecureTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTunnel(t, c)
+
+		if r := p.last(t); r.password != "p@ss:w/rd%" {
+			t.Fatalf("proxy received password %q", r.password)
+		}
+	})
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		p := newConnectProxy(t, "user", "secret")
+		_, err := DialProxy("http://user:wrong@"+p.Addr().String(), targetAddr, "test", insecureTLS)
+		if err == nil || !strings.Contains(err.Error(), "407") {
+			t.Fatalf("expected a 407 error, got %v", err)
+		}
+	})
+}
+
+func TestDialProxyUnsupportedScheme(t *testing.T) {
+	if _, err := DialProxy("ftp://127.0.0.1:21", "127.0.0.1:443", "test", nil); err == nil {
+		t.Fatal("expected an error for an ftp:// proxy")
+	}
+}
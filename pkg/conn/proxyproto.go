@@ -0,0 +1,261 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The PROXY protocol, which L4 load balancers use to pass on the address
+// of the client they accepted a connection from, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+// Whether the connections of a listener start with a PROXY protocol header
+type ProxyMode int
+
+const (
+	// no header, connections are taken as they come
+	ProxyNone ProxyMode = iota
+	// connections may start with a header. Only for protocols whose
+	// clients speak first, like HTTP and TLS: the listener waits for the
+	// first bytes to tell.
+	ProxyOptional
+	// connections must start with a header, the others are rejected
+	ProxyRequire
+)
+
+// Parses a mode as in ngrokd's proxy_protocol setting
+func ParseProxyMode(mode string) (ProxyMode, error) {
+	switch mode {
+	case "", "none":
+		return ProxyNone, nil
+	case "optional":
+		return ProxyOptional, nil
+	case "require":
+		return ProxyRequire, nil
+	}
+	return ProxyNone, fmt.Errorf("Invalid PROXY protocol mode %q, must be none, optional or require", mode)
+}
+
+const (
+	// how long the peer may take to send the header
+	proxyHeaderTimeout = 10 * time.Second
+
+	// the longest v1 header, including CRLF
+	proxyV1MaxLen = 107
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// A connection whose header was read: reads continue after the header and
+// RemoteAddr is the address of the client the header names
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Reads the PROXY protocol header c starts with according to mode, after
+// which c's RemoteAddr is the address of the client it names. Headers of
+// connections the load balancer opened itself, e.g. for health checks,
+// leave it alone.
+func ReadProxyHeader(c Conn, mode ProxyMode) error {
+	lc, ok := c.(*loggedConn)
+	if !ok || mode == ProxyNone {
+		return nil
+	}
+
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(lc.Conn)
+	remote, found, err := parseProxyHeader(r)
+	switch {
+	case err != nil:
+		return err
+	case !found && mode == ProxyRequire:
+		return fmt.Errorf("Connection doesn't start with a PROXY protocol header")
+	}
+
+	if remote == nil {
+		remote = lc.Conn.RemoteAddr()
+	}
+	lc.Conn = &proxiedConn{Conn: lc.Conn, r: r, remote: remote}
+	if found {
+		lc.Debug("PROXY protocol header names client %v", remote)
+	}
+	return nil
+}
+
+// Parses a v1 or v2 header at the start of r, if there is one. remote is
+// nil for headers that don't name a client.
+func parseProxyHeader(r *bufio.Reader) (remote net.Addr, found bool, err error) {
+	// look at as few bytes as possible, so that connections without a
+	// header aren't held up waiting for more
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		if prefix, err := r.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(prefix, proxyV1Prefix) {
+			remote, err = parseProxyV1(r)
+			return remote, true, err
+		}
+	case proxyV2Signature[0]:
+		if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+			remote, err = parseProxyV2(r)
+			return remote, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("PROXY protocol v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header %q", text)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header %q", text)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+const (
+	proxyV2Version = 0x20
+	proxyV2Local   = 0x00
+	proxyV2Proxy   = 0x01
+
+	proxyV2Unspec    = 0x00
+	proxyV2TCP4      = 0x11
+	proxyV2UDP4      = 0x12
+	proxyV2TCP6      = 0x21
+	proxyV2UDP6      = 0x22
+	proxyV2HeaderLen = 16
+)
+
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [proxyV2HeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if verCmd&0xf0 != proxyV2Version {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", verCmd>>4)
+	}
+
+	// the addresses, then TLVs which are skipped
+	body := make([]byte, min(length, 36))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(length-len(body))); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0f {
+	case proxyV2Local:
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol v2 command %d", verCmd&0x0f)
+	}
+
+	switch family {
+	case proxyV2TCP4, proxyV2UDP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY protocol v2 header too short for IPv4 addresses")
+		}
+		return proxyV2Addr(family, net.IP(body[0:4]), body[8:10]), nil
+	case proxyV2TCP6, proxyV2UDP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY protocol v2 header too short for IPv6 addresses")
+		}
+		return proxyV2Addr(family, net.IP(body[0:16]), body[32:34]), nil
+	}
+
+	// unix sockets and unspecified families don't name a client we can use
+	return nil, nil
+}
+
+func proxyV2Addr(family byte, ip net.IP, port []byte) net.Addr {
+	ip = append(net.IP(nil), ip...)
+	p := int(binary.BigEndian.Uint16(port))
+	if family&0x0f == 0x02 {
+		return &net.UDPAddr{IP: ip, Port: p}
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// A v2 header telling that the connection was accepted from src on dst.
+// If they aren't both TCP addresses of the same family, the header tells
+// that the connection carries no client's.
+func ProxyHeaderV2(src, dst net.Addr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		return append(header, proxyV2Version|proxyV2Local, proxyV2Unspec, 0, 0)
+	}
+
+	var addrs []byte
+	family := byte(proxyV2TCP6)
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil {
+		family = proxyV2TCP4
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+
+	header = append(header, proxyV2Version|proxyV2Proxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
@@ -0,0 +1,91 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// Sends data over a pipe and returns the listening side after reading its
+// PROXY protocol header
+func readHeader(t *testing.T, data []byte, mode ProxyMode) (Conn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+
+	c := Wrap(server, "pub")
+	return c, ReadProxyHeader(c, mode)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8443}
+
+	tests := []struct {
+		name   string
+		header []byte
+		mode   ProxyMode
+		remote string // empty if the header must be rejected, "pipe" for the connection's own address
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), ProxyRequire, "192.0.2.1:56324"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 8443\r\n"), ProxyRequire, "[2001:db8::1]:443"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ProxyRequire, "pipe"},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n"), ProxyRequire, ""},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), ProxyRequire, ""},
+		{"v2 tcp4", ProxyHeaderV2(v4, dst4), ProxyRequire, "192.0.2.1:56324"},
+		{"v2 tcp6", ProxyHeaderV2(v6, dst6), ProxyRequire, "[2001:db8::1]:443"},
+		{"v2 local", ProxyHeaderV2(nil, dst4), ProxyRequire, "pipe"},
+		{"missing", nil, ProxyRequire, ""},
+		{"optional missing", nil, ProxyOptional, "pipe"},
+		{"optional v2", ProxyHeaderV2(v4, dst4), ProxyOptional, "192.0.2.1:56324"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte("GET / HTTP/1.1\r\n\r\n")
+			c, err := readHeader(t, append(append([]byte(nil), tt.header...), payload...), tt.mode)
+			if tt.remote == "" {
+				if err == nil {
+					t.Fatalf("header %q accepted", tt.header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("header %q: %v", tt.header, err)
+			}
+
+			if remote := c.RemoteAddr().String(); remote != tt.remote {
+				t.Fatalf("remote address %s, expected %s", remote, tt.remote)
+			}
+
+			// the connection continues right after the header
+			if rest, err := io.ReadAll(c); err != nil || !bytes.Equal(rest, payload) {
+				t.Fatalf("read %q after the header, %v", rest, err)
+			}
+		})
+	}
+}
+
+func FuzzParseProxyHeader(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	f.Add(ProxyHeaderV2(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}))
+	f.Add(append(ProxyHeaderV2(nil, nil)[:14], 0xff, 0xff))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		remote, found, err := parseProxyHeader(r)
+		if err == nil && !found && remote != nil {
+			t.Fatalf("no header found but remote %v", remote)
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"ngrok/pkg/server/log"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// ALPN protocol of the QUIC transport between client and server
+	quicAlpn = "ngrok"
+
+	quicHandshakeTimeout = 10 * time.Second
+
+	// detect dead sessions quickly, so that a client which couldn't
+	// migrate its session reconnects and resumes its tunnels
+	quicKeepAlivePeriod = 5 * time.Second
+	quicMaxIdleTimeout  = 15 * time.Second
+
+	// how often to check whether the client changed networks
+	quicRouteCheckInterval = 2 * time.Second
+
+	// every proxy connection is a stream
+	quicMaxStreams = 1 << 16
+)
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:  quicHandshakeTimeout,
+		KeepAlivePeriod:       quicKeepAlivePeriod,
+		MaxIdleTimeout:        quicMaxIdleTimeout,
+		MaxIncomingStreams:    quicMaxStreams,
+		MaxIncomingUniStreams: -1,
+	}
+}
+
+func quicTLSConfig(tlsCfg *tls.Config) *tls.Config {
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.NextProtos = []string{quicAlpn}
+	return tlsCfg
+}
+
+// A QUIC stream as a net.Conn
+type quicStreamConn struct {
+	quic.Stream
+	session quic.Connection
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.session.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.session.RemoteAddr() }
+
+// Closing a stream only closes its write direction, stop reading too
+func (c *quicStreamConn) Close() error {
+	c.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// A QUIC connection to the server. Control and proxy connections are
+// streams of the session, which saves a handshake per proxy connection and
+// keeps a lost packet on one stream from stalling the others.
+//
+// The session follows the client across networks: when the route to the
+// server changes, e.g. a laptop moves from Wi-Fi to a tethered phone, the
+// session migrates to a new socket and its streams survive.
+type QuicSession struct {
+	quic.Connection
+
+	raddr *net.UDPAddr
+
+	// the transports are only closed with the session, closing one would
+	// tear down the connection even after it migrated away. mu also guards
+	// routeIp.
+	mu         sync.Mutex
+	transports []*quic.Transport
+	routeIp    net.IP
+}
+
+func DialQuic(addr string, tlsCfg *tls.Config) (*QuicSession, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := newQuicTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+	defer cancel()
+
+	tlsCfg = quicTLSConfig(tlsCfg)
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	session, err := tr.Dial(ctx, raddr, tlsCfg, quicConfig())
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+
+	s := &QuicSession{
+		Connection: session,
+		raddr:      raddr,
+		transports: []*quic.Transport{tr},
+		routeIp:    localRouteIp(raddr),
+	}
+	go s.followNetwork()
+	return s, nil
+}
+
+func newQuicTransport() (*quic.Transport, error) {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &quic.Transport{Conn: udpConn}, nil
+}
+
+// The local address the OS would send packets to raddr from. Connecting a
+// UDP socket only looks up the route, no packets are sent.
+func localRouteIp(raddr *net.UDPAddr) net.IP {
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+// Watches the route to the server and migrates the session when it changes
+func (s *QuicSession) followNetwork() {
+	ticker := time.NewTicker(quicRouteCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		routeIp := localRouteIp(s.raddr)
+		s.mu.Lock()
+		oldIp := s.routeIp
+		s.mu.Unlock()
+		if routeIp == nil || routeIp.Equal(oldIp) {
+			continue
+		}
+
+		log.Info("Route to %v changed from %v to %v, migrating QUIC session", s.raddr, oldIp, routeIp)
+		if err := s.migrate(); err != nil {
+			// the old path may still work, e.g. if the new network is
+			// flaky. If it doesn't, the idle timeout closes the session.
+			log.Warn("Failed to migrate QUIC session to %v: %v", routeIp, err)
+			continue
+		}
+		s.mu.Lock()
+		s.routeIp = routeIp
+		s.mu.Unlock()
+	}
+}
+
+func (s *QuicSession) migrate() error {
+	tr, err := newQuicTransport()
+	if err != nil {
+		return err
+	}
+
+	path, err := s.AddPath(tr)
+	if err != nil {
+		tr.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.Context(), quicHandshakeTimeout)
+	defer cancel()
+
+	if err = path.Probe(ctx); err == nil {
+		err = path.Switch()
+	}
+	if err != nil {
+		path.Close()
+		tr.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	s.transports = append(s.transports, tr)
+	s.mu.Unlock()
+	return nil
+}
+
+// Whether the session can no longer open streams
+func (s *QuicSession) Closed() bool {
+	return s.Context().Err() != nil
+}
+
+func (s *QuicSession) OpenConn(typ string) (conn *loggedConn, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+	defer cancel()
+
+	stream, err := s.OpenStreamSync(ctx)
+	if err != nil {
+		return
+	}
+
+	conn = wrapConn(&quicStreamConn{stream, s.Connection}, typ)
+	conn.Debug("New QUIC stream to: %v", s.RemoteAddr())
+	return
+}
+
+func (s *QuicSession) Close() error {
+	err := s.CloseWithError(0, "")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tr := range s.transports {
+		tr.Close()
+	}
+	s.transports = nil
+	return err
+}
+
+// Listens for QUIC sessions and delivers each stream they open as a
+// connection, until ctx is done
+func ListenQuic(ctx context.Context, addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
+	listener, err := quic.ListenAddr(addr, quicTLSConfig(tlsCfg), quicConfig())
+	if err != nil {
+		return
+	}
+	context.AfterFunc(ctx, func() { listener.Close() })
+
+	l = &Listener{
+		Addr:  listener.Addr(),
+		Conns: make(chan *loggedConn),
+	}
+
+	go func() {
+		for {
+			session, err := listener.Accept(ctx)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+					log.Debug("Stopped accepting QUIC sessions of type %s: %v", typ, err)
+					return
+				}
+				log.Error("Failed to accept new QUIC session of type %s: %v", typ, err)
+				continue
+			}
+
+			log.Debug("New QUIC session from %v", session.RemoteAddr())
+			go func() {
+				for {
+					stream, err := session.AcceptStream(context.Background())
+					if err != nil {
+						log.Debug("QUIC session from %v closed: %v", session.RemoteAddr(), err)
+						return
+					}
+
+					c := wrapConn(&quicStreamConn{stream, session}, typ)
+					c.Info("New QUIC stream from %v", c.RemoteAddr())
+					select {
+					case l.Conns <- c:
+					case <-ctx.Done():
+						c.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return
+}
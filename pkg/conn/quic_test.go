@@ -0,0 +1,91 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func snakeoilTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair("../../assets/server/tls/snakeoil.crt", "../../assets/server/tls/snakeoil.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func TestQuicDialAccept(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := ListenQuic(ctx, "127.0.0.1:0", "tun", snakeoilTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := DialQuic(l.Addr.String(), insecureTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// every connection is a stream of the one session
+	for _, typ := range []string{"ctl", "pxy"} {
+		c, err := s.OpenConn(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		// a stream is only announced to the server with its first bytes
+		if _, err = c.Write([]byte(typ)); err != nil {
+			t.Fatal(err)
+		}
+
+		var accepted *loggedConn
+		select {
+		case accepted = <-l.Conns:
+		case <-time.After(quicHandshakeTimeout):
+			t.Fatalf("%s stream not accepted", typ)
+		}
+		defer accepted.Close()
+
+		buf := make([]byte, len(typ))
+		if _, err = io.ReadFull(accepted, buf); err != nil || string(buf) != typ {
+			t.Fatalf("server read %q, %v", buf, err)
+		}
+		if _, err = accepted.Write([]byte("ok")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(c, buf[:2]); err != nil || string(buf[:2]) != "ok" {
+			t.Fatalf("client read %q, %v", buf[:2], err)
+		}
+	}
+}
+
+// Once its context is done, the listener releases its port
+func TestQuicListenerClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := ListenQuic(ctx, "127.0.0.1:0", "tun", snakeoilTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(quicHandshakeTimeout)
+	for {
+		c, err := net.ListenUDP("udp", l.Addr.(*net.UDPAddr))
+		if err == nil {
+			c.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("port still in use after closing: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
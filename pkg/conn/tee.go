@@ -19,7 +19,9 @@ import (
 // NB: the data is Tee'd into a shared-memory io.Pipe which
 // has a limited (and small) buffer. If you are not consuming from
 // the ReadBuffer() and WriteBuffer(), you are going to block
-// your application's real traffic from flowing over the connection
+// your application's real traffic from flowing over the connection.
+// Consume each buffer until EOF, even after you stop caring about
+// its contents.
 
 type Tee struct {
 	rd       io.Reader
@@ -32,6 +34,8 @@ type Tee struct {
 		rd *io.PipeReader
 		wr *io.PipeWriter
 	}
+	readBuf  *bufio.Reader
+	writeBuf *bufio.Reader
 	Conn
 }
 
@@ -45,17 +49,23 @@ func NewTee(conn Conn) *Tee {
 	c.readPipe.rd, c.readPipe.wr = io.Pipe()
 	c.writePipe.rd, c.writePipe.wr = io.Pipe()
 
+	c.readBuf = bufio.NewReader(c.readPipe.rd)
+	c.writeBuf = bufio.NewReader(c.writePipe.rd)
+
 	c.rd = io.TeeReader(c.Conn, c.readPipe.wr)
 	c.wr = io.MultiWriter(c.Conn, c.writePipe.wr)
 	return c
 }
 
+// The copy of what was read from the connection. Every call returns the
+// same reader, a fresh bufio.Reader would lose what the last one buffered.
 func (c *Tee) ReadBuffer() *bufio.Reader {
-	return bufio.NewReader(c.readPipe.rd)
+	return c.readBuf
 }
 
+// The copy of what was written to the connection, see ReadBuffer
 func (c *Tee) WriteBuffer() *bufio.Reader {
-	return bufio.NewReader(c.writePipe.rd)
+	return c.writeBuf
 }
 
 func (c *Tee) Read(b []byte) (n int, err error) {
@@ -74,6 +84,14 @@ func (c *Tee) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 
+// Close the underlying connection and both pipes so that anything
+// consuming the ReadBuffer() and WriteBuffer() sees EOF
+func (c *Tee) Close() error {
+	c.readPipe.wr.Close()
+	c.writePipe.wr.Close()
+	return c.Conn.Close()
+}
+
 func (c *Tee) Write(b []byte) (n int, err error) {
 	n, err = c.wr.Write(b)
 	if err != nil {
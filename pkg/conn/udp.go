@@ -0,0 +1,269 @@
+package conn
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"ngrok/pkg/server/log"
+	"sync"
+	"time"
+)
+
+const (
+	// largest possible UDP payload
+	maxDatagramSize = 65535
+
+	// datagrams queued per flow before new ones are dropped
+	flowBacklog = 64
+)
+
+// Adapts a connection which preserves message boundaries, i.e. every Read
+// returns one datagram and every Write sends one, to a stream so that
+// datagrams can be proxied and joined like any other connection. On the
+// stream, every datagram is prefixed with its length as a 16-bit big endian
+// integer.
+type framedConn struct {
+	net.Conn
+	dgram []byte
+	rbuf  []byte
+	wbuf  []byte
+}
+
+func (c *framedConn) Read(p []byte) (n int, err error) {
+	if len(c.rbuf) == 0 {
+		if c.dgram == nil {
+			// any UDP payload fits, and so does its length in the prefix
+			c.dgram = make([]byte, 2+maxDatagramSize)
+		}
+
+		if n, err = c.Conn.Read(c.dgram[2:]); err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(c.dgram, uint16(n))
+		c.rbuf = c.dgram[:2+n]
+	}
+
+	n = copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return
+}
+
+func (c *framedConn) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+
+	frames := c.wbuf
+	for len(frames) >= 2 {
+		size := int(binary.BigEndian.Uint16(frames))
+		if len(frames) < 2+size {
+			break
+		}
+
+		if _, err := c.Conn.Write(frames[2 : 2+size]); err != nil {
+			return 0, err
+		}
+		frames = frames[2+size:]
+	}
+
+	// keep the partial frame, if any, for the next write
+	c.wbuf = append(c.wbuf[:0], frames...)
+	return len(p), nil
+}
+
+// Dial a UDP address. The returned connection frames datagrams as
+// described by framedConn.
+func DialUDP(addr, typ string) (conn *loggedConn, err error) {
+	var rawConn net.Conn
+	if rawConn, err = net.Dial("udp", addr); err != nil {
+		return
+	}
+
+	conn = wrapConn(&framedConn{Conn: rawConn}, typ)
+	conn.Debug("New connection to: %v", rawConn.RemoteAddr())
+	return
+}
+
+// Accepts a new connection, called a flow, for every remote address that
+// sends datagrams to a UDP socket. Flows are closed after they have been
+// idle for longer than the idle timeout.
+type UDPListener struct {
+	log.Logger
+	conn        *net.UDPConn
+	typ         string
+	idleTimeout time.Duration
+	flows       map[string]*udpFlow
+	accept      chan *loggedConn
+	closed      chan struct{}
+	closeOnce   sync.Once
+	sync.Mutex
+}
+
+func ListenUDP(laddr *net.UDPAddr, typ string, idleTimeout time.Duration) (l *UDPListener, err error) {
+	var udpConn *net.UDPConn
+	if udpConn, err = net.ListenUDP("udp", laddr); err != nil {
+		return
+	}
+
+	l = &UDPListener{
+		Logger:      log.NewPrefixLogger("udp", udpConn.LocalAddr().String()),
+		conn:        udpConn,
+		typ:         typ,
+		idleTimeout: idleTimeout,
+		flows:       make(map[string]*udpFlow),
+		accept:      make(chan *loggedConn),
+		closed:      make(chan struct{}),
+	}
+
+	go l.serve()
+	return
+}
+
+func (l *UDPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Returns the next new flow. The returned connection frames datagrams as
+// described by framedConn.
+func (l *UDPListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Closes the socket and all of its flows
+func (l *UDPListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+
+		l.Lock()
+		flows := make([]*udpFlow, 0, len(l.flows))
+		for _, f := range l.flows {
+			flows = append(flows, f)
+		}
+		l.Unlock()
+
+		for _, f := range flows {
+			f.Close()
+		}
+	})
+	return nil
+}
+
+// Reads datagrams off the socket and dispatches them to their flows
+func (l *UDPListener) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, raddr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+			default:
+				l.Error("Failed to read from UDP socket: %v", err)
+				l.Close()
+			}
+			return
+		}
+
+		key := raddr.String()
+		l.Lock()
+		f, ok := l.flows[key]
+		if !ok {
+			f = newUdpFlow(l, raddr)
+			l.flows[key] = f
+		}
+		l.Unlock()
+
+		if !ok {
+			c := wrapConn(&framedConn{Conn: f}, l.typ)
+			c.Info("New flow from %v", raddr)
+
+			select {
+			case l.accept <- c:
+			case <-l.closed:
+				return
+			}
+		}
+
+		select {
+		case f.in <- append([]byte(nil), buf[:n]...):
+			f.touch()
+		default:
+			f.Debug("Dropping datagram, backlog is full")
+		}
+	}
+}
+
+// The datagrams exchanged with a single remote address, as a net.Conn
+type udpFlow struct {
+	log.Logger
+	l         *UDPListener
+	remote    *net.UDPAddr
+	in        chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	idle      *time.Timer
+}
+
+func newUdpFlow(l *UDPListener, remote *net.UDPAddr) *udpFlow {
+	f := &udpFlow{
+		Logger: log.NewPrefixLogger("flow", remote.String()),
+		l:      l,
+		remote: remote,
+		in:     make(chan []byte, flowBacklog),
+		closed: make(chan struct{}),
+	}
+	f.idle = time.AfterFunc(l.idleTimeout, func() {
+		f.Debug("Closing flow after %v idle", l.idleTimeout)
+		f.Close()
+	})
+	return f
+}
+
+func (f *udpFlow) touch() {
+	f.idle.Reset(f.l.idleTimeout)
+}
+
+func (f *udpFlow) Read(p []byte) (int, error) {
+	select {
+	case d := <-f.in:
+		return copy(p, d), nil
+	case <-f.closed:
+		return 0, io.EOF
+	}
+}
+
+func (f *udpFlow) Write(p []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	f.touch()
+	return f.l.conn.WriteToUDP(p, f.remote)
+}
+
+func (f *udpFlow) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.idle.Stop()
+
+		f.l.Lock()
+		if f.l.flows[f.remote.String()] == f {
+			delete(f.l.flows, f.remote.String())
+		}
+		f.l.Unlock()
+	})
+	return nil
+}
+
+func (f *udpFlow) LocalAddr() net.Addr  { return f.l.conn.LocalAddr() }
+func (f *udpFlow) RemoteAddr() net.Addr { return f.remote }
+
+// flows share the listener's socket, so deadlines aren't supported
+func (f *udpFlow) SetDeadline(t time.Time) error      { return nil }
+func (f *udpFlow) SetReadDeadline(t time.Time) error  { return nil }
+func (f *udpFlow) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,64 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func frame(dgram []byte) []byte {
+	f := make([]byte, 2, 2+len(dgram))
+	binary.BigEndian.PutUint16(f, uint16(len(dgram)))
+	return append(f, dgram...)
+}
+
+// A pipe keeps the boundaries of writes like a datagram socket, as long as
+// reads are large enough
+func TestFramedConnRoundTrip(t *testing.T) {
+	dgramSide, framedSide := net.Pipe()
+	defer dgramSide.Close()
+	c := &framedConn{Conn: framedSide}
+	defer c.Close()
+
+	max := bytes.Repeat([]byte{0xab}, maxDatagramSize)
+	dgrams := [][]byte{[]byte("hello"), {}, max, []byte("bye")}
+
+	// datagrams to frames
+	go func() {
+		for _, d := range dgrams {
+			dgramSide.Write(d)
+		}
+	}()
+	for _, d := range dgrams {
+		f := make([]byte, 2+len(d))
+		if _, err := io.ReadFull(c, f); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(f, frame(d)) {
+			t.Fatalf("frame of %d bytes doesn't match its datagram of %d bytes", len(f), len(d))
+		}
+	}
+
+	// frames to datagrams, whichever way the stream is split
+	var stream []byte
+	for _, d := range dgrams {
+		stream = append(stream, frame(d)...)
+	}
+	go func() {
+		for _, chunk := range [][]byte{stream[:1], stream[1:9], stream[9:20000], stream[20000:]} {
+			c.Write(chunk)
+		}
+	}()
+	buf := make([]byte, maxDatagramSize+1)
+	for _, d := range dgrams {
+		n, err := dgramSide.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], d) {
+			t.Fatalf("datagram of %d bytes, expected %d bytes", n, len(d))
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const websocketHandshakeTimeout = 30 * time.Second
+
+// Carries a byte stream in binary websocket messages, so that control and
+// proxy connections can pass through L7 load balancers and firewalls that
+// only allow HTTP(S)
+type wsConn struct {
+	*websocket.Conn
+	rd  io.Reader
+	wmu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.rd == nil {
+			_, rd, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.rd = rd
+		}
+
+		n, err := c.rd.Read(p)
+		if err == io.EOF {
+			c.rd = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Dial a wss:// url. If proxyUrl is set, the websocket connection is made
+// through that proxy, see DialProxy.
+func DialWebsocket(wsUrl, typ string, tlsCfg *tls.Config, proxyUrl string) (conn *loggedConn, err error) {
+	dialer := &websocket.Dialer{
+		TLSClientConfig:  tlsCfg,
+		HandshakeTimeout: websocketHandshakeTimeout,
+	}
+
+	if proxyUrl != "" {
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialProxy(proxyUrl, addr, typ, nil)
+		}
+	}
+
+	ws, resp, err := dialer.Dial(wsUrl, nil)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("Websocket handshake with %s failed: %s", wsUrl, resp.Status)
+		}
+		return
+	}
+
+	conn = wrapConn(&wsConn{Conn: ws}, typ)
+	conn.Debug("New websocket connection to: %v", ws.RemoteAddr())
+	return
+}
+
+var websocketUpgrader = websocket.Upgrader{
+	HandshakeTimeout: websocketHandshakeTimeout,
+
+	// clients aren't browsers, there is no origin to check
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Reads the websocket handshake request off c and completes it. Returns
+// the upgraded connection, or an error after answering the request if it
+// isn't a valid websocket handshake.
+func AcceptWebsocket(c Conn, typ string) (Conn, error) {
+	rd := bufio.NewReader(c)
+	req, err := http.ReadRequest(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &hijackWriter{conn: c, rw: bufio.NewReadWriter(rd, bufio.NewWriter(c)), header: make(http.Header)}
+	ws, err := websocketUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		w.flush()
+		return nil, err
+	}
+
+	upgraded := wrapConn(&wsConn{Conn: ws}, typ)
+	upgraded.Debug("Accepted websocket connection from: %v", ws.RemoteAddr())
+	return upgraded, nil
+}
+
+// The minimal http.ResponseWriter the websocket upgrader needs for a
+// connection that isn't served by an http.Server. Error responses are
+// buffered and written by flush.
+type hijackWriter struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *hijackWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *hijackWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *hijackWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, w.rw, nil
+}
+
+func (w *hijackWriter) flush() error {
+	w.WriteHeader(http.StatusOK)
+	resp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		ContentLength: int64(w.body.Len()),
+		Body:          io.NopCloser(&w.body),
+		Close:         true,
+	}
+	return resp.Write(w.conn)
+}
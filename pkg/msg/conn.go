@@ -2,70 +2,153 @@ package msg
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"io"
 	"ngrok/pkg/conn"
 )
 
-func readMsgShared(c conn.Conn) (buffer []byte, err error) {
-	c.Debug("Waiting to read message")
+// Messages larger than this are rejected before reading them, so a peer
+// can't make us allocate whatever size it claims
+const MaxFrameSize = 256 * 1024
+
+// How messages are delimited on a connection
+type framing interface {
+	readFrame(c conn.Conn) ([]byte, error)
+	writeFrame(c conn.Conn, buffer []byte) error
+}
+
+// The original framing: an int64 little-endian length prefix
+type legacyFraming struct{}
 
+func (legacyFraming) readFrame(c conn.Conn) ([]byte, error) {
 	var sz int64
-	err = binary.Read(c, binary.LittleEndian, &sz)
-	if err != nil {
-		return
+	if err := binary.Read(c, binary.LittleEndian, &sz); err != nil {
+		return nil, err
 	}
-	c.Debug("Reading message with length: %d", sz)
+	return readFrameBody(c, sz)
+}
 
-	buffer = make([]byte, sz)
-	n, err := c.Read(buffer)
-	c.Debug("Read message %s", buffer)
+func (legacyFraming) writeFrame(c conn.Conn, buffer []byte) error {
+	hdr := make([]byte, 8, 8+len(buffer))
+	binary.LittleEndian.PutUint64(hdr, uint64(len(buffer)))
+	_, err := c.Write(append(hdr, buffer...))
+	return err
+}
 
-	if err != nil {
-		return
+// A uint32 big-endian length prefix, see CapFrame32
+type frame32Framing struct{}
+
+func (frame32Framing) readFrame(c conn.Conn) ([]byte, error) {
+	var sz uint32
+	if err := binary.Read(c, binary.BigEndian, &sz); err != nil {
+		return nil, err
 	}
+	return readFrameBody(c, int64(sz))
+}
 
-	if int64(n) != sz {
-		err = errors.New(fmt.Sprintf("Expected to read %d bytes, but only read %d", sz, n))
-		return
+func (frame32Framing) writeFrame(c conn.Conn, buffer []byte) error {
+	hdr := make([]byte, 4, 4+len(buffer))
+	binary.BigEndian.PutUint32(hdr, uint32(len(buffer)))
+	_, err := c.Write(append(hdr, buffer...))
+	return err
+}
+
+func readFrameBody(c conn.Conn, sz int64) (buffer []byte, err error) {
+	c.Debug("Reading message with length: %d", sz)
+	if sz <= 0 || sz > MaxFrameSize {
+		return nil, fmt.Errorf("Invalid message length %d, must be between 1 and %d", sz, MaxFrameSize)
 	}
 
+	buffer = make([]byte, sz)
+	if _, err = io.ReadFull(c, buffer); err != nil {
+		return nil, err
+	}
 	return
 }
 
-func ReadMsg(c conn.Conn) (msg Message, err error) {
-	buffer, err := readMsgShared(c)
-	if err != nil {
-		return
+// Reads and writes messages with a framing and an encoding. A control
+// connection starts with Legacy, which every version of ngrok speaks, and
+// switches to the codec of the capabilities both sides support after the
+// Auth/AuthResp exchange, see CodecFor.
+type Codec struct {
+	framing  framing
+	encoding encoding
+	name     string
+}
+
+// JSON in int64 little-endian length-prefixed frames
+var Legacy = &Codec{legacyFraming{}, jsonEncoding{}, "legacy"}
+
+// The codec for the negotiated capabilities
+func CodecFor(caps []string) *Codec {
+	codec := *Legacy
+	if HasCapability(caps, CapFrame32) {
+		codec.framing = frame32Framing{}
+		codec.name = CapFrame32
+	}
+	if HasCapability(caps, CapCBOR) {
+		codec.encoding = cborEncoding{}
+		codec.name += "+" + CapCBOR
 	}
+	return &codec
+}
 
-	return Unpack(buffer)
+func (cd *Codec) String() string {
+	return cd.name
 }
 
-func ReadMsgInto(c conn.Conn, msg Message) (err error) {
-	buffer, err := readMsgShared(c)
+func (cd *Codec) readMsgShared(c conn.Conn) (buffer []byte, err error) {
+	c.Debug("Waiting to read message")
+	return cd.framing.readFrame(c)
+}
+
+func (cd *Codec) ReadMsg(c conn.Conn) (msg Message, err error) {
+	buffer, err := cd.readMsgShared(c)
 	if err != nil {
 		return
 	}
-	return UnpackInto(buffer, msg)
+
+	msg, err = unpack(cd.encoding, buffer, nil)
+	if err == nil {
+		c.Debug("Read message %T %+v", msg, msg)
+	}
+	return
 }
 
-func WriteMsg(c conn.Conn, msg interface{}) (err error) {
-	buffer, err := Pack(msg)
+func (cd *Codec) ReadMsgInto(c conn.Conn, msg Message) (err error) {
+	buffer, err := cd.readMsgShared(c)
 	if err != nil {
 		return
 	}
 
-	c.Debug("Writing message: %s", string(buffer))
-	err = binary.Write(c, binary.LittleEndian, int64(len(buffer)))
+	if _, err = unpack(cd.encoding, buffer, msg); err == nil {
+		c.Debug("Read message %T %+v", msg, msg)
+	}
+	return
+}
 
+func (cd *Codec) WriteMsg(c conn.Conn, msg interface{}) (err error) {
+	buffer, err := pack(cd.encoding, msg)
 	if err != nil {
 		return
 	}
 
-	if _, err = c.Write(buffer); err != nil {
-		return
+	if len(buffer) > MaxFrameSize {
+		return fmt.Errorf("Message %T of %d bytes exceeds the maximum of %d", msg, len(buffer), MaxFrameSize)
 	}
 
-	return nil
+	c.Debug("Writing message %T %+v", msg, msg)
+	return cd.framing.writeFrame(c, buffer)
+}
+
+func ReadMsg(c conn.Conn) (msg Message, err error) {
+	return Legacy.ReadMsg(c)
+}
+
+func ReadMsgInto(c conn.Conn, msg Message) (err error) {
+	return Legacy.ReadMsgInto(c, msg)
+}
+
+func WriteMsg(c conn.Conn, msg interface{}) (err error) {
+	return Legacy.WriteMsg(c, msg)
 }
@@ -18,10 +18,52 @@ func init() {
 	TypeMap["RegProxy"] = t((*RegProxy)(nil))
 	TypeMap["ReqProxy"] = t((*ReqProxy)(nil))
 	TypeMap["StartProxy"] = t((*StartProxy)(nil))
+	TypeMap["ProxyResp"] = t((*ProxyResp)(nil))
+	TypeMap["RegConnect"] = t((*RegConnect)(nil))
+	TypeMap["ConnectResp"] = t((*ConnectResp)(nil))
 	TypeMap["Ping"] = t((*Ping)(nil))
 	TypeMap["Pong"] = t((*Pong)(nil))
 }
 
+// Capabilities are optional protocol features. A client lists the ones it
+// supports in Auth and the server answers with those it supports too in
+// AuthResp, so features can be added without breaking older peers, which
+// send and receive no capabilities.
+const (
+	// frames after the Auth/AuthResp exchange have a uint32 big-endian
+	// length prefix
+	CapFrame32 = "frame32"
+
+	// messages after the Auth/AuthResp exchange are encoded as CBOR
+	CapCBOR = "cbor"
+
+	// clients answer StartProxy with a ProxyResp, so that the server
+	// answers public requests their local service can't take
+	CapProxyResp = "proxyresp"
+)
+
+// The capabilities this version supports
+var Capabilities = []string{CapFrame32, CapCBOR, CapProxyResp}
+
+func HasCapability(caps []string, capability string) bool {
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// The capabilities in theirs that we support as well
+func NegotiateCapabilities(theirs []string) (caps []string) {
+	for _, c := range Capabilities {
+		if HasCapability(theirs, c) {
+			caps = append(caps, c)
+		}
+	}
+	return
+}
+
 type Message interface{}
 
 type Envelope struct {
@@ -39,6 +81,9 @@ type Auth struct {
 	OS        string
 	Arch      string
 	ClientId  string // empty for new sessions
+
+	// optional features the client supports
+	Capabilities []string
 }
 
 // A server responds to an Auth message with an
@@ -51,11 +96,19 @@ type Auth struct {
 // The server response includes a unique ClientId
 // that is used to associate and authenticate future
 // proxy connections via the same field in RegProxy messages.
+//
+// Capabilities are the ones of the Auth message which the server supports
+// as well. Auth and AuthResp are always sent with the Legacy codec, the
+// following messages on the control channel with the codec of the
+// capabilities. Proxy and connect connections only carry a message or two
+// and always use the Legacy codec.
 type AuthResp struct {
 	Version   string
 	MmVersion string
 	ClientId  string
 	Error     string
+
+	Capabilities []string
 }
 
 // A client sends this message to the server over the control channel
@@ -66,13 +119,33 @@ type ReqTunnel struct {
 	ReqId    string
 	Protocol string
 
-	// http only
+	// the base domain of the tunnel's URL, empty for the default domain
+	// of the auth token. Not for connect tunnels.
+	Domain string
+
+	// http only. Hostname and Subdomain may be wildcards like
+	// *.feature.example.com, and Path a prefix like /api to only serve
+	// the requests under it.
 	Hostname  string
 	Subdomain string
 	HttpAuth  string
+	Path      string
 
-	// tcp only
+	// http only, the label of a pooled tunnel group. The tunnels of one
+	// account asking for the same url and group share it, and public
+	// connections are balanced across them.
+	Group string
+
+	// http only, whether the server keeps the url for a while when the
+	// client's control connection drops, queuing the public requests until
+	// the client reconnects and asks for it again
+	Hold bool
+
+	// tcp and udp only
 	RemotePort uint16
+
+	// connect only, the address on the server's network to connect to
+	RemoteAddr string
 }
 
 // When the server opens a new tunnel on behalf of
@@ -108,6 +181,33 @@ type StartProxy struct {
 	ClientAddr string // Network address of the client initiating the connection to the tunnel
 }
 
+// With the proxyresp capability, a client responds to StartProxy with a
+// ProxyResp once it dialed the local service. If Error is empty, the bytes
+// of the local service's side follow. Otherwise the client closes the
+// connection and the server answers the public request itself.
+type ProxyResp struct {
+	Error string
+}
+
+// For connect tunnels, the direction is reversed: every time a client
+// accepts a connection on its local listener, it opens a new connection
+// to the server and sends a RegConnect message. Like Auth, it carries the
+// client's auth token in User, left empty by clients authenticating with a
+// certificate. The server dials Addr, which must be allowed by the policy
+// of that token or certificate.
+type RegConnect struct {
+	ClientId string
+	User     string
+	Addr     string
+}
+
+// The server responds to a RegConnect with a ConnectResp. If Error is
+// empty, the server has connected to Addr and the bytes of the connection
+// follow.
+type ConnectResp struct {
+	Error string
+}
+
 // A client or server may send this message periodically over
 // the control channel to request that the remote side acknowledge
 // its connection is still alive. The remote side must respond with a Pong.
@@ -0,0 +1,220 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"ngrok/pkg/conn"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A connection which reads from a buffer at most chunk bytes at a time and
+// records what is written to it
+type bufferConn struct {
+	rd    io.Reader
+	chunk int
+	wr    bytes.Buffer
+}
+
+func newBufferConn(data []byte, chunk int) conn.Conn {
+	return conn.Wrap(&bufferConn{rd: bytes.NewReader(data), chunk: chunk}, "test")
+}
+
+func (c *bufferConn) Read(p []byte) (int, error) {
+	if c.chunk > 0 && len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	return c.rd.Read(p)
+}
+
+func (c *bufferConn) Write(p []byte) (int, error)        { return c.wr.Write(p) }
+func (c *bufferConn) Close() error                       { return nil }
+func (c *bufferConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *bufferConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *bufferConn) SetDeadline(t time.Time) error      { return nil }
+func (c *bufferConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *bufferConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// A frame as ngrok clients before capability negotiation write it
+func legacyFrame(payload []byte) []byte {
+	frame := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint64(frame, uint64(len(payload)))
+	return append(frame, payload...)
+}
+
+func legacyMsg(t testing.TB, typ string, payload any) []byte {
+	buf, err := json.Marshal(map[string]any{"Type": typ, "Payload": payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return legacyFrame(buf)
+}
+
+func codecs() []*Codec {
+	return []*Codec{
+		Legacy,
+		CodecFor([]string{CapFrame32}),
+		CodecFor([]string{CapCBOR}),
+		CodecFor(Capabilities),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	messages := []Message{
+		&Auth{Version: "2", User: "token", ClientId: "abc", Capabilities: Capabilities},
+		&AuthResp{ClientId: "abc", Capabilities: []string{CapCBOR}},
+		&ReqTunnel{ReqId: "1", Protocol: "http+https", Subdomain: "foo", RemotePort: 8080},
+		&NewTunnel{ReqId: "1", Url: "http://foo.ngrok.me", Protocol: "http"},
+		&ReqProxy{},
+		&StartProxy{Url: "tcp://ngrok.me:1234", ClientAddr: "1.2.3.4:5678"},
+		&RegConnect{ClientId: "abc", User: "token", Addr: "db:5432"},
+		&Ping{},
+	}
+
+	for _, codec := range codecs() {
+		for _, m := range messages {
+			c := &bufferConn{}
+			if err := codec.WriteMsg(conn.Wrap(c, "test"), m); err != nil {
+				t.Fatalf("%v: failed to write %T: %v", codec, m, err)
+			}
+
+			got, err := codec.ReadMsg(newBufferConn(c.wr.Bytes(), 0))
+			if err != nil {
+				t.Fatalf("%v: failed to read %T: %v", codec, m, err)
+			}
+
+			want, _ := json.Marshal(m)
+			have, _ := json.Marshal(got)
+			if !bytes.Equal(want, have) {
+				t.Fatalf("%v: read %s, wrote %s", codec, have, want)
+			}
+		}
+	}
+}
+
+func TestReadMsgLegacyClient(t *testing.T) {
+	frame := legacyMsg(t, "Auth", map[string]any{"Version": "2", "User": "token", "OS": "linux"})
+
+	m, err := ReadMsg(newBufferConn(frame, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, ok := m.(*Auth)
+	if !ok || auth.User != "token" || auth.Capabilities != nil {
+		t.Fatalf("unexpected message %#v", m)
+	}
+
+	if caps := NegotiateCapabilities(auth.Capabilities); CodecFor(caps).String() != Legacy.String() {
+		t.Fatalf("a client without capabilities must keep the legacy codec, got %v", caps)
+	}
+}
+
+// Regression: a single Read used to return a partial message whenever the
+// frame arrived in several TCP segments
+func TestReadMsgShortReads(t *testing.T) {
+	frame := legacyMsg(t, "ReqTunnel", map[string]any{"ReqId": "1", "Protocol": "http", "Subdomain": strings.Repeat("a", 500)})
+
+	m, err := ReadMsg(newBufferConn(frame, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := m.(*ReqTunnel); len(req.Subdomain) != 500 {
+		t.Fatalf("read truncated subdomain of %d bytes", len(req.Subdomain))
+	}
+}
+
+// Regression: the length prefix used to be allocated before reading, so a
+// peer could make the server allocate exabytes with 8 bytes
+func TestReadMsgOversizeLength(t *testing.T) {
+	for _, sz := range []int64{MaxFrameSize + 1, 1 << 40, -1, 0} {
+		hdr := make([]byte, 8)
+		binary.LittleEndian.PutUint64(hdr, uint64(sz))
+
+		if _, err := ReadMsg(newBufferConn(hdr, 0)); err == nil || !strings.Contains(err.Error(), "Invalid message length") {
+			t.Fatalf("expected an invalid length error for %d, got %v", sz, err)
+		}
+	}
+
+	hdr := []byte{0xff, 0xff, 0xff, 0xff}
+	if _, err := CodecFor(Capabilities).ReadMsg(newBufferConn(hdr, 0)); err == nil {
+		t.Fatal("expected an invalid length error for a frame32 frame")
+	}
+}
+
+func TestWriteMsgTooLarge(t *testing.T) {
+	err := WriteMsg(newBufferConn(nil, 0), &ReqTunnel{HttpAuth: strings.Repeat("a", MaxFrameSize)})
+	if err == nil {
+		t.Fatal("expected an error for a message larger than MaxFrameSize")
+	}
+}
+
+func TestUnpackUnknownType(t *testing.T) {
+	if _, err := Unpack([]byte(`{"Type":"Bogus","Payload":{}}`)); err == nil {
+		t.Fatal("expected an error for an unknown message type")
+	}
+}
+
+func FuzzReadMsg(f *testing.F) {
+	f.Add(legacyMsg(f, "Auth", map[string]any{"Version": "2", "User": "token"}), uint8(0))
+	f.Add(legacyMsg(f, "RegProxy", map[string]any{"ClientId": "abc"}), uint8(1))
+	f.Add(legacyMsg(f, "Ping", map[string]any{}), uint8(3))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, uint8(0))
+
+	for _, codec := range codecs() {
+		c := &bufferConn{}
+		codec.WriteMsg(conn.Wrap(c, "test"), &ReqTunnel{ReqId: "1", Protocol: "tcp", RemotePort: 22})
+		f.Add(c.wr.Bytes(), uint8(2))
+	}
+
+	all := codecs()
+	f.Fuzz(func(t *testing.T, data []byte, which uint8) {
+		codec := all[int(which)%len(all)]
+		m, err := codec.ReadMsg(newBufferConn(data, 7))
+		if err != nil {
+			return
+		}
+
+		// whatever was read must survive a round trip
+		c := &bufferConn{}
+		if err := codec.WriteMsg(conn.Wrap(c, "test"), m); err != nil {
+			t.Fatalf("failed to write back %T: %v", m, err)
+		}
+		if _, err := codec.ReadMsg(newBufferConn(c.wr.Bytes(), 0)); err != nil {
+			t.Fatalf("failed to read back %T: %v", m, err)
+		}
+	})
+}
+
+func FuzzUnpack(f *testing.F) {
+	for typ := range TypeMap {
+		f.Add([]byte(`{"Type":"` + typ + `","Payload":{}}`))
+	}
+	f.Add([]byte(`{"Type":"ReqTunnel","Payload":{"RemotePort":70000}}`))
+	f.Add([]byte(`{"Type":"Auth","Payload":null}`))
+	f.Add([]byte(`{"Type":"Auth","Payload":[1,2,3]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Unpack(data)
+		if err != nil {
+			return
+		}
+
+		if _, ok := TypeMap[typeName(m)]; !ok {
+			t.Fatalf("unpacked a message of unregistered type %T", m)
+		}
+
+		if _, err := Pack(m); err != nil {
+			t.Fatalf("failed to pack unpacked %T: %v", m, err)
+		}
+	})
+}
+
+func typeName(m Message) string {
+	return reflect.TypeOf(m).Elem().Name()
+}
@@ -5,19 +5,63 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
 )
 
-func unpack(buffer []byte, msgIn Message) (msg Message, err error) {
+// How messages are encoded inside a frame. Messages are wrapped in an
+// envelope naming their type, see TypeMap.
+type encoding interface {
+	marshal(env any) ([]byte, error)
+	unmarshalEnvelope(buffer []byte) (typ string, payload []byte, err error)
+	unmarshal(payload []byte, msg Message) error
+}
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) marshal(env any) ([]byte, error) { return json.Marshal(env) }
+
+func (jsonEncoding) unmarshalEnvelope(buffer []byte) (string, []byte, error) {
 	var env Envelope
-	if err = json.Unmarshal(buffer, &env); err != nil {
+	err := json.Unmarshal(buffer, &env)
+	return env.Type, env.Payload, err
+}
+
+func (jsonEncoding) unmarshal(payload []byte, msg Message) error { return json.Unmarshal(payload, msg) }
+
+type cborEncoding struct{}
+
+var cborDecMode, _ = cbor.DecOptions{
+	MaxArrayElements: 4096,
+	MaxMapPairs:      4096,
+}.DecMode()
+
+func (cborEncoding) marshal(env any) ([]byte, error) { return cbor.Marshal(env) }
+
+func (cborEncoding) unmarshalEnvelope(buffer []byte) (string, []byte, error) {
+	var env struct {
+		Type    string
+		Payload cbor.RawMessage
+	}
+	err := cborDecMode.Unmarshal(buffer, &env)
+	return env.Type, env.Payload, err
+}
+
+func (cborEncoding) unmarshal(payload []byte, msg Message) error {
+	return cborDecMode.Unmarshal(payload, msg)
+}
+
+func unpack(enc encoding, buffer []byte, msgIn Message) (msg Message, err error) {
+	typ, payload, err := enc.unmarshalEnvelope(buffer)
+	if err != nil {
 		return
 	}
 
 	if msgIn == nil {
-		t, ok := TypeMap[env.Type]
+		t, ok := TypeMap[typ]
 
 		if !ok {
-			err = errors.New(fmt.Sprintf("Unsupported message type %s", env.Type))
+			err = errors.New(fmt.Sprintf("Unsupported message type %s", typ))
 			return
 		}
 
@@ -27,25 +71,29 @@ func unpack(buffer []byte, msgIn Message) (msg Message, err error) {
 		msg = msgIn
 	}
 
-	err = json.Unmarshal(env.Payload, &msg)
+	err = enc.unmarshal(payload, msg)
 	return
 }
 
+func pack(enc encoding, payload interface{}) ([]byte, error) {
+	return enc.marshal(struct {
+		Type    string
+		Payload interface{}
+	}{
+		Type:    reflect.TypeOf(payload).Elem().Name(),
+		Payload: payload,
+	})
+}
+
 func UnpackInto(buffer []byte, msg Message) (err error) {
-	_, err = unpack(buffer, msg)
+	_, err = unpack(jsonEncoding{}, buffer, msg)
 	return
 }
 
 func Unpack(buffer []byte) (msg Message, err error) {
-	return unpack(buffer, nil)
+	return unpack(jsonEncoding{}, buffer, nil)
 }
 
 func Pack(payload interface{}) ([]byte, error) {
-	return json.Marshal(struct {
-		Type    string
-		Payload interface{}
-	}{
-		Type:    reflect.TypeOf(payload).Elem().Name(),
-		Payload: payload,
-	})
+	return pack(jsonEncoding{}, payload)
 }
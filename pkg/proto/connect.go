@@ -0,0 +1,19 @@
+package proto
+
+import (
+	"ngrok/pkg/conn"
+)
+
+// Connect tunnels carry connections from the client's machine to an
+// address on the server's network
+type Connect struct{}
+
+func NewConnect() *Connect {
+	return new(Connect)
+}
+
+func (h *Connect) GetName() string { return "connect" }
+
+func (h *Connect) WrapConn(c conn.Conn, ctx interface{}) conn.Conn {
+	return c
+}
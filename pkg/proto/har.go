@@ -0,0 +1,289 @@
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"ngrok/pkg/version"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Types for the HTTP Archive (HAR) 1.2 format, used to export captured
+// transactions and to import requests for replay.
+// See http://www.softwareishard.com/blog/har-12-spec/
+type Har struct {
+	Log HarLog `json:"log"`
+}
+
+type HarLog struct {
+	Version string     `json:"version"`
+	Creator HarCreator `json:"creator"`
+	Entries []HarEntry `json:"entries"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HarRequest  `json:"request"`
+	Response        HarResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HarTimings  `json:"timings"`
+
+	// custom field, the address of the client that made the request
+	ClientAddr string `json:"_clientAddr,omitempty"`
+}
+
+type HarRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarCookie    `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	QueryString []HarNameValue `json:"queryString"`
+	PostData    *HarPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarCookie    `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	Content     HarContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []HarNameValue `json:"params"`
+	Text     string         `json:"text"`
+
+	// custom field, set to "base64" when Text holds a binary body
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type HarContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// ngrok only observes the total round trip of a transaction, so
+// everything is accounted for as wait time
+type HarTimings struct {
+	Blocked float64 `json:"blocked"`
+	Dns     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	Ssl     float64 `json:"ssl"`
+}
+
+func NewHar() *Har {
+	return &Har{
+		Log: HarLog{
+			Version: "1.2",
+			Creator: HarCreator{Name: "ngrok", Version: version.MajorMinor()},
+			Entries: make([]HarEntry, 0),
+		},
+	}
+}
+
+// Converts a captured transaction into a HAR entry. scheme is the scheme
+// the request was made with on the public side of the tunnel.
+func NewHarEntry(txn *HttpTxn, scheme, clientAddr string) HarEntry {
+	req := txn.Req
+	reqUrl := *req.URL
+	reqUrl.Scheme = scheme
+	reqUrl.Host = req.Host
+
+	ms := float64(txn.Duration) / float64(time.Millisecond)
+	e := HarEntry{
+		StartedDateTime: txn.Start.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            ms,
+		Request: HarRequest{
+			Method:      req.Method,
+			Url:         reqUrl.String(),
+			HttpVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: harValues(req.URL.Query()),
+			HeadersSize: -1,
+			BodySize:    len(req.BodyBytes),
+		},
+		Timings:    HarTimings{Blocked: -1, Dns: -1, Connect: -1, Ssl: -1, Wait: ms},
+		ClientAddr: clientAddr,
+	}
+
+	if len(req.BodyBytes) > 0 {
+		text, encoding := harText(req.BodyBytes)
+		e.Request.PostData = &HarPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Params:   make([]HarNameValue, 0),
+			Text:     text,
+			Encoding: encoding,
+		}
+		if form, err := url.ParseQuery(string(req.BodyBytes)); err == nil && strings.HasPrefix(e.Request.PostData.MimeType, "application/x-www-form-urlencoded") {
+			e.Request.PostData.Params = harValues(form)
+		}
+	}
+
+	if resp := txn.Resp; resp != nil {
+		body := decodeBody(resp.Header.Get("Content-Encoding"), resp.BodyBytes)
+		text, encoding := harText(body)
+		e.Response = HarResponse{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+			HttpVersion: resp.Proto,
+			Cookies:     harCookies(resp.Cookies()),
+			Headers:     harHeaders(resp.Header),
+			Content: HarContent{
+				Size:     len(body),
+				MimeType: resp.Header.Get("Content-Type"),
+				Text:     text,
+				Encoding: encoding,
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(resp.BodyBytes),
+		}
+	} else {
+		// the response never arrived, HAR represents this with status 0
+		e.Response = HarResponse{
+			Cookies:     make([]HarCookie, 0),
+			Headers:     make([]HarNameValue, 0),
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	}
+
+	return e
+}
+
+// Builds the raw bytes of the request described by a HAR entry, suitable
+// for replaying over a tunnel
+func (e *HarEntry) RawRequest() ([]byte, error) {
+	var body []byte
+	if pd := e.Request.PostData; pd != nil {
+		if pd.Encoding == "base64" {
+			var err error
+			if body, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+				return nil, err
+			}
+		} else if pd.Text == "" && len(pd.Params) > 0 {
+			form := make(url.Values)
+			for _, p := range pd.Params {
+				form.Add(p.Name, p.Value)
+			}
+			body = []byte(form.Encode())
+		} else {
+			body = []byte(pd.Text)
+		}
+	}
+
+	req, err := http.NewRequest(e.Request.Method, e.Request.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range e.Request.Headers {
+		// HTTP/2 pseudo headers (e.g. from browser exports) can't be replayed
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Host":
+			req.Host = h.Value
+		case "Content-Length", "Transfer-Encoding":
+		default:
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+
+	return DumpRequestOut(req, true)
+}
+
+func harHeaders(h http.Header) []HarNameValue {
+	nvs := make([]HarNameValue, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			nvs = append(nvs, HarNameValue{Name: name, Value: v})
+		}
+	}
+	return nvs
+}
+
+func harValues(vals url.Values) []HarNameValue {
+	return harHeaders(http.Header(vals))
+}
+
+func harCookies(cookies []*http.Cookie) []HarCookie {
+	hcs := make([]HarCookie, 0, len(cookies))
+	for _, c := range cookies {
+		hcs = append(hcs, HarCookie{Name: c.Name, Value: c.Value})
+	}
+	return hcs
+}
+
+// HAR text fields must be strings, so binary bodies are base64 encoded
+func harText(body []byte) (text string, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// Undoes a response's Content-Encoding, returning the body unchanged if
+// the encoding is unknown or the body fails to decode
+func decodeBody(contentEncoding string, body []byte) []byte {
+	var (
+		rd  io.Reader
+		err error
+	)
+
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		if rd, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+			return body
+		}
+	case "deflate":
+		rd = flate.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+
+	decoded, err := io.ReadAll(rd)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
@@ -0,0 +1,229 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A transaction captured from raw request and response bytes, resp may be
+// empty for a transaction that never got a response
+func captureTxn(t *testing.T, req string, resp []byte) *HttpTxn {
+	t.Helper()
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(req)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn := &HttpTxn{
+		Req:      &HttpRequest{Request: r},
+		Start:    time.Date(2014, 6, 6, 12, 30, 0, 0, time.UTC),
+		Duration: 1500 * time.Microsecond,
+	}
+	if txn.Req.BodyBytes, txn.Req.Body, err = extractBody(r.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp != nil {
+		rs, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.Resp = &HttpResponse{Response: rs}
+		if txn.Resp.BodyBytes, txn.Resp.Body, err = extractBody(rs.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return txn
+}
+
+func gzipped(s string) string {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(s))
+	w.Close()
+	return b.String()
+}
+
+// Decodes the JSON of entry into a generic map, so that the test checks the
+// field names HAR readers see
+func harJSON(t *testing.T, entry HarEntry) map[string]interface{} {
+	t.Helper()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Looks up a value by a path of object keys in decoded JSON
+func jsonPath(m map[string]interface{}, path ...string) interface{} {
+	var v interface{} = m
+	for _, key := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[key]
+	}
+	return v
+}
+
+func nameValue(list interface{}, name string) interface{} {
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		nv := item.(map[string]interface{})
+		if nv["name"] == name {
+			return nv["value"]
+		}
+	}
+	return nil
+}
+
+func TestNewHarEntry(t *testing.T) {
+	binary := string([]byte{0x08, 0x96, 0x01, 0xff, 0xfe})
+	gzipBody := gzipped("hello")
+
+	tests := []struct {
+		name   string
+		req    string
+		resp   string
+		noResp bool
+
+		// expected values by JSON path, and headers or query parameters
+		// by name
+		fields  map[string]interface{}
+		headers map[string]string
+		query   map[string]string
+	}{
+		{
+			name: "text body with query",
+			req: "POST /submit?a=1&b=two HTTP/1.1\r\nHost: foo.example.com\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+				"Cookie: session=abc\r\nContent-Length: 7\r\n\r\nx=1&y=2",
+			resp: "HTTP/1.1 302 Found\r\nLocation: /done\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nok",
+			fields: map[string]interface{}{
+				"startedDateTime":           "2014-06-06T12:30:00.000Z",
+				"time":                      1.5,
+				"timings.wait":              1.5,
+				"timings.dns":               -1.0,
+				"request.method":            "POST",
+				"request.url":               "https://foo.example.com/submit?a=1&b=two",
+				"request.httpVersion":       "HTTP/1.1",
+				"request.bodySize":          7.0,
+				"request.postData.mimeType": "application/x-www-form-urlencoded",
+				"request.postData.text":     "x=1&y=2",
+				"response.status":           302.0,
+				"response.statusText":       "Found",
+				"response.redirectURL":      "/done",
+				"response.content.text":     "ok",
+				"response.content.size":     2.0,
+				"_clientAddr":               "192.0.2.1:56324",
+			},
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Cookie": "session=abc"},
+			query:   map[string]string{"a": "1", "b": "two"},
+		},
+		{
+			name: "binary body",
+			req:  "PUT /blob HTTP/1.1\r\nHost: foo.example.com\r\nContent-Type: application/x-protobuf\r\nContent-Length: 5\r\n\r\n" + binary,
+			resp: "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: 5\r\n\r\n" + binary,
+			fields: map[string]interface{}{
+				"request.bodySize":           5.0,
+				"request.postData.text":      base64.StdEncoding.EncodeToString([]byte(binary)),
+				"request.postData._encoding": "base64",
+				"response.content.text":      base64.StdEncoding.EncodeToString([]byte(binary)),
+				"response.content.encoding":  "base64",
+			},
+		},
+		{
+			name: "compressed response",
+			req:  "GET / HTTP/1.1\r\nHost: foo.example.com\r\n\r\n",
+			resp: "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(len(gzipBody)) + "\r\n\r\n" + gzipBody,
+			fields: map[string]interface{}{
+				"request.postData":      nil,
+				"response.content.text": "hello",
+				"response.content.size": 5.0,
+				"response.bodySize":     float64(len(gzipBody)),
+			},
+		},
+		{
+			name:   "no response",
+			req:    "GET / HTTP/1.1\r\nHost: foo.example.com\r\n\r\n",
+			noResp: true,
+			fields: map[string]interface{}{
+				"response.status":   0.0,
+				"response.bodySize": -1.0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp []byte
+			if !tt.noResp {
+				resp = []byte(tt.resp)
+			}
+			entry := harJSON(t, NewHarEntry(captureTxn(t, tt.req, resp), "https", "192.0.2.1:56324"))
+
+			for path, expected := range tt.fields {
+				if got := jsonPath(entry, strings.Split(path, ".")...); got != expected {
+					t.Errorf("%s is %#v, expected %#v", path, got, expected)
+				}
+			}
+
+			for name, expected := range tt.headers {
+				got := nameValue(jsonPath(entry, "request", "headers"), name)
+				if got != expected {
+					t.Errorf("header %s is %#v, expected %q", name, got, expected)
+				}
+			}
+
+			for name, expected := range tt.query {
+				if got := nameValue(jsonPath(entry, "request", "queryString"), name); got != expected {
+					t.Errorf("query parameter %s is %#v, expected %q", name, got, expected)
+				}
+			}
+		})
+	}
+}
+
+// Exported entries replay as the request that was captured
+func TestHarEntryRawRequest(t *testing.T) {
+	binary := string([]byte{0x08, 0x96, 0x01, 0xff, 0xfe})
+	txn := captureTxn(t, "PUT /blob?x=1 HTTP/1.1\r\nHost: foo.example.com\r\nX-Test: yes\r\nContent-Length: 5\r\n\r\n"+binary, nil)
+
+	// through JSON, like an exported file
+	b, err := json.Marshal(NewHarEntry(txn, "http", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry HarEntry
+	if err = json.Unmarshal(b, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := entry.RawRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, _ := extractBody(req.Body)
+
+	if req.Method != "PUT" || req.Host != "foo.example.com" || req.URL.RequestURI() != "/blob?x=1" ||
+		req.Header.Get("X-Test") != "yes" || string(body) != binary {
+		t.Fatalf("replayed %s %s %s %v %q", req.Method, req.Host, req.URL.RequestURI(), req.Header, body)
+	}
+}
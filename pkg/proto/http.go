@@ -11,7 +11,6 @@ import (
 	"ngrok/pkg/conn"
 	"ngrok/pkg/util"
 	"strings"
-	"sync"
 	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
@@ -34,6 +33,9 @@ type HttpTxn struct {
 	Duration    time.Duration
 	UserCtx     interface{}
 	ConnUserCtx interface{}
+
+	// set instead of Resp if the connection ended without a response
+	RespErr error
 }
 
 type Http struct {
@@ -69,7 +71,13 @@ func (h *Http) WrapConn(c conn.Conn, ctx interface{}) conn.Conn {
 }
 
 func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interface{}) {
-	defer close(lastTxn)
+	defer func() {
+		close(lastTxn)
+
+		// keep consuming the copy of the requests after the last one we
+		// could parse, otherwise we block the writer
+		io.Copy(io.Discard, tee.WriteBuffer())
+	}()
 
 	for {
 		req, err := http.ReadRequest(tee.WriteBuffer())
@@ -100,8 +108,14 @@ func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interf
 			}
 		}
 
-		lastTxn <- txn
+		// announce the request before its response or failure
 		h.Txns.In() <- txn
+		lastTxn <- txn
+
+		// what follows a websocket upgrade are frames, not requests
+		if req.Header.Get("Upgrade") == "websocket" {
+			break
+		}
 	}
 }
 
@@ -112,6 +126,9 @@ func (h *Http) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
 		h.reqTimer.Update(txn.Duration)
 		if err != nil {
 			tee.Warn("Error reading response from server: %v", err)
+			txn.RespErr = err
+			h.Txns.In() <- txn
+
 			// no more responses to be read, we're done
 			break
 		}
@@ -133,27 +150,18 @@ func (h *Http) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
 		// XXX: remove web socket shim in favor of a real websocket protocol analyzer
 		if txn.Req.Header.Get("Upgrade") == "websocket" {
 			tee.Info("Upgrading to websocket")
-			var wg sync.WaitGroup
-
-			// shim for websockets
-			// in order for websockets to work, we need to continue reading all of the
-			// the bytes in the analyzer so that the joined connections will continue
-			// sending bytes to each other
-			wg.Add(2)
-			go func() {
-				io.ReadAll(tee.WriteBuffer())
-				wg.Done()
-			}()
-
-			go func() {
-				io.ReadAll(tee.ReadBuffer())
-				wg.Done()
-			}()
-
-			wg.Wait()
 			break
 		}
 	}
+
+	// keep consuming the copy of the responses, and the requests we won't
+	// read responses for, so that the joined connections continue sending
+	// bytes to each other
+	go func() {
+		for range lastTxn {
+		}
+	}()
+	io.Copy(io.Discard, tee.ReadBuffer())
 }
 
 // we have to vendor DumpRequestOut because it's broken and the fix won't be in until at least 1.4
@@ -0,0 +1,198 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"ngrok/pkg/conn"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wraps one end of a pipe like the client wraps its proxy connections.
+// Whatever is written through the returned connection is discarded at the
+// other end, which is returned to write responses into.
+func wrapPipe(h *Http) (conn.Conn, net.Conn) {
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	return h.WrapConn(conn.Wrap(local, "test"), nil), remote
+}
+
+func nextTxn(t *testing.T, txns chan interface{}) *HttpTxn {
+	t.Helper()
+	select {
+	case txn := <-txns:
+		return txn.(*HttpTxn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a transaction")
+		return nil
+	}
+}
+
+func writeWithin(t *testing.T, c io.Writer, data []byte) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write(data)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked on the inspector")
+	}
+}
+
+const okResponse = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+
+// Answers every request, so that the inspector never waits on a response
+func answerRequests(c conn.Conn, remote net.Conn) {
+	go io.Copy(io.Discard, c)
+	go func() {
+		for {
+			if _, err := remote.Write([]byte(okResponse)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Regression: every request used to be read with a fresh bufio.Reader, which
+// lost the pipelined requests the previous one had buffered
+func TestReadPipelinedRequests(t *testing.T) {
+	h := NewHttp()
+	txns := h.Txns.Reg()
+	c, remote := wrapPipe(h)
+	defer c.Close()
+
+	answerRequests(c, remote)
+	writeWithin(t, c, []byte("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\nPOST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\nabc"))
+
+	// each transaction is broadcast when its request and again when its
+	// response was read
+	seen := make(map[*HttpTxn]bool)
+	var paths []string
+	for len(paths) < 2 {
+		if txn := nextTxn(t, txns); !seen[txn] {
+			seen[txn] = true
+			paths = append(paths, txn.Req.URL.Path+" "+string(txn.Req.BodyBytes))
+		}
+	}
+
+	if paths[0] != "/a " || paths[1] != "/b abc" {
+		t.Fatalf("expected /a and /b with body abc, got %q", paths)
+	}
+}
+
+// Regression: once a request failed to parse, nothing consumed the copy of
+// the stream anymore and the connection hung
+func TestMalformedRequestDoesNotBlock(t *testing.T) {
+	h := NewHttp()
+	c, _ := wrapPipe(h)
+	defer c.Close()
+
+	writeWithin(t, c, []byte("NOT HTTP\r\n\r\n"))
+	writeWithin(t, c, bytes.Repeat([]byte("x"), 1<<20))
+}
+
+// Regression: once a response failed to parse, requests pipelined behind it
+// blocked forever
+func TestMalformedResponseDoesNotBlock(t *testing.T) {
+	h := NewHttp()
+	txns := h.Txns.Reg()
+	c, remote := wrapPipe(h)
+	defer c.Close()
+
+	go func() {
+		for range txns {
+		}
+	}()
+
+	writeWithin(t, c, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	go remote.Write([]byte("NOT HTTP\r\n\r\n" + strings.Repeat("x", 1<<20)))
+
+	buf := make([]byte, 1<<20)
+	if _, err := io.ReadAtLeast(c, buf, len(buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		writeWithin(t, c, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}
+}
+
+// A request whose connection closes without a response is broadcast again
+// with the error, e.g. for the rules that drop connections
+func TestMissingResponseIsBroadcast(t *testing.T) {
+	h := NewHttp()
+	txns := h.Txns.Reg()
+	c, remote := wrapPipe(h)
+	defer c.Close()
+
+	writeWithin(t, c, []byte("GET /dropped HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	req := nextTxn(t, txns)
+	if req.Resp != nil || req.RespErr != nil {
+		t.Fatalf("request broadcast with response %v, error %v", req.Resp, req.RespErr)
+	}
+
+	// the connection ends as soon as the agent reads from it
+	remote.Close()
+	go io.Copy(io.Discard, c)
+	if txn := nextTxn(t, txns); txn != req || txn.Resp != nil || txn.RespErr == nil {
+		t.Fatalf("expected the request again without a response, got %+v", txn)
+	}
+}
+
+func TestWebsocketUpgradeDoesNotBlock(t *testing.T) {
+	h := NewHttp()
+	txns := h.Txns.Reg()
+	c, remote := wrapPipe(h)
+	defer c.Close()
+
+	go func() {
+		for range txns {
+		}
+	}()
+
+	writeWithin(t, c, []byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	go remote.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+	buf := make([]byte, 4096)
+	if _, err := c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	writeWithin(t, c, bytes.Repeat([]byte{0x81, 0x7f}, 1<<18))
+}
+
+func FuzzReadRequests(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	f.Add([]byte("POST /a?b=c HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"))
+	f.Add([]byte("POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\nGET / HTTP/1.1\r\nHost: b\r\n\r\n"))
+	f.Add([]byte("GET /ws HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\n\r\n\x81\x05hello"))
+	f.Add([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"))
+
+	h := NewHttp()
+	txns := h.Txns.Reg()
+	go func() {
+		for range txns {
+		}
+	}()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c, remote := wrapPipe(h)
+		defer c.Close()
+
+		answerRequests(c, remote)
+
+		// whatever the client sends, the inspector must not block it
+		writeWithin(t, c, data)
+		writeWithin(t, c, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	})
+}
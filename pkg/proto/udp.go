@@ -0,0 +1,18 @@
+package proto
+
+import (
+	"ngrok/pkg/conn"
+)
+
+// Datagrams arrive framed over the proxy connection, see conn.DialUDP
+type Udp struct{}
+
+func NewUdp() *Udp {
+	return new(Udp)
+}
+
+func (h *Udp) GetName() string { return "udp" }
+
+func (h *Udp) WrapConn(c conn.Conn, ctx interface{}) conn.Conn {
+	return c
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"ngrok/pkg/server/auth"
+	log "ngrok/pkg/server/log"
+	"os"
+	"time"
+)
+
+// Limits of the admin, health and metrics listeners. They only serve small
+// requests, so a slow or idle client must not hold on to a connection.
+const (
+	opsReadHeaderTimeout = 10 * time.Second
+	opsReadTimeout       = 30 * time.Second
+	opsWriteTimeout      = 30 * time.Second
+	opsIdleTimeout       = 120 * time.Second
+	opsMaxHeaderBytes    = 64 * 1024
+	opsShutdownTimeout   = 10 * time.Second
+)
+
+func newOpsServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: opsReadHeaderTimeout,
+		ReadTimeout:       opsReadTimeout,
+		WriteTimeout:      opsWriteTimeout,
+		IdleTimeout:       opsIdleTimeout,
+		MaxHeaderBytes:    opsMaxHeaderBytes,
+	}
+}
+
+// Serves srv in the background, over TLS if it has a TLS config. ngrokd
+// exits if the listener can't be started, e.g. because its address is in use.
+func serveOps(name string, srv *http.Server) {
+	go func() {
+		log.Info("Starting %s endpoint on %s", name, srv.Addr)
+
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Failed to start %s endpoint: %v", name, err)
+			os.Exit(1)
+		}
+	}()
+}
+
+func adminHandler(handler *auth.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler.HomePage)
+	mux.HandleFunc("/keys", handler.GetAPIKeys)
+	mux.HandleFunc("/add", handler.AddAPIKey)
+	mux.HandleFunc("/del", handler.RemoveAPIKey)
+	mux.HandleFunc("/certs", handler.GetClientCerts)
+	mux.HandleFunc("/certs/issue", handler.IssueClientCert)
+	mux.HandleFunc("/certs/revoke", handler.RevokeClientCert)
+	mux.HandleFunc("/ca.crt", handler.GetCACert)
+	mux.HandleFunc("/ca.crl", handler.GetCRL)
+	mux.HandleFunc("/routes", getRoutes)
+	mux.HandleFunc("/static/", handler.ServeStaticFiles)
+	return mux
+}
+
+// The route table of the public http(s) listeners, as JSON
+func getRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"routes": tunnelRegistry.Routes()})
+}
@@ -15,15 +15,23 @@ const (
 	apiKeySize = 32
 )
 
-func CreateAuthToken(ctx context.Context, dbConn *gorm.DB, desc string) error {
+// Creates a token with the connect policy connectAllow and the domain policy
+// domains, which the caller checked with CheckDomainPolicy
+func CreateAuthToken(ctx context.Context, dbConn *gorm.DB, desc string, connectAllow string, domains string) error {
+	if _, err := ParseConnectPolicy(connectAllow); err != nil {
+		return err
+	}
+
 	authToken, err := util.SecureRandId(apiKeySize)
 	if err != nil {
 		return err
 	}
 
 	accessKey := db.AuthToken{
-		AuthToken:   authToken,
-		Description: desc,
+		AuthToken:    authToken,
+		Description:  desc,
+		ConnectAllow: connectAllow,
+		Domains:      domains,
 	}
 	if err := dbConn.WithContext(ctx).Create(&accessKey).Error; err != nil {
 		log.Error("CreateAuthToken: Failed to insert token: %v", err)
@@ -82,6 +90,25 @@ func DeleteAuthToken(ctx context.Context, dbConn *gorm.DB, id string) error {
 	return nil
 }
 
+// Returns the connect policy of a token, an unknown token has an empty
+// policy which allows nothing
+func GetConnectPolicy(ctx context.Context, dbConn *gorm.DB, token string) (ConnectPolicy, error) {
+	found, err := GetAuthToken(ctx, dbConn, token)
+	if err != nil {
+		return nil, fmt.Errorf("GetConnectPolicy: provided token key is invalid")
+	}
+	return ParseConnectPolicy(found.ConnectAllow)
+}
+
+// Returns the domain policy of a token, see GetConnectPolicy
+func GetDomainPolicy(ctx context.Context, dbConn *gorm.DB, token string) (DomainPolicy, error) {
+	found, err := GetAuthToken(ctx, dbConn, token)
+	if err != nil {
+		return nil, fmt.Errorf("GetDomainPolicy: provided token key is invalid")
+	}
+	return ParseDomainPolicy(found.Domains)
+}
+
 func ValidateAuthToken(ctx context.Context, db *gorm.DB, token string) error {
 	found, err := GetAuthToken(ctx, db, token)
 	if err != nil {
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"ngrok/pkg/server/db"
+	"ngrok/pkg/server/log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+
+	// agent certificates are meant to be short-lived, e.g. issued for a
+	// single CI run
+	DefaultClientCertValidity = 24 * time.Hour
+	MaxClientCertValidity     = 90 * 24 * time.Hour
+
+	crlValidity = 24 * time.Hour
+)
+
+// The built-in CA which issues agent certificates. It is created on first
+// start and kept in the database, so every ngrokd sharing the database
+// trusts the same agents.
+type CertAuthority struct {
+	Cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func LoadCA(ctx context.Context, dbConn *gorm.DB) (*CertAuthority, error) {
+	var found db.CertAuthority
+	result := dbConn.WithContext(ctx).Order("created_at ASC").Limit(1).Find(&found)
+	if result.Error != nil {
+		return nil, fmt.Errorf("LoadCA: could not load CA: %w", result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		var err error
+		if found, err = createCA(ctx, dbConn); err != nil {
+			return nil, err
+		}
+	}
+
+	certBlock, _ := pem.Decode([]byte(found.CertPEM))
+	keyBlock, _ := pem.Decode([]byte(found.KeyPEM))
+	if certBlock == nil || keyBlock == nil {
+		return nil, errors.New("LoadCA: stored CA is not valid PEM")
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCA: could not parse CA certificate: %w", err)
+	}
+
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCA: could not parse CA key: %w", err)
+	}
+
+	return &CertAuthority{Cert: cert, key: key, pem: []byte(found.CertPEM)}, nil
+}
+
+func createCA(ctx context.Context, dbConn *gorm.DB) (db.CertAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return db.CertAuthority{}, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return db.CertAuthority{}, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ngrokd agent CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return db.CertAuthority{}, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return db.CertAuthority{}, err
+	}
+
+	ca := db.CertAuthority{
+		CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+	}
+	if err := dbConn.WithContext(ctx).Create(&ca).Error; err != nil {
+		return db.CertAuthority{}, fmt.Errorf("createCA: could not insert CA: %w", err)
+	}
+
+	log.Info("Created agent CA %x", serial)
+	return ca, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func serialString(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+// The CA certificate in PEM format, for agents' and operators' reference
+func (ca *CertAuthority) PEM() []byte {
+	return ca.pem
+}
+
+func (ca *CertAuthority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// An issued certificate and its private key in PEM format
+type IssuedCert struct {
+	ID      string    `json:"id"`
+	Serial  string    `json:"serial"`
+	Name    string    `json:"name"`
+	Cert    string    `json:"cert"`
+	Key     string    `json:"key"`
+	CA      string    `json:"ca"`
+	Expires time.Time `json:"expires"`
+}
+
+// Issues an agent certificate for the identity name. The agent
+// authenticates as name, may reach what connectAllow allows and open
+// tunnels on the domains of the domain policy domains, which the caller
+// checked with CheckDomainPolicy.
+func (ca *CertAuthority) Issue(ctx context.Context, dbConn *gorm.DB, name, desc, connectAllow, domains string, validity time.Duration) (IssuedCert, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return IssuedCert{}, errors.New("Certificate name cannot be empty")
+	}
+
+	if validity < time.Hour || validity > MaxClientCertValidity {
+		return IssuedCert{}, fmt.Errorf("Certificate validity must be between 1 hour and %d days", int(MaxClientCertValidity.Hours()/24))
+	}
+
+	if _, err := ParseConnectPolicy(connectAllow); err != nil {
+		return IssuedCert{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return IssuedCert{}, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return IssuedCert{}, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return IssuedCert{}, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return IssuedCert{}, err
+	}
+
+	record := db.ClientCert{
+		Serial:       serialString(serial),
+		Name:         name,
+		Description:  desc,
+		ConnectAllow: connectAllow,
+		Domains:      domains,
+		NotAfter:     tmpl.NotAfter,
+	}
+	if err := dbConn.WithContext(ctx).Create(&record).Error; err != nil {
+		log.Error("Issue: Failed to insert certificate: %v", err)
+		return IssuedCert{}, fmt.Errorf("Issue: could not insert certificate: %w", err)
+	}
+
+	log.Info("Issued agent certificate %s for %s, expires %v", record.Serial, name, record.NotAfter)
+	return IssuedCert{
+		ID:      record.ID,
+		Serial:  record.Serial,
+		Name:    name,
+		Cert:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:     string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+		CA:      string(ca.pem),
+		Expires: record.NotAfter,
+	}, nil
+}
+
+func ListClientCerts(ctx context.Context, dbConn *gorm.DB) ([]db.ClientCert, error) {
+	var certs []db.ClientCert
+	if err := dbConn.WithContext(ctx).Order("created_at DESC").Find(&certs).Error; err != nil {
+		log.Error("ListClientCerts: Failed to list certificates: %v", err)
+		return nil, fmt.Errorf("ListClientCerts: could not list certificates: %w", err)
+	}
+	return certs, nil
+}
+
+func RevokeClientCert(ctx context.Context, dbConn *gorm.DB, id string) error {
+	if id == "" {
+		return errors.New("RevokeClientCert: id cannot be empty")
+	}
+
+	result := dbConn.WithContext(ctx).Model(&db.ClientCert{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		log.Error("RevokeClientCert: Failed to revoke certificate: %v", result.Error)
+		return fmt.Errorf("RevokeClientCert: could not revoke certificate: %w", result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("RevokeClientCert: no unrevoked certificate with id: %s", id)
+	}
+	log.Info("RevokeClientCert: Successfully revoked certificate id %s", id)
+
+	return nil
+}
+
+// Looks up the record of an agent certificate which the TLS handshake
+// already verified against the CA. Like an OCSP responder, the database is
+// asked on every connection, so revocations take effect immediately.
+func CheckClientCert(ctx context.Context, dbConn *gorm.DB, cert *x509.Certificate) (db.ClientCert, error) {
+	var found db.ClientCert
+	err := dbConn.WithContext(ctx).Where("serial = ?", serialString(cert.SerialNumber)).First(&found).Error
+	if err != nil {
+		return db.ClientCert{}, fmt.Errorf("Unknown client certificate %s", serialString(cert.SerialNumber))
+	}
+
+	if found.RevokedAt != nil {
+		return db.ClientCert{}, fmt.Errorf("Client certificate %s was revoked", found.Serial)
+	}
+
+	if time.Now().After(found.NotAfter) {
+		return db.ClientCert{}, fmt.Errorf("Client certificate %s expired", found.Serial)
+	}
+
+	if cert.Subject.CommonName != found.Name {
+		return db.ClientCert{}, fmt.Errorf("Client certificate %s was not issued to %s", found.Serial, cert.Subject.CommonName)
+	}
+
+	return found, nil
+}
+
+// A CRL of the revoked certificates which have not expired yet, for
+// verifiers which don't ask ngrokd about every connection
+func (ca *CertAuthority) CRL(ctx context.Context, dbConn *gorm.DB) ([]byte, error) {
+	var revoked []db.ClientCert
+	err := dbConn.WithContext(ctx).Where("revoked_at IS NOT NULL AND not_after > ?", time.Now()).Find(&revoked).Error
+	if err != nil {
+		return nil, fmt.Errorf("CRL: could not list revoked certificates: %w", err)
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, r := range revoked {
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: *r.RevokedAt})
+	}
+
+	now := time.Now()
+	tmpl := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+	}
+	return x509.CreateRevocationList(rand.Reader, tmpl, ca.Cert, ca.key)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"ngrok/pkg/server/db"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dbConn, err := db.GetDB(&db.Database{Type: "sqlite", File: filepath.Join(t.TempDir(), "ngrokd.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(dbConn); err != nil {
+		t.Fatal(err)
+	}
+	return dbConn
+}
+
+func testCA(t *testing.T) (*CertAuthority, *gorm.DB) {
+	t.Helper()
+	dbConn := testDB(t)
+	ca, err := LoadCA(context.Background(), dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, dbConn
+}
+
+func issue(t *testing.T, ca *CertAuthority, dbConn *gorm.DB, name string) (IssuedCert, *x509.Certificate) {
+	t.Helper()
+	issued, err := ca.Issue(context.Background(), dbConn, name, "test", "db.internal:5432", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(issued.Cert))
+	if block == nil {
+		t.Fatalf("issued certificate is not PEM: %q", issued.Cert)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issued, cert
+}
+
+// Verifies cert like the TLS handshake of an agent connection does
+func verify(ca *CertAuthority, cert *x509.Certificate, at time.Time) error {
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:       ca.Pool(),
+		CurrentTime: at,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+func revokedSerials(t *testing.T, ca *CertAuthority, dbConn *gorm.DB) map[string]bool {
+	t.Helper()
+	der, err := ca.CRL(context.Background(), dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crl.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Fatalf("CRL not signed by the CA: %v", err)
+	}
+
+	serials := make(map[string]bool)
+	for _, entry := range crl.RevokedCertificateEntries {
+		serials[serialString(entry.SerialNumber)] = true
+	}
+	return serials
+}
+
+func TestLoadCA(t *testing.T) {
+	ca, dbConn := testCA(t)
+
+	// every ngrokd sharing the database loads the same CA
+	again, err := LoadCA(context.Background(), dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Cert.Equal(ca.Cert) {
+		t.Fatal("loaded another CA than the one created")
+	}
+	if !ca.Cert.IsCA || ca.Cert.Subject.CommonName != "ngrokd agent CA" {
+		t.Fatalf("CA certificate %+v", ca.Cert.Subject)
+	}
+}
+
+func TestClientCertAccepted(t *testing.T) {
+	ca, dbConn := testCA(t)
+	issued, cert := issue(t, ca, dbConn, "ci-runner")
+
+	if err := verify(ca, cert, time.Now()); err != nil {
+		t.Fatalf("issued certificate doesn't verify: %v", err)
+	}
+	if issued.CA != string(ca.PEM()) || issued.Serial != serialString(cert.SerialNumber) {
+		t.Fatalf("issued %+v", issued)
+	}
+
+	found, err := CheckClientCert(context.Background(), dbConn, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "ci-runner" || found.ConnectAllow != "db.internal:5432" {
+		t.Fatalf("found %+v", found)
+	}
+}
+
+func TestClientCertRevoked(t *testing.T) {
+	ca, dbConn := testCA(t)
+	issued, cert := issue(t, ca, dbConn, "ci-runner")
+	_, other := issue(t, ca, dbConn, "other")
+
+	if revokedSerials(t, ca, dbConn)[issued.Serial] {
+		t.Fatal("certificate listed in the CRL before it was revoked")
+	}
+
+	if err := RevokeClientCert(context.Background(), dbConn, issued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeClientCert(context.Background(), dbConn, issued.ID); err == nil {
+		t.Fatal("revoked a certificate twice")
+	}
+
+	// the handshake still accepts it, the database check doesn't
+	if _, err := CheckClientCert(context.Background(), dbConn, cert); err == nil {
+		t.Fatal("revoked certificate accepted")
+	}
+	if _, err := CheckClientCert(context.Background(), dbConn, other); err != nil {
+		t.Fatalf("certificate rejected after revoking another one: %v", err)
+	}
+
+	revoked := revokedSerials(t, ca, dbConn)
+	if !revoked[issued.Serial] || revoked[serialString(other.SerialNumber)] || len(revoked) != 1 {
+		t.Fatalf("CRL lists %v, expected %s", revoked, issued.Serial)
+	}
+}
+
+func TestClientCertForeignCA(t *testing.T) {
+	ca, dbConn := testCA(t)
+	foreignCA, foreignDB := testCA(t)
+	_, cert := issue(t, foreignCA, foreignDB, "ci-runner")
+
+	if err := verify(ca, cert, time.Now()); err == nil {
+		t.Fatal("certificate of a foreign CA verifies")
+	}
+	if _, err := CheckClientCert(context.Background(), dbConn, cert); err == nil {
+		t.Fatal("certificate of a foreign CA accepted")
+	}
+}
+
+func TestClientCertExpired(t *testing.T) {
+	ca, dbConn := testCA(t)
+	issued, cert := issue(t, ca, dbConn, "ci-runner")
+
+	if err := verify(ca, cert, cert.NotAfter.Add(time.Minute)); err == nil {
+		t.Fatal("expired certificate verifies")
+	}
+
+	// the handshake checks the certificate's own expiry, the database
+	// check the recorded one
+	err := dbConn.Model(&db.ClientCert{}).Where("id = ?", issued.ID).Update("not_after", time.Now().Add(-time.Minute)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckClientCert(context.Background(), dbConn, cert); err == nil {
+		t.Fatal("expired certificate accepted")
+	}
+
+	// nor are expired certificates listed in the CRL
+	if err := RevokeClientCert(context.Background(), dbConn, issued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := revokedSerials(t, ca, dbConn); len(revoked) != 0 {
+		t.Fatalf("CRL lists %v", revoked)
+	}
+
+	for _, validity := range []time.Duration{time.Minute, MaxClientCertValidity + time.Hour} {
+		if _, err := ca.Issue(context.Background(), dbConn, "ci-runner", "", "", "", validity); err == nil {
+			t.Fatalf("issued a certificate valid for %s", validity)
+		}
+	}
+}
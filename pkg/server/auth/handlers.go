@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"mime"
@@ -21,6 +22,9 @@ var serverAssetsPrefix = "assets/server"
 // Server struct embedding config
 type Handler struct {
 	Config *config.Config
+
+	// issues agent certificates
+	CA *CertAuthority
 }
 
 /* var funcMap = template.FuncMap{
@@ -88,15 +92,29 @@ func (h *Handler) AddAPIKey(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	description := strings.Trim(r.PostFormValue("description"), " ")
-	if len(description) == 0 {
-		var errDescription string
+	connectAllow := strings.TrimSpace(r.PostFormValue("connect_allow"))
+	domains := strings.TrimSpace(r.PostFormValue("domains"))
+	_, errPolicy := ParseConnectPolicy(connectAllow)
+	errDomains := CheckDomainPolicy(domains, h.Config.ServedDomains())
+	if len(description) == 0 || errPolicy != nil || errDomains != nil {
+		var errDescription, errConnectAllow, errDomainPolicy string
 		if len(description) == 0 {
 			errDescription = "Please enter a description in this field"
 		}
+		if errPolicy != nil {
+			errConnectAllow = errPolicy.Error()
+		}
+		if errDomains != nil {
+			errDomainPolicy = errDomains.Error()
+		}
 
 		data := map[string]string{
-			"FormDescription": description,
-			"ErrDescription":  errDescription,
+			"FormDescription":  description,
+			"ErrDescription":   errDescription,
+			"FormConnectAllow": connectAllow,
+			"ErrConnectAllow":  errConnectAllow,
+			"FormDomains":      domains,
+			"ErrDomains":       errDomainPolicy,
 		}
 
 		w.Header().Set("HX-Retarget", "form")
@@ -109,7 +127,7 @@ func (h *Handler) AddAPIKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := CreateAuthToken(ctx, h.Config.Database, description)
+	err := CreateAuthToken(ctx, h.Config.Database, description, connectAllow, domains)
 	if err != nil {
 		var message string
 		if strings.Contains(err.Error(), "CHECK constraint failed") {
@@ -163,6 +181,155 @@ func (h *Handler) RemoveAPIKey(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("HX-Location", "/")
 }
 
+func (h *Handler) GetClientCerts(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	certs, err := ListClientCerts(ctx, h.Config.Database)
+	if err != nil {
+		log.Error("something went wrong: %s", err.Error())
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, certs)
+		return
+	}
+
+	err = tmpl.ExecuteTemplate(w, "cert-list", certs)
+	if err != nil {
+		log.Error("GetClientCerts: Failed to execute template: %v, %+v", err, certs)
+	}
+}
+
+// Issues an agent certificate. Browsers get the certificate and key shown
+// once, API clients sending Accept: application/json get them as JSON.
+func (h *Handler) IssueClientCert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	description := strings.TrimSpace(r.PostFormValue("description"))
+	connectAllow := strings.TrimSpace(r.PostFormValue("connect_allow"))
+	domains := strings.TrimSpace(r.PostFormValue("domains"))
+
+	validity := DefaultClientCertValidity
+	validityHours := strings.TrimSpace(r.PostFormValue("validity_hours"))
+	if validityHours != "" {
+		hours, err := strconv.Atoi(validityHours)
+		if err != nil {
+			hours = -1
+		}
+		validity = time.Duration(hours) * time.Hour
+	}
+
+	var issued IssuedCert
+	err := CheckDomainPolicy(domains, h.Config.ServedDomains())
+	if err == nil {
+		issued, err = h.CA.Issue(ctx, h.Config.Database, name, description, connectAllow, domains, validity)
+	}
+	if err != nil {
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		data := map[string]string{
+			"FormName":          name,
+			"FormDescription":   description,
+			"FormConnectAllow":  connectAllow,
+			"FormDomains":       domains,
+			"FormValidityHours": validityHours,
+			"ErrCert":           err.Error(),
+		}
+
+		w.Header().Set("HX-Retarget", "#cert-form")
+		w.Header().Set("HX-Reswap", "innerHTML")
+		err := tmpl.ExecuteTemplate(w, "new-cert-form", data)
+		if err != nil {
+			log.Error("Failed to execute template: %v", err)
+		}
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusCreated, issued)
+		return
+	}
+
+	err = tmpl.ExecuteTemplate(w, "issued-cert", issued)
+	if err != nil {
+		log.Error("IssueClientCert: Failed to execute template: %v", err)
+	}
+}
+
+func (h *Handler) RevokeClientCert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	id := r.URL.Query().Get("id")
+	log.Info("Revoking certificate ID %s", id)
+
+	if err := RevokeClientCert(ctx, h.Config.Database, id); err != nil {
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+
+		w.Header().Set("HX-Retarget", "body")
+		w.Header().Set("HX-Reswap", "beforeend")
+		err := tmpl.ExecuteTemplate(w, "modal", "Requested certificate was not found or is already revoked!")
+		if err != nil {
+			log.Error("Failed to execute template: %v", err)
+		}
+		return
+	}
+
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("HX-Location", "/")
+}
+
+func (h *Handler) GetCACert(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(h.CA.PEM())
+}
+
+func (h *Handler) GetCRL(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	crl, err := h.CA.CRL(ctx, h.Config.Database)
+	if err != nil {
+		log.Error("GetCRL: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Failed to encode response: %v", err)
+	}
+}
+
 func (h *Handler) ServeStaticFiles(w http.ResponseWriter, r *http.Request) {
 	fileName := serverAssetsPrefix + r.URL.Path
 
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"ngrok/pkg/server/config"
+	"strings"
+)
+
+// The addresses on the server's network that a token may reach through
+// connect tunnels. A token without a policy can't open connect tunnels.
+type ConnectPolicy []connectRule
+
+type connectRule struct {
+	host string
+	cidr *net.IPNet
+	port string
+}
+
+// Parses a connect policy: a list of host:port entries separated by commas
+// or whitespace. The host may be a hostname, an IP address, a CIDR block or
+// a *.domain wildcard, the port may be * to allow any port.
+//
+// Examples: "db.staging.internal:5432, 10.0.0.0/8:6379, *.svc.cluster.local:*"
+func ParseConnectPolicy(policy string) (ConnectPolicy, error) {
+	fields := splitPolicy(policy)
+
+	p := make(ConnectPolicy, 0, len(fields))
+	for _, f := range fields {
+		host, port, err := net.SplitHostPort(f)
+		if err != nil || host == "" || port == "" {
+			return nil, fmt.Errorf("Invalid connect policy entry '%s': must be host:port", f)
+		}
+
+		rule := connectRule{host: strings.ToLower(host), port: port}
+		if strings.Contains(host, "/") {
+			if _, rule.cidr, err = net.ParseCIDR(host); err != nil {
+				return nil, fmt.Errorf("Invalid connect policy entry '%s': %v", f, err)
+			}
+		}
+
+		p = append(p, rule)
+	}
+
+	return p, nil
+}
+
+// Whether the policy allows connecting to addr. CIDR blocks only match IP
+// addresses, hostnames aren't resolved.
+func (p ConnectPolicy) Allows(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, r := range p {
+		if r.port != "*" && r.port != port {
+			continue
+		}
+
+		switch {
+		case r.cidr != nil:
+			if ip != nil && r.cidr.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(r.host, "*."):
+			if ip == nil && strings.HasSuffix(host, r.host[1:]) {
+				return true
+			}
+		case ip != nil:
+			if ruleIp := net.ParseIP(r.host); ruleIp != nil && ruleIp.Equal(ip) {
+				return true
+			}
+		case r.host == host:
+			return true
+		}
+	}
+
+	return false
+}
+
+// The base domains a token may open tunnels on, the first one being its
+// default. A token without a policy may use every unrestricted domain and
+// defaults to the server's default domain.
+type DomainPolicy []string
+
+// Parses a domain policy: a list of domain names separated by commas or
+// whitespace.
+//
+// Example: "team-a.example.com, shared.example.com"
+func ParseDomainPolicy(policy string) (DomainPolicy, error) {
+	fields := splitPolicy(policy)
+
+	p := make(DomainPolicy, 0, len(fields))
+	for _, f := range fields {
+		if strings.ContainsAny(f, ":/*") {
+			return nil, fmt.Errorf("Invalid domain policy entry '%s': must be a domain name", f)
+		}
+		p = append(p, strings.ToLower(f))
+	}
+
+	return p, nil
+}
+
+// Checks that a domain policy parses and only lists served domains. Tokens
+// keep policies naming domains that are no longer served, those domains
+// just don't resolve.
+func CheckDomainPolicy(policy string, served []config.Domain) error {
+	p, err := ParseDomainPolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range p {
+		if !isServed(served, name) {
+			return fmt.Errorf("Invalid domain policy entry '%s': not a domain served by this server", name)
+		}
+	}
+	return nil
+}
+
+// Whether the policy allows tunnels on d
+func (p DomainPolicy) Allows(d *config.Domain) bool {
+	if len(p) == 0 {
+		return !d.Restricted
+	}
+
+	for _, name := range p {
+		if name == d.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// The domain for a tunnel asking for the domain name, or for the default
+// domain if name is empty
+func (p DomainPolicy) Resolve(served []config.Domain, name string) (*config.Domain, error) {
+	if name == "" {
+		if len(p) > 0 {
+			name = p[0]
+		} else {
+			// the first domain the policy allows
+			for i := range served {
+				if p.Allows(&served[i]) {
+					return &served[i], nil
+				}
+			}
+			return nil, fmt.Errorf("Your auth token is not allowed to open tunnels on any domain")
+		}
+	}
+
+	name = strings.ToLower(name)
+	for i := range served {
+		if served[i].Name != name {
+			continue
+		}
+		if !p.Allows(&served[i]) {
+			return nil, fmt.Errorf("Your auth token is not allowed to open tunnels on '%s'", name)
+		}
+		return &served[i], nil
+	}
+	return nil, fmt.Errorf("The domain '%s' is not served by this server", name)
+}
+
+func isServed(served []config.Domain, name string) bool {
+	for _, d := range served {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func splitPolicy(policy string) []string {
+	return strings.FieldsFunc(policy, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
@@ -0,0 +1,109 @@
+package auth
+
+import "testing"
+
+func TestParseConnectPolicy(t *testing.T) {
+	valid := map[string]int{
+		"":                             0,
+		"db.internal:5432":             1,
+		"db:5432, 10.0.0.0/8:6379":     2,
+		"a:1,b:2\n\tc:3  d:*":          4,
+		"[::1]:22 [fd00::/8]:*":        2,
+		"*.svc.cluster.local:*":        1,
+		"DB.Internal:5432,,10.0.0.1:1": 2,
+	}
+	for policy, rules := range valid {
+		p, err := ParseConnectPolicy(policy)
+		if err != nil {
+			t.Errorf("'%s' rejected: %v", policy, err)
+		} else if len(p) != rules {
+			t.Errorf("'%s' parsed to %d rules, expected %d", policy, len(p), rules)
+		}
+	}
+
+	invalid := []string{
+		"db.internal",
+		":5432",
+		"db.internal:",
+		"10.0.0.0/33:80",
+		"fd00::/8:80",
+		"ok:1, bad",
+	}
+	for _, policy := range invalid {
+		if _, err := ParseConnectPolicy(policy); err == nil {
+			t.Errorf("'%s' accepted", policy)
+		}
+	}
+}
+
+func TestConnectPolicyAllows(t *testing.T) {
+	tests := []struct {
+		policy string
+		addr   string
+		allows bool
+	}{
+		// hostnames, case insensitive
+		{"db.internal:5432", "db.internal:5432", true},
+		{"db.internal:5432", "DB.Internal:5432", true},
+		{"DB.Internal:5432", "db.internal:5432", true},
+		{"db.internal:5432", "db.internal:5433", false},
+		{"db.internal:5432", "cache.internal:5432", false},
+		{"db.internal:5432", "db.internal", false},
+
+		// wildcards match subdomains only, never IP addresses
+		{"*.svc.local:80", "api.svc.local:80", true},
+		{"*.svc.local:80", "a.b.svc.local:80", true},
+		{"*.svc.local:80", "svc.local:80", false},
+		{"*.svc.local:80", "evilsvc.local:80", false},
+		{"*.svc.local:80", "api.svc.local.evil.com:80", false},
+		{"*.1.1:80", "10.1.1.1:80", false},
+
+		// IP literals compare as addresses
+		{"10.0.0.1:22", "10.0.0.1:22", true},
+		{"10.0.0.1:22", "10.0.0.2:22", false},
+		{"10.0.0.1:22", "[::ffff:10.0.0.1]:22", true},
+
+		// CIDR blocks match IP addresses, hostnames aren't resolved
+		{"10.0.0.0/8:6379", "10.20.30.40:6379", true},
+		{"10.0.0.0/8:6379", "11.0.0.1:6379", false},
+		{"10.0.0.0/8:6379", "10.0.0.1:6380", false},
+		{"127.0.0.0/8:80", "localhost:80", false},
+
+		// IPv6
+		{"[::1]:22", "[::1]:22", true},
+		{"[::1]:22", "[0:0:0:0:0:0:0:1]:22", true},
+		{"[::1]:22", "127.0.0.1:22", false},
+		{"[fd00::/8]:443", "[fd12:3456::1]:443", true},
+		{"[fd00::/8]:443", "[fe80::1]:443", false},
+		{"[fd00::/8]:443", "10.0.0.1:443", false},
+
+		// any port
+		{"db.internal:*", "db.internal:1", true},
+		{"db.internal:*", "db.internal:65535", true},
+		{"10.0.0.0/8:*", "10.0.0.1:22", true},
+		{"*.svc.local:*", "api.svc.local:8080", true},
+
+		// any of several rules
+		{"a:1, b:2", "b:2", true},
+		{"a:1, b:2", "a:2", false},
+
+		// an empty policy allows nothing
+		{"", "db.internal:5432", false},
+	}
+
+	for _, tt := range tests {
+		p, err := ParseConnectPolicy(tt.policy)
+		if err != nil {
+			t.Fatalf("'%s' rejected: %v", tt.policy, err)
+		}
+		if got := p.Allows(tt.addr); got != tt.allows {
+			t.Errorf("'%s' allows %s: %v, expected %v", tt.policy, tt.addr, got, tt.allows)
+		}
+	}
+
+	// a token without a policy
+	var p ConnectPolicy
+	if p.Allows("db.internal:5432") {
+		t.Errorf("nil policy allows connections")
+	}
+}
@@ -1,42 +1,331 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"ngrok/pkg/server/db"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 
+	"gopkg.in/yaml.v1"
 	"gorm.io/gorm"
 	klog "k8s.io/klog/v2"
 )
 
+// The settings of ngrokd. Each one is read, from lowest to highest
+// precedence, from its default, the configuration file under its yaml key,
+// the environment variable env and the command line flag named like the
+// yaml key with dashes, e.g. -tls-cert. Settings tagged reload take effect
+// on SIGHUP, the others on restart. Settings tagged secret are redacted
+// from String.
 type Config struct {
-	RegistryCacheFile string
-	TLSCert           string
-	TLSKey            string
-	LogLevel          string
-	HttpAddr          string
-	HttpsAddr         string
-	TunnelAddr        string
-	AdminAddr         string
-	HealthAddr        string
-	Domain            string
-	ProxyMaxPoolSize  int
-	ConnectionTimeout int
-	Database          *gorm.DB
+	RegistryCacheFile string `yaml:"registry_cache_file" env:"REGISTRY_CACHE_FILE" default:"" help:"File to persist the tunnel registry to"`
+	TLSCert           string `yaml:"tls_cert" env:"TLS_CERT_PATH" default:"./certs/tls.crt" reload:"true" help:"TLS certificate of the https and tunnel listeners, empty for the built-in snakeoil one"`
+	TLSKey            string `yaml:"tls_key" env:"TLS_KEY_PATH" default:"./certs/tls.key" reload:"true" help:"TLS key of the https and tunnel listeners"`
+	TLSClientAuth     string `yaml:"tls_client_auth" env:"TLS_CLIENT_AUTH" default:"none" help:"Agent certificates on the tunnel listeners: none, optional or require"`
+	LogLevel          string `yaml:"log_level" env:"LOG_LEVEL" default:"DEBUG" reload:"true" help:"FINEST, FINE, DEBUG, TRACE, INFO, WARNING, ERROR or CRITICAL"`
+	ProxyProtocol     string `yaml:"proxy_protocol" env:"PROXY_PROTOCOL" default:"none" help:"PROXY protocol headers on the http, https and tcp tunnel listeners: none, optional or require"`
+	HttpAddr          string `yaml:"http_addr" env:"HTTP_LISTEN_ADDR" default:":80" help:"Public address of http tunnels, empty to disable"`
+	HttpsAddr         string `yaml:"https_addr" env:"HTTPS_LISTEN_ADDR" default:":443" help:"Public address of https tunnels, empty to disable"`
+	TunnelAddr        string `yaml:"tunnel_addr" env:"TUNNEL_LISTEN_ADDR" default:":4443" help:"Address of control and proxy connections from agents"`
+	TunnelWsPath      string `yaml:"tunnel_ws_path" env:"TUNNEL_WS_PATH" default:"" help:"Path of agent connections over websockets on the http(s) addresses, reserved on every public hostname; empty disables them"`
+	TunnelQuicAddr    string `yaml:"tunnel_quic_addr" env:"TUNNEL_QUIC_LISTEN_ADDR" default:"" help:"UDP address of agent connections over QUIC, empty to disable"`
+	AdminAddr         string `yaml:"admin_addr" env:"ADMIN_ADDR" default:":4111" help:"Address of the admin UI and API, empty to disable"`
+	AdminTLSCert      string `yaml:"admin_tls_cert" env:"ADMIN_TLS_CERT_PATH" default:"" help:"TLS certificate of the admin address, empty to serve plain HTTP"`
+	AdminTLSKey       string `yaml:"admin_tls_key" env:"ADMIN_TLS_KEY_PATH" default:"" help:"TLS key of the admin address"`
+	AdminClientCA     string `yaml:"admin_client_ca" env:"ADMIN_CLIENT_CA_PATH" default:"" help:"Require admin client certificates signed by the CAs in this PEM file"`
+	HealthAddr        string `yaml:"health_addr" env:"HTTP_ADDR" default:":4112" help:"Address of the health checks, empty to disable"`
+	MetricsAddr       string `yaml:"metrics_addr" env:"METRICS_ADDR" default:"" help:"Address of the metrics, empty to disable"`
+	Domain            string `yaml:"domain" env:"DOMAIN" default:"ngrok.me" help:"Domain of the tunnel URLs"`
+	ProxyMaxPoolSize  int    `yaml:"proxy_max_pool_size" env:"PROXY_MAX_POOL_SIZE" default:"10" reload:"true" help:"Proxy connections to keep ready per agent"`
+	ConnectionTimeout int    `yaml:"connection_timeout" env:"CONNECTION_TIMEOUT_SECONDS" default:"10" reload:"true" help:"Seconds agents have to send their first message"`
+	TCPBindAddr       string `yaml:"tcp_bind_addr" env:"TCP_BIND_ADDR" default:"0.0.0.0" reload:"true" help:"IP tcp and udp tunnels listen on, :: for IPv4 and IPv6"`
+	TCPPortRange      string `yaml:"tcp_port_range" env:"TCP_PORT_RANGE" default:"" reload:"true" help:"Ports tcp and udp tunnels may listen on, e.g. 10000-20000,30022, empty for any"`
+	TCPExcludedPorts  string `yaml:"tcp_excluded_ports" env:"TCP_EXCLUDED_PORTS" default:"" reload:"true" help:"Ports tcp and udp tunnels may not listen on, e.g. 10022,11000-11999"`
+	TunnelRateLimit   int    `yaml:"tunnel_rate_limit" env:"TUNNEL_RATE_LIMIT" default:"0" reload:"true" help:"Public http connections per second each tunnel accepts, 0 for no limit"`
+	HoldTimeout       int    `yaml:"hold_timeout" env:"HOLD_TIMEOUT_SECONDS" default:"30" reload:"true" help:"Seconds tunnels with hold keep their url and queue requests after losing their agent"`
+	HoldMaxRequests   int    `yaml:"hold_max_requests" env:"HOLD_MAX_REQUESTS" default:"100" reload:"true" help:"Requests a tunnel with hold queues at most"`
+	HoldMaxBytes      int    `yaml:"hold_max_bytes" env:"HOLD_MAX_BYTES" default:"10485760" reload:"true" help:"Bytes of requests a tunnel with hold queues at most"`
+	HoldRetryAfter    int    `yaml:"hold_retry_after" env:"HOLD_RETRY_AFTER_SECONDS" default:"5" reload:"true" help:"Seconds clients are told to wait before retrying requests a held tunnel couldn't deliver"`
+	ErrorPagesDir     string `yaml:"error_pages_dir" env:"ERROR_PAGES_DIR" default:"" reload:"true" help:"Directory of templates overriding the error pages of public http requests, empty for the built-in ones"`
+	UdpIdleTimeout    int    `yaml:"udp_idle_timeout" env:"UDP_IDLE_TIMEOUT_SECONDS" default:"60" reload:"true" help:"Seconds after which idle UDP flows are closed"`
+	DatabaseType      string `yaml:"database_type" env:"DATABASE_TYPE" default:"sqlite" help:"sqlite, postgres or mysql"`
+	DatabaseFile      string `yaml:"database_file" env:"DATABASE_FILE" default:"sqlite.db" help:"File of the sqlite database"`
+	DatabaseHost      string `yaml:"database_host" env:"DATABASE_HOST" default:"localhost" help:"Host of the postgres or mysql database"`
+	DatabasePort      int    `yaml:"database_port" env:"DATABASE_PORT" default:"5432" help:"Port of the postgres or mysql database"`
+	DatabaseUser      string `yaml:"database_user" env:"DATABASE_USER" default:"postgres" help:"User of the postgres or mysql database"`
+	DatabasePassword  string `yaml:"database_password" env:"DATABASE_PASSWORD" default:"supersecretpassw0rd" secret:"true" help:"Password of the postgres or mysql database"`
+
+	// base domains, only read from the configuration file, see
+	// ServedDomains
+	Domains []Domain `yaml:"domains"`
+
+	Database *gorm.DB `yaml:"-"`
+
+	opts *Options
+}
+
+// Where the settings come from, see ParseArgs
+type Options struct {
+	config string            // path of the configuration file, if any
+	flags  map[string]string // the values of the flags given, by yaml key
+}
+
+var logLevels = []string{"FINEST", "FINE", "DEBUG", "TRACE", "INFO", "WARNING", "ERROR", "CRITICAL"}
+
+// Parses the command line of ngrokd
+func ParseArgs(args []string) (*Options, error) {
+	fs := flag.NewFlagSet("ngrokd", flag.ContinueOnError)
+	configPath := fs.String("config", "", "Path to the YAML configuration file")
+	for _, f := range settings() {
+		fs.String(flagName(f), f.Tag.Get("default"), f.Tag.Get("help"))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments: %v", fs.Args())
+	}
+
+	opts := &Options{config: *configPath, flags: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			opts.flags[strings.ReplaceAll(f.Name, "-", "_")] = f.Value.String()
+		}
+	})
+	return opts, nil
+}
+
+// Reads the settings from the sources in opts and validates them. Database
+// is left unset.
+func Load(opts *Options) (*Config, error) {
+	config := &Config{opts: opts}
+	v := reflect.ValueOf(config).Elem()
+
+	for _, f := range settings() {
+		if err := setField(v.FieldByIndex(f.Index), f.Tag.Get("default")); err != nil {
+			return nil, fmt.Errorf("Invalid default for %s: %v", f.Tag.Get("yaml"), err)
+		}
+	}
+
+	var errs []error
+	if opts.config != "" {
+		errs = append(errs, config.loadFile(opts.config))
+	}
+
+	for _, f := range settings() {
+		if value, ok := os.LookupEnv(f.Tag.Get("env")); ok {
+			if err := setField(v.FieldByIndex(f.Index), value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", f.Tag.Get("env"), err))
+			}
+		}
+		if value, ok := opts.flags[f.Tag.Get("yaml")]; ok {
+			if err := setField(v.FieldByIndex(f.Index), value); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %v", flagName(f), err))
+			}
+		}
+	}
+
+	if err := errors.Join(append(errs, config.validate()...)...); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Reads the settings again from the same sources, e.g. after the
+// configuration file was edited. The database connection is kept.
+func (c *Config) Reload() (*Config, error) {
+	next, err := Load(c.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	next.Database = c.Database
+	return next, nil
+}
+
+// The yaml keys of the settings which differ in next but only take effect
+// on restart
+func (c *Config) RestartRequired(next *Config) (keys []string) {
+	cv, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for _, f := range settings() {
+		if f.Tag.Get("reload") == "" && cv.FieldByIndex(f.Index).Interface() != nv.FieldByIndex(f.Index).Interface() {
+			keys = append(keys, f.Tag.Get("yaml"))
+		}
+	}
+
+	// the TLS material of domains is reloaded, the domains themselves not
+	if !sameDomains(c.ServedDomains(), next.ServedDomains()) {
+		keys = append(keys, "domains")
+	}
+	return
+}
+
+// The settings for logging, with secrets redacted
+func (c Config) String() string {
+	v := reflect.ValueOf(c)
+	parts := make([]string, 0)
+	for _, f := range settings() {
+		value := fmt.Sprint(v.FieldByIndex(f.Index).Interface())
+		if f.Tag.Get("secret") != "" && value != "" {
+			value = "<redacted>"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", f.Tag.Get("yaml"), value))
+	}
+	for _, d := range c.Domains {
+		parts = append(parts, fmt.Sprintf("domains[%s]=%+v", d.Name, d))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *Config) loadFile(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read configuration file %s: %v", path, err)
+	}
+
+	var values map[string]interface{}
+	if err = yaml.Unmarshal(buf, &values); err != nil {
+		return fmt.Errorf("Error parsing configuration file %s: %v", path, err)
+	}
+
+	fields := make(map[string]reflect.StructField)
+	for _, f := range settings() {
+		fields[f.Tag.Get("yaml")] = f
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	for _, key := range keys {
+		value := values[key]
+		if key == "domains" {
+			var err error
+			if c.Domains, err = parseDomains(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: domains: %v", path, err))
+			}
+			continue
+		}
+
+		f, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %s", path, key))
+			continue
+		}
+
+		switch value.(type) {
+		case string, int, int64, float64, bool:
+		case nil:
+			value = ""
+		default:
+			errs = append(errs, fmt.Errorf("%s: %s must be a single value", path, key))
+			continue
+		}
+
+		if err := setField(v.FieldByIndex(f.Index), fmt.Sprint(value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %v", path, key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks the settings, returning every problem found
+func (c *Config) validate() (errs []error) {
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	addrs := [][2]string{
+		{"http_addr", c.HttpAddr},
+		{"https_addr", c.HttpsAddr},
+		{"tunnel_addr", c.TunnelAddr},
+		{"tunnel_quic_addr", c.TunnelQuicAddr},
+		{"admin_addr", c.AdminAddr},
+		{"health_addr", c.HealthAddr},
+		{"metrics_addr", c.MetricsAddr},
+	}
+	for _, a := range addrs {
+		key, addr := a[0], a[1]
+		if addr == "" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		check(err == nil, "%s: invalid address %q, must be [host]:port", key, addr)
+	}
+
+	check(c.TunnelAddr != "", "tunnel_addr: must be set")
+	check(c.Domain != "" && !strings.ContainsAny(c.Domain, ":/"), "domain: invalid domain %q", c.Domain)
+	check(c.TunnelWsPath == "" || strings.HasPrefix(c.TunnelWsPath, "/"), "tunnel_ws_path: must start with /, got %q", c.TunnelWsPath)
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls_cert and tls_key: must be set together")
+	check((c.AdminTLSCert == "") == (c.AdminTLSKey == ""), "admin_tls_cert and admin_tls_key: must be set together")
+	check(c.AdminClientCA == "" || c.AdminTLSCert != "", "admin_client_ca: requires admin_tls_cert and admin_tls_key")
+	check(oneOf(c.TLSClientAuth, "none", "optional", "require"), "tls_client_auth: must be none, optional or require, got %q", c.TLSClientAuth)
+	check(oneOf(c.ProxyProtocol, "none", "optional", "require"), "proxy_protocol: must be none, optional or require, got %q", c.ProxyProtocol)
+	check(oneOf(c.LogLevel, logLevels...), "log_level: must be one of %s, got %q", strings.Join(logLevels, ", "), c.LogLevel)
+	check(oneOf(c.DatabaseType, "sqlite", "postgres", "mysql"), "database_type: must be sqlite, postgres or mysql, got %q", c.DatabaseType)
+	check(c.DatabasePort > 0 && c.DatabasePort < 65536, "database_port: must be between 1 and 65535, got %d", c.DatabasePort)
+	check(c.ProxyMaxPoolSize > 0, "proxy_max_pool_size: must be positive, got %d", c.ProxyMaxPoolSize)
+	check(c.ConnectionTimeout > 0, "connection_timeout: must be positive, got %d", c.ConnectionTimeout)
+	check(c.TunnelRateLimit >= 0, "tunnel_rate_limit: must not be negative, got %d", c.TunnelRateLimit)
+	check(c.HoldTimeout >= 0, "hold_timeout: must not be negative, got %d", c.HoldTimeout)
+	check(c.HoldMaxRequests > 0, "hold_max_requests: must be positive, got %d", c.HoldMaxRequests)
+	check(c.HoldMaxBytes > 0, "hold_max_bytes: must be positive, got %d", c.HoldMaxBytes)
+	check(c.HoldRetryAfter >= 0, "hold_retry_after: must not be negative, got %d", c.HoldRetryAfter)
+	check(c.UdpIdleTimeout > 0, "udp_idle_timeout: must be positive, got %d", c.UdpIdleTimeout)
+	check(net.ParseIP(c.TCPBindAddr) != nil, "tcp_bind_addr: must be an IP address, got %q", c.TCPBindAddr)
+	if _, err := ParsePortRanges(c.TCPPortRange); err != nil {
+		check(false, "tcp_port_range: %v", err)
+	}
+	if _, err := ParsePortRanges(c.TCPExcludedPorts); err != nil {
+		check(false, "tcp_excluded_ports: %v", err)
+	}
+	errs = append(errs, validateDomains(c.Domains)...)
+	return
+}
+
+func (c *Config) DatabaseConfig() *db.Database {
+	return &db.Database{
+		Type:     c.DatabaseType,
+		File:     c.DatabaseFile,
+		Host:     c.DatabaseHost,
+		Port:     c.DatabasePort,
+		User:     c.DatabaseUser,
+		Password: c.DatabasePassword,
+	}
 }
 
+// Reads the configuration from the command line, the configuration file
+// and the environment and connects to the database. Exits on errors.
 func InitConfig() *Config {
+	opts, err := ParseArgs(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		klog.Fatalf("%v", err)
+	}
 
-	dbConf := db.Database{
-		Type:     getEnvStr("DATABASE_TYPE", "sqlite"), // sqlite/postgres/mysql
-		File:     getEnvStr("DATABASE_FILE", "sqlite.db"),
-		Host:     getEnvStr("DATABASE_HOST", "localhost"),
-		Port:     getEnvInt("DATABASE_PORT", 5432),
-		User:     getEnvStr("DATABASE_USER", "postgres"),
-		Password: getEnvStr("DATABASE_PASSWORD", "supersecretpassw0rd"),
+	config, err := Load(opts)
+	if err != nil {
+		klog.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-	dbConn, err := db.GetDB(&dbConf)
+	dbConn, err := db.GetDB(config.DatabaseConfig())
 	if err != nil {
 		klog.Fatalf("Could not connect to database %v", err)
 	}
@@ -48,40 +337,46 @@ func InitConfig() *Config {
 	if err != nil {
 		klog.Fatalf("Could not migrate database %v", err)
 	}
-	config := Config{
-		RegistryCacheFile: getEnvStr("REGISTRY_CACHE_FILE", ""),
-		TLSCert:           getEnvStr("TLS_CERT_PATH", "./certs/tls.crt"),
-		TLSKey:            getEnvStr("TLS_KEY_PATH", "./certs/tls.key"),
-		LogLevel:          getEnvStr("LOG_LEVEL", "DEBUG"), // DEBUG,INFO,WARNING,ERROR
-		HttpAddr:          getEnvStr("HTTP_LISTEN_ADDR", ":80"),
-		HttpsAddr:         getEnvStr("HTTPS_LISTEN_ADDR", ":443"),
-		TunnelAddr:        getEnvStr("TUNNEL_LISTEN_ADDR", ":4443"),
-		AdminAddr:         getEnvStr("ADMIN_ADDR", ":4111"),
-		HealthAddr:        getEnvStr("HTTP_ADDR", ":4112"),
-		Domain:            getEnvStr("DOMAIN", "ngrok.me"),
-		ProxyMaxPoolSize:  getEnvInt("PROXY_MAX_POOL_SIZE", 10),
-		ConnectionTimeout: getEnvInt("CONNECTION_TIMEOUT_SECONDS", 10),
-		Database:          dbConn,
-	}
-	klog.Infof("CONFIG IS %+v", config)
-
-	return &config
+	config.Database = dbConn
+	klog.Infof("Config: %s", config)
+
+	return config
 }
 
-func getEnvStr(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// The fields of Config which are settings
+func settings() (fields []reflect.StructField) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Tag.Get("env") != "" {
+			fields = append(fields, f)
+		}
 	}
-	return fallback
+	return
+}
+
+func flagName(f reflect.StructField) string {
+	return strings.ReplaceAll(f.Tag.Get("yaml"), "_", "-")
 }
-func getEnvInt(key string, fallback int) int {
-	if value, ok := os.LookupEnv(key); ok {
-		i64, err := strconv.ParseInt(value, 10, 0)
-		var ret int = int(i64) // Safe based on ParseInt doc (0 bitsize = int)
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.Int:
+		i, err := strconv.Atoi(strings.TrimSpace(value))
 		if err != nil {
-			return fallback
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		field.SetInt(int64(i))
+	default:
+		field.SetString(value)
+	}
+	return nil
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
 		}
-		return ret
 	}
-	return fallback
+	return false
 }
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ngrokd.yml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The configuration with every setting at its default
+func defaultConfig(t *testing.T) *Config {
+	t.Helper()
+	config, err := Load(&Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+domain: file.test
+log_level: INFO
+proxy_max_pool_size: 20
+connection_timeout: 20
+`)
+	t.Setenv("PROXY_MAX_POOL_SIZE", "30")
+	t.Setenv("CONNECTION_TIMEOUT_SECONDS", "30")
+
+	opts, err := ParseArgs([]string{"-config", path, "-connection-timeout", "40"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Load(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key      string
+		value    interface{}
+		expected interface{}
+	}{
+		{"http_addr", config.HttpAddr, ":80"},
+		{"domain", config.Domain, "file.test"},
+		{"log_level", config.LogLevel, "INFO"},
+		{"proxy_max_pool_size", config.ProxyMaxPoolSize, 30},
+		{"connection_timeout", config.ConnectionTimeout, 40},
+	}
+	for _, tt := range tests {
+		if tt.value != tt.expected {
+			t.Errorf("%s: %v, expected %v", tt.key, tt.value, tt.expected)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	if _, err := ParseArgs([]string{"extra"}); err == nil {
+		t.Error("unexpected argument accepted")
+	}
+	if _, err := ParseArgs([]string{"-no-such-flag", "1"}); err == nil {
+		t.Error("unknown flag accepted")
+	}
+
+	opts, err := ParseArgs([]string{"-tls-cert", "a.crt", "-tls-key", "a.key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"tls_cert": "a.crt", "tls_key": "a.key"}; !reflect.DeepEqual(opts.flags, expected) {
+		t.Errorf("flags %v, expected %v", opts.flags, expected)
+	}
+}
+
+func TestLoadFileRejects(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"no_such_setting: 1", "unknown setting no_such_setting"},
+		{"domain:\n  name: example.com", "domain must be a single value"},
+		{"http_addr:\n  - :80\n  - :8080", "http_addr must be a single value"},
+		{"proxy_max_pool_size: many", "proxy_max_pool_size"},
+		{"domain: [", "Error parsing configuration file"},
+	}
+
+	for _, tt := range tests {
+		config := defaultConfig(t)
+		err := config.loadFile(writeConfig(t, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: %v, expected an error containing %q", tt.content, err, tt.err)
+		}
+	}
+
+	// every problem is reported at once
+	err := defaultConfig(t).loadFile(writeConfig(t, "foo: 1\nbar: 2"))
+	if err == nil || !strings.Contains(err.Error(), "foo") || !strings.Contains(err.Error(), "bar") {
+		t.Errorf("expected both unknown settings reported, got %v", err)
+	}
+
+	if err := defaultConfig(t).loadFile(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("missing configuration file accepted")
+	}
+
+	// empty values clear a setting
+	config := defaultConfig(t)
+	if err := config.loadFile(writeConfig(t, "admin_addr:\nlog_level: INFO")); err != nil {
+		t.Fatal(err)
+	}
+	if config.AdminAddr != "" || config.LogLevel != "INFO" {
+		t.Errorf("admin_addr %q, log_level %q", config.AdminAddr, config.LogLevel)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if errs := defaultConfig(t).validate(); len(errs) != 0 {
+		t.Fatalf("defaults invalid: %v", errs)
+	}
+
+	tests := []struct {
+		change func(*Config)
+		key    string
+	}{
+		{func(c *Config) { c.HttpAddr = "80" }, "http_addr"},
+		{func(c *Config) { c.AdminAddr = "localhost:http" }, "admin_addr"},
+		{func(c *Config) { c.MetricsAddr = ":65536" }, "metrics_addr"},
+		{func(c *Config) { c.TunnelAddr = "" }, "tunnel_addr"},
+		{func(c *Config) { c.Domain = "" }, "domain"},
+		{func(c *Config) { c.Domain = "example.com:80" }, "domain"},
+		{func(c *Config) { c.TunnelWsPath = "_ngrok" }, "tunnel_ws_path"},
+		{func(c *Config) { c.TLSKey = "" }, "tls_cert and tls_key"},
+		{func(c *Config) { c.AdminTLSCert = "admin.crt" }, "admin_tls_cert and admin_tls_key"},
+		{func(c *Config) { c.AdminClientCA = "ca.pem" }, "admin_client_ca"},
+		{func(c *Config) { c.TLSClientAuth = "always" }, "tls_client_auth"},
+		{func(c *Config) { c.LogLevel = "debug" }, "log_level"},
+		{func(c *Config) { c.DatabaseType = "oracle" }, "database_type"},
+		{func(c *Config) { c.DatabasePort = 0 }, "database_port"},
+		{func(c *Config) { c.ProxyMaxPoolSize = 0 }, "proxy_max_pool_size"},
+		{func(c *Config) { c.ConnectionTimeout = -1 }, "connection_timeout"},
+		{func(c *Config) { c.UdpIdleTimeout = 0 }, "udp_idle_timeout"},
+		{func(c *Config) { c.TCPBindAddr = "localhost" }, "tcp_bind_addr"},
+		{func(c *Config) { c.TCPPortRange = "20000-10000" }, "tcp_port_range"},
+		{func(c *Config) { c.TCPExcludedPorts = "ssh" }, "tcp_excluded_ports"},
+	}
+
+	for _, tt := range tests {
+		config := defaultConfig(t)
+		tt.change(config)
+		errs := config.validate()
+		if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), tt.key+":") {
+			t.Errorf("expected one error for %s, got %v", tt.key, errs)
+		}
+	}
+
+	// optional addresses may be empty
+	config := defaultConfig(t)
+	config.HttpAddr, config.AdminAddr, config.TunnelWsPath = "", "", ""
+	config.TLSCert, config.TLSKey = "", ""
+	if errs := config.validate(); len(errs) != 0 {
+		t.Errorf("empty optional settings rejected: %v", errs)
+	}
+
+	// and Load reports every problem
+	t.Setenv("LOG_LEVEL", "loud")
+	t.Setenv("DATABASE_PORT", "-1")
+	_, err := Load(&Options{})
+	if err == nil || !strings.Contains(err.Error(), "log_level") || !strings.Contains(err.Error(), "database_port") {
+		t.Errorf("expected log_level and database_port reported, got %v", err)
+	}
+}
+
+func TestStringRedactsSecrets(t *testing.T) {
+	config := defaultConfig(t)
+	config.DatabasePassword = "hunter2"
+	s := config.String()
+	if strings.Contains(s, "hunter2") || !strings.Contains(s, `database_password="<redacted>"`) {
+		t.Errorf("secret not redacted: %s", s)
+	}
+	if !strings.Contains(s, `database_user="postgres"`) {
+		t.Errorf("settings missing: %s", s)
+	}
+
+	// an empty secret isn't hidden, it shows the setting is missing
+	config.DatabasePassword = ""
+	if s := config.String(); !strings.Contains(s, `database_password=""`) {
+		t.Errorf("empty secret: %s", s)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := defaultConfig(t)
+	next := defaultConfig(t)
+	if keys := current.RestartRequired(next); len(keys) != 0 {
+		t.Errorf("unchanged configuration requires a restart for %v", keys)
+	}
+
+	// settings tagged reload take effect without one
+	next.LogLevel = "ERROR"
+	next.ProxyMaxPoolSize = 50
+	next.TLSCert = "other.crt"
+	if keys := current.RestartRequired(next); len(keys) != 0 {
+		t.Errorf("reloadable settings require a restart for %v", keys)
+	}
+
+	next.HttpAddr = ":8080"
+	next.DatabasePassword = "changed"
+	if keys := current.RestartRequired(next); !reflect.DeepEqual(keys, []string{"http_addr", "database_password"}) {
+		t.Errorf("restart required for %v", keys)
+	}
+}
+
+func TestReloadKeepsDatabase(t *testing.T) {
+	path := writeConfig(t, "log_level: INFO")
+	opts, err := ParseArgs([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := Load(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(path, []byte("log_level: ERROR"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	next, err := current.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.LogLevel != "ERROR" || next.Database != current.Database {
+		t.Errorf("reloaded log_level %s", next.LogLevel)
+	}
+
+	if err = os.WriteFile(path, []byte("log_level: loud"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = current.Reload(); err == nil {
+		t.Error("invalid configuration reloaded")
+	}
+}
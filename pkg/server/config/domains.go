@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A base domain served by ngrokd. Tunnels get URLs under the domain, or
+// TCPHostname for tcp and udp tunnels. Tokens open tunnels on the domains
+// their domain policy lists, or on any unrestricted domain if it lists none,
+// see auth.DomainPolicy.
+type Domain struct {
+	Name        string `yaml:"name"`
+	TLSCert     string `yaml:"tls_cert"`     // for the domain and its subdomains, empty for tls_cert
+	TLSKey      string `yaml:"tls_key"`      // of TLSCert
+	TCPHostname string `yaml:"tcp_hostname"` // empty for Name
+	Restricted  bool   `yaml:"restricted"`   // only for tokens whose policy lists it
+}
+
+// The host of the URLs of tcp and udp tunnels on the domain
+func (d *Domain) TCPHost() string {
+	if d.TCPHostname != "" {
+		return d.TCPHostname
+	}
+	return d.Name
+}
+
+// Whether host is the domain or one of its subdomains
+func (d *Domain) Contains(host string) bool {
+	host = strings.ToLower(host)
+	return host == d.Name || strings.HasSuffix(host, "."+d.Name)
+}
+
+// The domains tunnels are served on, the first one being the default. These
+// are the domains of the configuration file, or the single domain setting
+// if it has none.
+func (c *Config) ServedDomains() []Domain {
+	if len(c.Domains) > 0 {
+		return c.Domains
+	}
+	return []Domain{{Name: strings.ToLower(c.Domain)}}
+}
+
+// The served domain named name, nil if there is none
+func (c *Config) FindDomain(name string) *Domain {
+	domains := c.ServedDomains()
+	for i := range domains {
+		if domains[i].Name == strings.ToLower(name) {
+			return &domains[i]
+		}
+	}
+	return nil
+}
+
+// Parses the domains list of the configuration file
+func parseDomains(value interface{}) ([]Domain, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must be a list")
+	}
+
+	domains := make([]Domain, 0, len(list))
+	for i, item := range list {
+		entry, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %d must be a map", i)
+		}
+
+		var d Domain
+		for k, v := range entry {
+			key := fmt.Sprint(k)
+			var str string
+			switch v := v.(type) {
+			case string:
+				str = v
+			case nil:
+			default:
+				if key != "restricted" {
+					return nil, fmt.Errorf("entry %d: %s must be a string", i, key)
+				}
+			}
+
+			switch key {
+			case "name":
+				d.Name = strings.ToLower(strings.TrimSpace(str))
+			case "tls_cert":
+				d.TLSCert = str
+			case "tls_key":
+				d.TLSKey = str
+			case "tcp_hostname":
+				d.TCPHostname = strings.ToLower(strings.TrimSpace(str))
+			case "restricted":
+				b, ok := v.(bool)
+				if !ok {
+					return nil, fmt.Errorf("entry %d: restricted must be true or false", i)
+				}
+				d.Restricted = b
+			default:
+				return nil, fmt.Errorf("entry %d: unknown setting %s", i, key)
+			}
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+func validateDomains(domains []Domain) (errs []error) {
+	seen := make(map[string]bool)
+	for i, d := range domains {
+		switch {
+		case d.Name == "" || strings.ContainsAny(d.Name, ":/ *"):
+			errs = append(errs, fmt.Errorf("domains: entry %d: invalid name %q", i, d.Name))
+		case seen[d.Name]:
+			errs = append(errs, fmt.Errorf("domains: %s is listed twice", d.Name))
+		}
+		seen[d.Name] = true
+
+		if (d.TLSCert == "") != (d.TLSKey == "") {
+			errs = append(errs, fmt.Errorf("domains: %s: tls_cert and tls_key must be set together", d.Name))
+		}
+		if strings.ContainsAny(d.TCPHostname, ":/ *") {
+			errs = append(errs, fmt.Errorf("domains: %s: invalid tcp_hostname %q", d.Name, d.TCPHostname))
+		}
+	}
+	return
+}
+
+func sameDomains(a, b []Domain) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].TCPHostname != b[i].TCPHostname || a[i].Restricted != b[i].Restricted {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Ranges of ports, written like 10000-20000,30022
+type PortRanges [][2]int
+
+// Parses comma separated ports and ranges of ports, empty for none
+func ParsePortRanges(s string) (PortRanges, error) {
+	var ranges PortRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+
+		first, err1 := parsePort(lo)
+		last, err2 := parsePort(hi)
+		if err1 != nil || err2 != nil || first > last {
+			return nil, fmt.Errorf("invalid port range %q, must be like 10000-20000 or 10022", part)
+		}
+		ranges = append(ranges, [2]int{first, last})
+	}
+	return ranges, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+func (r PortRanges) Contains(port int) bool {
+	for _, pr := range r {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of ports in the ranges, counting ports in overlapping ranges
+// once for each
+func (r PortRanges) Count() (n int) {
+	for _, pr := range r {
+		n += pr[1] - pr[0] + 1
+	}
+	return
+}
+
+// The i-th port of the ranges, 0 <= i < Count()
+func (r PortRanges) Nth(i int) int {
+	for _, pr := range r {
+		if size := pr[1] - pr[0] + 1; i >= size {
+			i -= size
+		} else {
+			return pr[0] + i
+		}
+	}
+	return 0
+}
+
+func (r PortRanges) String() string {
+	parts := make([]string, len(r))
+	for i, pr := range r {
+		if pr[0] == pr[1] {
+			parts[i] = strconv.Itoa(pr[0])
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", pr[0], pr[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected PortRanges
+		str      string
+	}{
+		{"", nil, ""},
+		{" , ", nil, ""},
+		{"10022", PortRanges{{10022, 10022}}, "10022"},
+		{"10000-20000,30022", PortRanges{{10000, 20000}, {30022, 30022}}, "10000-20000,30022"},
+		{" 1 - 3 , 65535 ", PortRanges{{1, 3}, {65535, 65535}}, "1-3,65535"},
+		{"5-5", PortRanges{{5, 5}}, "5"},
+	}
+
+	for _, tt := range tests {
+		ranges, err := ParsePortRanges(tt.s)
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, tt.expected) {
+			t.Errorf("%q: %v, expected %v", tt.s, ranges, tt.expected)
+		}
+		if ranges.String() != tt.str {
+			t.Errorf("%q: formatted as %q, expected %q", tt.s, ranges.String(), tt.str)
+		}
+	}
+
+	for _, s := range []string{"0", "65536", "-1", "20-10", "10-", "a-b", "1-2-3", "80,http"} {
+		if ranges, err := ParsePortRanges(s); err == nil {
+			t.Errorf("%q: accepted as %v", s, ranges)
+		}
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges("10-12,20,30-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ranges.Count(); n != 6 {
+		t.Fatalf("%d ports, expected 6", n)
+	}
+
+	var ports []int
+	for i := 0; i < ranges.Count(); i++ {
+		ports = append(ports, ranges.Nth(i))
+	}
+	if expected := []int{10, 11, 12, 20, 30, 31}; !reflect.DeepEqual(ports, expected) {
+		t.Errorf("ports %v, expected %v", ports, expected)
+	}
+
+	for port, contained := range map[int]bool{9: false, 10: true, 12: true, 13: false, 20: true, 31: true, 32: false} {
+		if ranges.Contains(port) != contained {
+			t.Errorf("Contains(%d) = %v", port, !contained)
+		}
+	}
+
+	var none PortRanges
+	if none.Count() != 0 || none.Contains(80) {
+		t.Error("empty ranges contain ports")
+	}
+}
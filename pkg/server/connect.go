@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"ngrok/pkg/conn"
+	"ngrok/pkg/msg"
+	"ngrok/pkg/server/auth"
+	"ngrok/pkg/server/config"
+	"time"
+)
+
+const connectDialTimeout = 10 * time.Second
+
+// Handles a connection a client opened for a connect tunnel: dials the
+// requested address on the server's network and joins the two
+func NewConnect(ctx context.Context, config *config.Config, cnctConn conn.Conn, regCnct *msg.RegConnect) {
+	defer cnctConn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			cnctConn.Warn("Failed with error: %v", r)
+		}
+	}()
+
+	cnctConn.SetType("cnct")
+
+	fail := func(err error) {
+		cnctConn.Warn("%v", err)
+		msg.WriteMsg(cnctConn, &msg.ConnectResp{Error: err.Error()})
+	}
+
+	// every connection authenticates like the control connection did, a
+	// client id alone proves nothing
+	owner, policy, err := connectCredentials(ctx, config, cnctConn, regCnct.User)
+	if err != nil {
+		fail(fmt.Errorf("Authentication error: %v", err))
+		return
+	}
+
+	// look up the control connection of the client, which must belong to
+	// the same token or certificate
+	ctl := controlRegistry.Get(regCnct.ClientId)
+	if ctl == nil || ctl.owner != owner {
+		fail(fmt.Errorf("No client found for identifier: %s", regCnct.ClientId))
+		return
+	}
+	cnctConn.AddLogPrefix(ctl.id)
+
+	// the policy is checked for every connection, not just when the tunnel
+	// was opened, since the client picks the address
+	if !policy.Allows(regCnct.Addr) {
+		fail(fmt.Errorf("Your auth token is not allowed to connect to '%s'", regCnct.Addr))
+		return
+	}
+
+	rawConn, err := net.DialTimeout("tcp", regCnct.Addr, connectDialTimeout)
+	if err != nil {
+		fail(fmt.Errorf("Failed to connect to %s: %v", regCnct.Addr, err))
+		return
+	}
+	remoteConn := conn.Wrap(rawConn, "prv")
+	defer remoteConn.Close()
+
+	if err = msg.WriteMsg(cnctConn, &msg.ConnectResp{}); err != nil {
+		cnctConn.Warn("Failed to write ConnectResp: %v", err)
+		return
+	}
+
+	cnctConn.Info("Connected to %s", regCnct.Addr)
+	cnctConn.SetDeadline(time.Time{})
+	bytesIn, bytesOut := conn.Join(cnctConn, remoteConn)
+	cnctConn.Debug("Closed connection to %s, %d bytes in, %d bytes out", regCnct.Addr, bytesIn, bytesOut)
+}
+
+// Verifies the client certificate of c, or the auth token if it has none.
+// Returns the owner of the credential, as controls record it, and its
+// connect policy.
+func connectCredentials(ctx context.Context, config *config.Config, c conn.Conn, token string) (string, auth.ConnectPolicy, error) {
+	if certs := conn.PeerCertificates(c); len(certs) > 0 {
+		cert, err := auth.CheckClientCert(ctx, config.Database, certs[0])
+		if err != nil {
+			return "", nil, err
+		}
+		policy, err := auth.ParseConnectPolicy(cert.ConnectAllow)
+		if err != nil {
+			c.Warn("Invalid connect policy of client certificate %s: %v", cert.Serial, err)
+		}
+		return "cert:" + cert.Name, policy, nil
+	} else if config.TLSClientAuth == "require" {
+		return "", nil, fmt.Errorf("a client certificate is required")
+	}
+
+	if err := auth.ValidateAuthToken(ctx, config.Database, token); err != nil {
+		return "", nil, err
+	}
+	policy, err := auth.GetConnectPolicy(ctx, config.Database, token)
+	if err != nil {
+		c.Debug("No connect policy: %v", err)
+	}
+	return "token:" + token, policy, nil
+}
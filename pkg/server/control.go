@@ -4,26 +4,38 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"ngrok/pkg/conn"
 	"ngrok/pkg/msg"
 	"ngrok/pkg/server/auth"
 	"ngrok/pkg/server/config"
+	"ngrok/pkg/server/db"
 	"ngrok/pkg/server/log"
 	"ngrok/pkg/util"
 	"ngrok/pkg/version"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	pingTimeoutInterval = 30 * time.Second
-	connReapInterval    = 10 * time.Second
 	controlWriteTimeout = 10 * time.Second
 	proxyStaleDuration  = 60 * time.Second
 )
 
-var proxyMaxPoolSize int
+// heartbeat timing as time.Durations, variables so that tests can detect
+// lost heartbeats quickly
+var pingTimeoutInterval, connReapInterval atomic.Int64
+
+func init() {
+	pingTimeoutInterval.Store(int64(30 * time.Second))
+	connReapInterval.Store(int64(10 * time.Second))
+}
+
+// see setLimits
+var proxyMaxPoolSize atomic.Int64
 
 type Control struct {
 	// auth message
@@ -49,9 +61,32 @@ type Control struct {
 	// proxy connections
 	proxies chan conn.Conn
 
+	// held by goroutines other than the control's own to send on out or
+	// add to proxies, and by stopper() to set closed before closing them
+	closeLock sync.RWMutex
+	closed    bool
+
 	// identifier
 	id string
 
+	// what the client's auth token may reach with connect tunnels
+	connectPolicy auth.ConnectPolicy
+
+	// the credential the client authenticated with, its connect
+	// connections must present the same one and only the tunnels of one
+	// owner may share a hostname
+	owner string
+
+	// the domains the client's auth token may open tunnels on
+	domainPolicy auth.DomainPolicy
+
+	// how messages on the control connection are framed and encoded
+	// after the AuthResp
+	codec *msg.Codec
+
+	// the capabilities negotiated with the client
+	caps []string
+
 	// synchronizer for controlled shutdown of writer()
 	writerShutdown *util.Shutdown
 
@@ -72,7 +107,7 @@ func NewControl(ctx context.Context, config *config.Config, ctlConn conn.Conn, a
 		conn:            ctlConn,
 		out:             make(chan msg.Message),
 		in:              make(chan msg.Message),
-		proxies:         make(chan conn.Conn, proxyMaxPoolSize),
+		proxies:         make(chan conn.Conn, proxyMaxPoolSize.Load()),
 		lastPing:        time.Now(),
 		writerShutdown:  util.NewShutdown(),
 		readerShutdown:  util.NewShutdown(),
@@ -85,17 +120,40 @@ func NewControl(ctx context.Context, config *config.Config, ctlConn conn.Conn, a
 		ctlConn.Close()
 	}
 
-	// register the clientid
-	c.id = authMsg.ClientId
-	if c.id == "" {
-		// it's a new session, assign an ID after auth
+	// agents may authenticate with a certificate issued by the built-in CA
+	// instead of an auth token. The TLS handshake verified it already, but
+	// it may have been revoked since the connection was made.
+	var clientCert *db.ClientCert
+	if certs := conn.PeerCertificates(ctlConn); len(certs) > 0 {
+		found, err := auth.CheckClientCert(ctx, config.Database, certs[0])
+		if err != nil {
+			log.Warn("Error validating client certificate: %v", err)
+			failAuth(fmt.Errorf("Authentication error: %v", err))
+			return
+		}
+		clientCert = &found
+	} else if config.TLSClientAuth == "require" {
+		// websocket connections arrive without one
+		failAuth(fmt.Errorf("Authentication error: a client certificate is required"))
+		return
+	}
+
+	// resumed sessions authenticate like new ones, a client id alone
+	// proves nothing
+	if clientCert == nil {
 		err := auth.ValidateAuthToken(ctx, config.Database, authMsg.User)
 		if err != nil {
 			log.Warn("Error validating API key: %v", err)
 			failAuth(fmt.Errorf("Authentication error: %v\nUse `ngrok set-auth` to set an auth token.", err))
 			return
 		}
+	}
 
+	// register the clientid
+	c.id = authMsg.ClientId
+	if c.id == "" {
+		// it's a new session, assign an ID after auth
+		var err error
 		if c.id, err = util.SecureRandId(16); err != nil {
 			failAuth(err)
 			return
@@ -106,7 +164,36 @@ func NewControl(ctx context.Context, config *config.Config, ctlConn conn.Conn, a
 	ctlConn.SetType("ctl")
 	ctlConn.AddLogPrefix(c.id)
 
-	if authMsg.Version != version.Proto {
+	// resumed sessions send their token or certificate too, so look the
+	// policy up for both
+	if clientCert != nil {
+		ctlConn.Info("Authenticated as %s with client certificate %s", clientCert.Name, clientCert.Serial)
+		c.owner = "cert:" + clientCert.Name
+		if policy, err := auth.ParseConnectPolicy(clientCert.ConnectAllow); err != nil {
+			ctlConn.Warn("Invalid connect policy of client certificate %s: %v", clientCert.Serial, err)
+		} else {
+			c.connectPolicy = policy
+		}
+		if policy, err := auth.ParseDomainPolicy(clientCert.Domains); err != nil {
+			ctlConn.Warn("Invalid domain policy of client certificate %s: %v", clientCert.Serial, err)
+		} else {
+			c.domainPolicy = policy
+		}
+	} else {
+		c.owner = "token:" + authMsg.User
+		if policy, err := auth.GetConnectPolicy(ctx, config.Database, authMsg.User); err != nil {
+			ctlConn.Debug("No connect policy: %v", err)
+		} else {
+			c.connectPolicy = policy
+		}
+		if policy, err := auth.GetDomainPolicy(ctx, config.Database, authMsg.User); err != nil {
+			ctlConn.Warn("Invalid domain policy: %v", err)
+		} else {
+			c.domainPolicy = policy
+		}
+	}
+
+	if !version.Compat(authMsg.Version, version.Proto) {
 		failAuth(fmt.Errorf("Incompatible versions. Server %s, client %s. Download a new version at http://ngrok.com", version.MajorMinor(), authMsg.Version)) //TODO: Fix download url
 		return
 	}
@@ -116,14 +203,20 @@ func NewControl(ctx context.Context, config *config.Config, ctlConn conn.Conn, a
 		replaced.shutdown.WaitComplete()
 	}
 
+	// agents without capabilities keep the legacy codec
+	c.caps = msg.NegotiateCapabilities(authMsg.Capabilities)
+	c.codec = msg.CodecFor(c.caps)
+	ctlConn.Debug("Negotiated capabilities %v, using the %v codec", c.caps, c.codec)
+
 	// start the writer first so that the following messages get sent
 	go c.writer()
 
 	// Respond to authentication
 	c.out <- &msg.AuthResp{
-		Version:   version.Proto,
-		MmVersion: version.MajorMinor(),
-		ClientId:  c.id,
+		Version:      version.Proto,
+		MmVersion:    version.MajorMinor(),
+		ClientId:     c.id,
+		Capabilities: c.caps,
 	}
 
 	// As a performance optimization, ask for a proxy connection up front
@@ -163,7 +256,17 @@ func (c *Control) registerTunnel(rawTunnelReq *msg.ReqTunnel) {
 			ReqId:    rawTunnelReq.ReqId,
 		}
 
-		rawTunnelReq.Hostname = strings.Replace(t.url, proto+"://", "", 1)
+		if t.takenOver != nil {
+			t.takenOver.end(t)
+		}
+
+		// the other protocols register the same host name, each on the
+		// port it is served on
+		hostname := strings.Replace(t.url, proto+"://", "", 1)
+		if host, _, err := net.SplitHostPort(hostname); err == nil {
+			hostname = host
+		}
+		rawTunnelReq.Hostname = hostname
 	}
 }
 
@@ -182,13 +285,13 @@ func (c *Control) manager() {
 	defer c.managerShutdown.Complete()
 
 	// reaping timer for detecting heartbeat failure
-	reap := time.NewTicker(connReapInterval)
+	reap := time.NewTicker(time.Duration(connReapInterval.Load()))
 	defer reap.Stop()
 
 	for {
 		select {
 		case <-reap.C:
-			if time.Since(c.lastPing) > pingTimeoutInterval {
+			if time.Since(c.lastPing) > time.Duration(pingTimeoutInterval.Load()) {
 				c.conn.Info("Lost heartbeat")
 				c.shutdown.Begin()
 			}
@@ -227,7 +330,13 @@ func (c *Control) writer() {
 	// write messages to the control channel
 	for m := range c.out {
 		c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
-		if err := msg.WriteMsg(c.conn, m); err != nil {
+		// the peer switches codecs after reading the AuthResp
+		codec := c.codec
+		if _, ok := m.(*msg.AuthResp); ok {
+			codec = msg.Legacy
+		}
+
+		if err := codec.WriteMsg(c.conn, m); err != nil {
 			panic(err)
 		}
 	}
@@ -248,7 +357,7 @@ func (c *Control) reader() {
 
 	// read messages from the control channel
 	for {
-		if msg, err := msg.ReadMsg(c.conn); err != nil {
+		if msg, err := c.codec.ReadMsg(c.conn); err != nil {
 			if err == io.EOF {
 				c.conn.Info("EOF")
 				return
@@ -280,7 +389,10 @@ func (c *Control) stopper() {
 	c.managerShutdown.WaitComplete()
 
 	// shutdown writer()
+	c.closeLock.Lock()
+	c.closed = true
 	close(c.out)
+	c.closeLock.Unlock()
 	c.writerShutdown.WaitComplete()
 
 	// close connection fully
@@ -305,9 +417,21 @@ func (c *Control) RegisterProxy(conn conn.Conn) {
 	conn.AddLogPrefix(c.id)
 
 	conn.SetDeadline(time.Now().Add(proxyStaleDuration))
+
+	c.closeLock.RLock()
+	defer c.closeLock.RUnlock()
+	if c.closed {
+		conn.Info("Control is closing, discarding.")
+		conn.Close()
+		return
+	}
+
+	// once in the pool, the connection is another goroutine's to use and
+	// log with
+	id := conn.Id()
 	select {
 	case c.proxies <- conn:
-		conn.Info("Registered")
+		c.conn.Info("Registered proxy %s", id)
 	default:
 		conn.Info("Proxies buffer is full, discarding.")
 		conn.Close()
@@ -332,7 +456,7 @@ func (c *Control) GetProxy() (proxyConn conn.Conn, err error) {
 	default:
 		// no proxy available in the pool, ask for one over the control channel
 		c.conn.Debug("No proxy in pool, requesting proxy from control . . .")
-		if err = util.PanicToError(func() { c.out <- &msg.ReqProxy{} }); err != nil {
+		if err = c.requestProxy(); err != nil {
 			return
 		}
 
@@ -343,7 +467,7 @@ func (c *Control) GetProxy() (proxyConn conn.Conn, err error) {
 				return
 			}
 
-		case <-time.After(pingTimeoutInterval):
+		case <-time.After(time.Duration(pingTimeoutInterval.Load())):
 			err = fmt.Errorf("Timeout trying to get proxy connection")
 			return
 		}
@@ -351,6 +475,22 @@ func (c *Control) GetProxy() (proxyConn conn.Conn, err error) {
 	return
 }
 
+// Asks the client for another proxy connection
+func (c *Control) requestProxy() error {
+	c.closeLock.RLock()
+	defer c.closeLock.RUnlock()
+	if c.closed {
+		return fmt.Errorf("Control is closing")
+	}
+
+	select {
+	case c.out <- &msg.ReqProxy{}:
+		return nil
+	case <-c.shutdown.Begun():
+		return fmt.Errorf("Control is closing")
+	}
+}
+
 // Called when this control is replaced by another control
 // this can happen if the network drops out and the client reconnects
 // before the old tunnel has lost its heartbeat
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/glebarez/sqlite"
 	"github.com/google/uuid"
 	"gorm.io/driver/mysql"
@@ -16,6 +18,37 @@ type AuthToken struct {
 	ID          string `gorm:"primaryKey;size:36"`
 	AuthToken   string `gorm:"unique;not null;size:64"`
 	Description string `gorm:"not null"`
+
+	// addresses on the server's network the token may reach with
+	// connect tunnels, see auth.ParseConnectPolicy
+	ConnectAllow string `gorm:"not null;default:''"`
+
+	// base domains the token may open tunnels on, see
+	// auth.ParseDomainPolicy
+	Domains string `gorm:"not null;default:''"`
+	gorm.Model
+}
+
+// The built-in CA which issues agent certificates, see auth.LoadCA
+type CertAuthority struct {
+	ID      string `gorm:"primaryKey;size:36"`
+	CertPEM string `gorm:"not null"`
+	KeyPEM  string `gorm:"not null"`
+	gorm.Model
+}
+
+// An agent certificate issued by the built-in CA. Agents presenting it
+// authenticate as Name with the connect policy ConnectAllow and the domain
+// policy Domains.
+type ClientCert struct {
+	ID           string `gorm:"primaryKey;size:36"`
+	Serial       string `gorm:"unique;not null;size:40"`
+	Name         string `gorm:"not null"`
+	Description  string `gorm:"not null;default:''"`
+	ConnectAllow string `gorm:"not null;default:''"`
+	Domains      string `gorm:"not null;default:''"`
+	NotAfter     time.Time
+	RevokedAt    *time.Time
 	gorm.Model
 }
 
@@ -29,7 +62,7 @@ type Database struct {
 }
 
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(&AuthToken{})
+	return db.AutoMigrate(&AuthToken{}, &CertAuthority{}, &ClientCert{})
 }
 
 func (a *AuthToken) BeforeCreate(tx *gorm.DB) (err error) {
@@ -39,6 +72,20 @@ func (a *AuthToken) BeforeCreate(tx *gorm.DB) (err error) {
 	return
 }
 
+func (c *CertAuthority) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == "" {
+		c.ID = uuid.NewString()
+	}
+	return
+}
+
+func (c *ClientCert) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == "" {
+		c.ID = uuid.NewString()
+	}
+	return
+}
+
 func GetDB(db *Database) (*gorm.DB, error) {
 	switch db.Type {
 	case "sqlite":
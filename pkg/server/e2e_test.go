@@ -0,0 +1,1164 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"ngrok/pkg/client"
+	"ngrok/pkg/conn"
+	"ngrok/pkg/msg"
+	"ngrok/pkg/server/config"
+	"ngrok/pkg/server/db"
+	"ngrok/pkg/version"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// End to end tests run ngrokd and agents in process, connected over
+// loopback. The server's registries are globals, so all tests share one
+// server, see startE2EServer.
+
+const (
+	e2eDomain  = "ngrok.test"
+	e2eToken   = "e2e-token"
+	e2eTimeout = 10 * time.Second
+	e2eWsPath  = "/_ngrok/tunnel"
+)
+
+type e2eServer struct {
+	dir        string
+	config     *config.Config
+	tunnelAddr string
+}
+
+var (
+	e2eOnce sync.Once
+	e2e     *e2eServer
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if e2e != nil {
+		os.RemoveAll(e2e.dir)
+	}
+	os.Exit(code)
+}
+
+func startE2EServer(t *testing.T) *e2eServer {
+	e2eOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "ngrokd-e2e")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dbConn, err := db.GetDB(&db.Database{Type: "sqlite", File: filepath.Join(dir, "ngrokd.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.AutoMigrate(dbConn); err != nil {
+			t.Fatal(err)
+		}
+		if err = dbConn.Create(&db.AuthToken{AuthToken: e2eToken, Description: "e2e"}).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		tlsConfig, err := LoadTLSConfig("../../assets/server/tls/snakeoil.crt", "../../assets/server/tls/snakeoil.key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &config.Config{
+			TLSClientAuth:     "none",
+			Domain:            e2eDomain,
+			ProxyMaxPoolSize:  10,
+			ConnectionTimeout: 10,
+			UdpIdleTimeout:    60,
+			Database:          dbConn,
+		}
+
+		servedDomains = cfg.ServedDomains()
+		setLimits(cfg)
+		tunnelRegistry = NewTunnelRegistry(registryCacheSize, "")
+		controlRegistry = NewControlRegistry()
+		wsTunnel := &wsTunnelHandler{
+			path:   e2eWsPath,
+			handle: func(c conn.Conn) { handleTunnelConnection(context.Background(), cfg, c) },
+		}
+		listeners = map[string]*conn.Listener{
+			"http":  startHttpListener("127.0.0.1:0", nil, wsTunnel),
+			"https": startHttpListener("127.0.0.1:0", tlsConfig, wsTunnel),
+		}
+
+		tunnelListener, err := conn.Listen("127.0.0.1:0", "tun", tlsConfig, conn.ProxyNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveTunnelListener(context.Background(), cfg, "e2e", tunnelListener)
+
+		e2e = &e2eServer{dir: dir, config: cfg, tunnelAddr: tunnelListener.Addr.String()}
+	})
+
+	if e2e == nil {
+		t.Fatal("e2e server failed to start")
+	}
+	return e2e
+}
+
+// Creates an auth token, replacing the one of an earlier run of the test
+func (s *e2eServer) createToken(t *testing.T, token db.AuthToken) {
+	t.Helper()
+	if err := s.config.Database.Unscoped().Where("auth_token = ?", token.AuthToken).Delete(&db.AuthToken{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.config.Database.Create(&token).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A TCP relay between an agent and the server. Agents can't be stopped,
+// so each one connects through a relay which is closed when its test
+// ends. Tests cut its connections to simulate network failures.
+type relay struct {
+	net.Listener
+	target string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newRelay(t *testing.T, target string) *relay {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &relay{Listener: l, target: target}
+	go r.serve()
+	t.Cleanup(r.close)
+	return r
+}
+
+func (r *relay) serve() {
+	for {
+		c, err := r.Accept()
+		if err != nil {
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.target)
+		if err != nil {
+			c.Close()
+			continue
+		}
+
+		r.mu.Lock()
+		r.conns = append(r.conns, c, upstream)
+		r.mu.Unlock()
+
+		go func() {
+			io.Copy(upstream, c)
+			upstream.Close()
+		}()
+		go func() {
+			io.Copy(c, upstream)
+			c.Close()
+		}()
+	}
+}
+
+// Closes all connections, as if the network between agent and server
+// failed
+func (r *relay) cut() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.conns = nil
+}
+
+func (r *relay) close() {
+	r.Close()
+	r.cut()
+}
+
+type agent struct {
+	ctl   *client.Controller
+	relay *relay
+	done  chan struct{}
+}
+
+func startAgent(t *testing.T, s *e2eServer, token string, tunnels map[string]*client.TunnelConfiguration) *agent {
+	a := &agent{
+		ctl:   client.NewController(),
+		relay: newRelay(t, s.tunnelAddr),
+		done:  make(chan struct{}),
+	}
+
+	serverAddr := a.relay.Addr().String()
+	go func() {
+		defer close(a.done)
+		a.ctl.Run(&client.Configuration{
+			ServerAddr:  serverAddr,
+			InspectAddr: "disabled",
+			LogTo:       "stdout",
+			AuthToken:   map[string]string{serverAddr: token},
+			Tunnels:     tunnels,
+			Path:        filepath.Join(t.TempDir(), "ngrok.yaml"),
+		})
+	}()
+	return a
+}
+
+// Waits until the agent has n tunnels and returns their public urls by
+// protocol and url scheme, e.g. "http:https"
+func (a *agent) waitTunnels(t *testing.T, n int) map[string]string {
+	t.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-a.done:
+			t.Fatal("agent stopped before its tunnels were established")
+		default:
+		}
+
+		urls := make(map[string]string)
+		for _, tunnel := range a.ctl.State().GetTunnels() {
+			urls[tunnel.Protocol.GetName()+":"+strings.SplitN(tunnel.PublicUrl, ":", 2)[0]] = tunnel.PublicUrl
+		}
+		if len(urls) >= n {
+			return urls
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %d tunnels", n)
+	return nil
+}
+
+// Makes requests to tunnel urls, dialing the public listeners on loopback
+// whatever the url's host
+var e2eClient = &http.Client{
+	Timeout: e2eTimeout,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, _ := net.SplitHostPort(addr)
+			return new(net.Dialer).DialContext(ctx, network, "127.0.0.1:"+port)
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	},
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := e2eClient.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func startLocalHttp(t *testing.T) string {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s from %s", r.URL.Path, r.Host)
+	}))
+	t.Cleanup(local.Close)
+	return local.Listener.Addr().String()
+}
+
+func startLocalEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func echo(t *testing.T, url string) {
+	t.Helper()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(url, "tcp://"))
+	c, err := net.DialTimeout("tcp", "127.0.0.1:"+port, e2eTimeout)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(e2eTimeout))
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through %s: read %q, %v", url, buf, err)
+	}
+}
+
+// Waits until the public url answers with the status. Requests may fail
+// meanwhile, e.g. on proxy connections of an agent that is going away.
+func waitStatus(t *testing.T, url string, status int) {
+	t.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for time.Now().Before(deadline) {
+		if resp, err := e2eClient.Get(url); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == status {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s to answer %d", url, status)
+}
+
+func TestE2EHttpAndHttps(t *testing.T) {
+	s := startE2EServer(t)
+	localAddr := startLocalHttp(t)
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"web": {Subdomain: "web", Protocols: map[string]string{"http": localAddr, "https": localAddr}},
+	})
+	urls := a.waitTunnels(t, 2)
+
+	for _, url := range []string{urls["http:http"], urls["http:https"]} {
+		code, body := get(t, url+"/path")
+		if code != http.StatusOK || !strings.HasPrefix(body, "hello /path from web."+e2eDomain) {
+			t.Fatalf("GET %s: %d %q", url, code, body)
+		}
+	}
+
+	// unknown hosts don't reach the agent
+	host := strings.Replace(urls["http:http"], "web.", "nobody.", 1)
+	if code, _ := get(t, host); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for %s, got %d", host, code)
+	}
+}
+
+func TestE2EHttpAuth(t *testing.T) {
+	s := startE2EServer(t)
+	localAddr := startLocalHttp(t)
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"private": {Subdomain: "private", HttpAuth: "user:pass", Protocols: map[string]string{"http": localAddr}},
+	})
+	url := a.waitTunnels(t, 1)["http:http"]
+
+	if code, _ := get(t, url); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", code)
+	}
+
+	if code, _ := get(t, strings.Replace(url, "://", "://user:pass@", 1)); code != http.StatusOK {
+		t.Fatalf("expected 200 with credentials, got %d", code)
+	}
+}
+
+func TestE2ETcp(t *testing.T) {
+	s := startE2EServer(t)
+	localAddr := startLocalEcho(t)
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"echo": {Protocols: map[string]string{"tcp": localAddr}},
+	})
+	url := a.waitTunnels(t, 1)["tcp:tcp"]
+	if !strings.HasPrefix(url, "tcp://"+e2eDomain+":") {
+		t.Fatalf("unexpected tcp url %s", url)
+	}
+
+	for i := 0; i < 3; i++ {
+		echo(t, url)
+	}
+}
+
+func TestE2EAuthFailure(t *testing.T) {
+	s := startE2EServer(t)
+
+	a := startAgent(t, s, "not-a-token", map[string]*client.TunnelConfiguration{
+		"web": {Subdomain: "denied", Protocols: map[string]string{"http": "127.0.0.1:1"}},
+	})
+
+	// the agent gives up when the server rejects its token
+	select {
+	case <-a.done:
+	case <-time.After(e2eTimeout):
+		t.Fatal("agent kept running with an invalid auth token")
+	}
+
+	if tunnelRegistry.Get(fmt.Sprintf("http://denied.%s:%d", e2eDomain, listeners["http"].Addr.(*net.TCPAddr).Port)) != nil {
+		t.Fatal("tunnel registered for an agent with an invalid auth token")
+	}
+}
+
+// A minimal agent speaking the control protocol, so that tests decide when
+// it sends heartbeats
+type rawAgent struct {
+	conn.Conn
+	id string
+}
+
+func dialRawAgent(t *testing.T, s *e2eServer, clientId, token string) (*rawAgent, *msg.AuthResp) {
+	t.Helper()
+	c, err := conn.Dial(s.tunnelAddr, "ctl", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(e2eTimeout))
+
+	if err = msg.WriteMsg(c, &msg.Auth{ClientId: clientId, User: token, Version: version.Proto, MmVersion: version.MajorMinor()}); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp msg.AuthResp
+	if err = msg.ReadMsgInto(c, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &rawAgent{Conn: c, id: resp.ClientId}, &resp
+}
+
+func (a *rawAgent) reqTunnel(t *testing.T, subdomain string) string {
+	t.Helper()
+	nt := a.request(t, &msg.ReqTunnel{ReqId: "1", Protocol: "http", Subdomain: subdomain})
+	if nt.Error != "" {
+		t.Fatal(nt.Error)
+	}
+	return nt.Url
+}
+
+func (a *rawAgent) request(t *testing.T, req *msg.ReqTunnel) *msg.NewTunnel {
+	t.Helper()
+	if err := msg.WriteMsg(a, req); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		m, err := msg.ReadMsg(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nt, ok := m.(*msg.NewTunnel); ok {
+			return nt
+		}
+	}
+}
+
+// Regression: a session resuming with a client id was never asked for its
+// auth token
+func TestE2EResumeRequiresAuth(t *testing.T) {
+	s := startE2EServer(t)
+
+	_, resp := dialRawAgent(t, s, "forged-client-id", "not-a-token")
+	if resp.Error == "" {
+		t.Fatal("resumed a session with an invalid auth token")
+	}
+}
+
+// Regression: connect connections were authorized by their client id
+// alone, anyone who learned it could use the client's connect policy
+func TestE2EConnectRequiresAuth(t *testing.T) {
+	s := startE2EServer(t)
+	target := startLocalEcho(t)
+
+	s.createToken(t, db.AuthToken{AuthToken: "connect-token", Description: "connect", ConnectAllow: target})
+	a, resp := dialRawAgent(t, s, "", "connect-token")
+	if resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+
+	regConnect := func(token string) (conn.Conn, *msg.ConnectResp) {
+		t.Helper()
+		c, err := conn.Dial(s.tunnelAddr, "cnct", &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(e2eTimeout))
+
+		if err = msg.WriteMsg(c, &msg.RegConnect{ClientId: a.id, User: token, Addr: target}); err != nil {
+			t.Fatal(err)
+		}
+		var resp msg.ConnectResp
+		if err = msg.ReadMsgInto(c, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return c, &resp
+	}
+
+	// a known client id without its token, or with another valid one
+	for _, token := range []string{"", "not-a-token", e2eToken} {
+		if _, resp := regConnect(token); resp.Error == "" {
+			t.Fatalf("connected with the client id and token %q", token)
+		}
+	}
+
+	c, cnctResp := regConnect("connect-token")
+	if cnctResp.Error != "" {
+		t.Fatal(cnctResp.Error)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through the connection: read %q, %v", buf, err)
+	}
+}
+
+// Regression: a tunnel on the hostname an agent connected to over
+// websockets received the agent's connection, auth token included
+func TestE2EWebsocketPathReserved(t *testing.T) {
+	s := startE2EServer(t)
+
+	var reached atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	t.Cleanup(local.Close)
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"web": {Subdomain: "wspath", Protocols: map[string]string{"http": local.Listener.Addr().String()}},
+	})
+	url := a.waitTunnels(t, 1)["http:http"]
+
+	// the handshake is taken by ngrokd, not by the tunnel on the hostname
+	wsUrl, err := neturl.Parse(strings.Replace(url, "http://", "ws://", 1) + e2eWsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.DialTimeout("tcp", "127.0.0.1:"+wsUrl.Port(), e2eTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(e2eTimeout))
+
+	ws, resp, err := websocket.NewClient(c, wsUrl, nil, 1024, 1024)
+	if err != nil {
+		t.Fatalf("websocket handshake for %s: %v", wsUrl, err)
+	}
+	resp.Body.Close()
+
+	// and it carries an agent connection
+	if err = ws.WriteMessage(websocket.BinaryMessage, authMessage(t, e2eToken)); err != nil {
+		t.Fatal(err)
+	}
+	var received []byte
+	for !bytes.Contains(received, []byte("AuthResp")) {
+		_, p, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected an AuthResp, got %q, %v", received, err)
+		}
+		received = append(received, p...)
+	}
+	if n := reached.Load(); n != 0 {
+		t.Fatalf("the handshake reached the tunnel %d times", n)
+	}
+
+	// other requests for the path still reach the tunnel
+	if code, body := get(t, url+e2eWsPath); code != http.StatusOK || body != "hello "+e2eWsPath {
+		t.Fatalf("GET %s: %d %q", url+e2eWsPath, code, body)
+	}
+}
+
+// The framed Auth message an agent starts its control connection with
+func authMessage(t *testing.T, token string) []byte {
+	t.Helper()
+	w, r := net.Pipe()
+	go func() {
+		msg.WriteMsg(conn.Wrap(w, "test"), &msg.Auth{User: token, Version: version.Proto, MmVersion: version.MajorMinor()})
+		w.Close()
+	}()
+
+	frame, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestE2EHeartbeatLoss(t *testing.T) {
+	s := startE2EServer(t)
+
+	defer func(timeout, reap int64) {
+		pingTimeoutInterval.Store(timeout)
+		connReapInterval.Store(reap)
+	}(pingTimeoutInterval.Load(), connReapInterval.Load())
+	pingTimeoutInterval.Store(int64(time.Second))
+	connReapInterval.Store(int64(100 * time.Millisecond))
+
+	a, _ := dialRawAgent(t, s, "", e2eToken)
+	url := a.reqTunnel(t, "heartbeat")
+
+	// heartbeats keep the tunnel alive past the timeout
+	for i := 0; i < 15; i++ {
+		if err := msg.WriteMsg(a, &msg.Ping{}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second / 5)
+	}
+	if tunnelRegistry.Get(url) == nil {
+		t.Fatal("tunnel reaped although the agent sent heartbeats")
+	}
+
+	// without them the server reaps the control connection and its tunnels
+	deadline := time.Now().Add(e2eTimeout)
+	for tunnelRegistry.Get(url) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel not reaped after the agent stopped sending heartbeats")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the session resumes with the same client id and url
+	resumed, resp := dialRawAgent(t, s, a.id, e2eToken)
+	if resp.Error != "" || resumed.id != a.id {
+		t.Fatalf("failed to resume session %s: %q, got id %s", a.id, resp.Error, resumed.id)
+	}
+	if resumedUrl := resumed.reqTunnel(t, "heartbeat"); resumedUrl != url {
+		t.Fatalf("resumed session got %s instead of %s", resumedUrl, url)
+	}
+}
+
+func TestE2EReconnect(t *testing.T) {
+	s := startE2EServer(t)
+	httpAddr := startLocalHttp(t)
+	echoAddr := startLocalEcho(t)
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"web":  {Subdomain: "reconnect", Protocols: map[string]string{"http": httpAddr}},
+		"echo": {Protocols: map[string]string{"tcp": echoAddr}},
+	})
+	urls := a.waitTunnels(t, 2)
+	waitStatus(t, urls["http:http"], http.StatusOK)
+	echo(t, urls["tcp:tcp"])
+
+	// the agent's connections fail, the server tears its tunnels down
+	a.relay.cut()
+	waitStatus(t, urls["http:http"], http.StatusNotFound)
+
+	// the agent reconnects to the same urls, tcp tunnels get the port they
+	// had back
+	waitStatus(t, urls["http:http"], http.StatusOK)
+	echo(t, urls["tcp:tcp"])
+}
+
+func TestE2EDomains(t *testing.T) {
+	s := startE2EServer(t)
+
+	saved := servedDomains
+	servedDomains = []config.Domain{
+		{Name: e2eDomain},
+		{Name: "team.test", TCPHostname: "tcp.team.test", Restricted: true},
+	}
+	t.Cleanup(func() { servedDomains = saved })
+
+	s.createToken(t, db.AuthToken{AuthToken: "team-token", Description: "team", Domains: "team.test"})
+
+	port := listeners["http"].Addr.(*net.TCPAddr).Port
+	tests := []struct {
+		token string
+		req   msg.ReqTunnel
+		url   string // empty if the request must fail
+	}{
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Subdomain: "shared"}, fmt.Sprintf("http://shared.%s:%d", e2eDomain, port)},
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Subdomain: "sneaky", Domain: "team.test"}, ""},
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Hostname: "sneaky.team.test"}, ""},
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Subdomain: "nope", Domain: "unknown.test"}, ""},
+		{"team-token", msg.ReqTunnel{Protocol: "http", Subdomain: "app"}, fmt.Sprintf("http://app.team.test:%d", port)},
+		{"team-token", msg.ReqTunnel{Protocol: "http", Subdomain: "app", Domain: e2eDomain}, ""},
+		{"team-token", msg.ReqTunnel{Protocol: "tcp"}, "tcp://tcp.team.test:"},
+	}
+
+	for _, tt := range tests {
+		a, resp := dialRawAgent(t, s, "", tt.token)
+		if resp.Error != "" {
+			t.Fatal(resp.Error)
+		}
+
+		nt := a.request(t, &tt.req)
+		switch {
+		case tt.url == "" && nt.Error == "":
+			t.Fatalf("%s: %+v got %s, expected an error", tt.token, tt.req, nt.Url)
+		case tt.url != "" && !strings.HasPrefix(nt.Url, tt.url):
+			t.Fatalf("%s: %+v got %q (%s), expected %s", tt.token, tt.req, nt.Url, nt.Error, tt.url)
+		}
+		a.Close()
+	}
+}
+
+func TestE2ERoutes(t *testing.T) {
+	s := startE2EServer(t)
+
+	// local servers which tell which one answered
+	local := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.Listener.Addr().String()
+	}
+
+	// the tunnels on a hostname may come from different agents
+	var urls []string
+	for _, tunnel := range []*client.TunnelConfiguration{
+		{Subdomain: "shop", Protocols: map[string]string{"http": local("web")}},
+		{Subdomain: "shop", Path: "/api/", Protocols: map[string]string{"http": local("api")}},
+		{Subdomain: "*.feature", Protocols: map[string]string{"http": local("feature")}},
+	} {
+		a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{"routes": tunnel})
+		urls = append(urls, a.waitTunnels(t, 1)["http:http"])
+	}
+
+	port := listeners["http"].Addr.(*net.TCPAddr).Port
+	shop := fmt.Sprintf("http://shop.%s:%d", e2eDomain, port)
+	if urls[1] != shop+"/api" || urls[2] != fmt.Sprintf("http://*.feature.%s:%d", e2eDomain, port) {
+		t.Fatalf("unexpected tunnel urls %v", urls)
+	}
+
+	tests := []struct {
+		url, body string
+	}{
+		{shop + "/", "web /"},
+		{shop + "/apis", "web /apis"},
+		{shop + "/api", "api /api"},
+		{shop + "/api/users", "api /api/users"},
+		{fmt.Sprintf("http://a.feature.%s:%d/x", e2eDomain, port), "feature /x"},
+		{fmt.Sprintf("http://a.b.feature.%s:%d/", e2eDomain, port), "feature /"},
+	}
+	for _, tt := range tests {
+		if code, body := get(t, tt.url); code != http.StatusOK || body != tt.body {
+			t.Fatalf("GET %s: %d %q, expected %q", tt.url, code, body, tt.body)
+		}
+	}
+
+	// wildcards don't match their own domain
+	if code, _ := get(t, fmt.Sprintf("http://feature.%s:%d/", e2eDomain, port)); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for feature.%s, got %d", e2eDomain, code)
+	}
+
+	// a kept alive connection still reaches the right tunnel for each request
+	keepAlive := &http.Client{Transport: e2eClient.Transport.(*http.Transport).Clone()}
+	keepAlive.Transport.(*http.Transport).DisableKeepAlives = false
+	for _, tt := range []struct{ path, body string }{{"/api", "api /api"}, {"/", "web /"}, {"/api/x", "api /api/x"}} {
+		resp, err := keepAlive.Get(shop + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.body {
+			t.Fatalf("GET %s over a kept alive connection: %q, expected %q", tt.path, body, tt.body)
+		}
+	}
+
+	// other accounts can't add routes to the hostname
+	s.createToken(t, db.AuthToken{AuthToken: "routes-token", Description: "routes"})
+	for _, req := range []msg.ReqTunnel{
+		{Protocol: "http", Subdomain: "shop", Path: "/admin"},
+		{Protocol: "http", Subdomain: "*"},
+		{Protocol: "http", Hostname: "*.*.example.com"},
+	} {
+		a, resp := dialRawAgent(t, s, "", "routes-token")
+		if resp.Error != "" {
+			t.Fatal(resp.Error)
+		}
+		if nt := a.request(t, &req); nt.Error == "" {
+			t.Fatalf("%+v got %s, expected an error", req, nt.Url)
+		}
+		a.Close()
+	}
+
+	// the admin API shows the route table
+	rec := httptest.NewRecorder()
+	getRoutes(rec, httptest.NewRequest("GET", "/routes", nil))
+	for _, url := range urls {
+		if !strings.Contains(rec.Body.String(), fmt.Sprintf("%q", url)) {
+			t.Fatalf("route %s missing from %s", url, rec.Body.String())
+		}
+	}
+}
+
+func TestE2EPool(t *testing.T) {
+	s := startE2EServer(t)
+
+	local := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.Listener.Addr().String()
+	}
+
+	var agents []*agent
+	var urls []string
+	for _, name := range []string{"one", "two"} {
+		a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+			"pool": {Subdomain: "pooled", Group: "backends", Protocols: map[string]string{"http": local(name)}},
+		})
+		agents = append(agents, a)
+		urls = append(urls, a.waitTunnels(t, 1)["http:http"])
+	}
+	if urls[0] != urls[1] {
+		t.Fatalf("pooled tunnels got different urls %v", urls)
+	}
+
+	// connections are balanced across the agents
+	served := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		code, body := get(t, urls[0])
+		if code != http.StatusOK {
+			t.Fatalf("GET %s: %d %q", urls[0], code, body)
+		}
+		served[body]++
+	}
+	if served["one"] != 3 || served["two"] != 3 {
+		t.Fatalf("connections weren't balanced: %v", served)
+	}
+
+	// tunnels outside the group or of other accounts can't take the url
+	s.createToken(t, db.AuthToken{AuthToken: "pool-token", Description: "pool"})
+	for _, tt := range []struct {
+		token string
+		req   msg.ReqTunnel
+	}{
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Subdomain: "pooled"}},
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Subdomain: "pooled", Group: "others"}},
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Subdomain: "pooled", Group: "backends", HttpAuth: "user:pass"}},
+		{e2eToken, msg.ReqTunnel{Protocol: "http", Group: "backends"}},
+		{"pool-token", msg.ReqTunnel{Protocol: "http", Subdomain: "pooled", Group: "backends"}},
+	} {
+		a, resp := dialRawAgent(t, s, "", tt.token)
+		if resp.Error != "" {
+			t.Fatal(resp.Error)
+		}
+		if nt := a.request(t, &tt.req); nt.Error == "" {
+			t.Fatalf("%s: %+v got %s, expected an error", tt.token, tt.req, nt.Url)
+		}
+		a.Close()
+	}
+
+	// losing an agent leaves the url to the other one
+	agents[0].relay.close()
+	deadline := time.Now().Add(e2eTimeout)
+	for tunnelRegistry.Get(urls[0]).pool.size() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("lost agent wasn't removed from the pool")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if code, body := get(t, urls[0]); code != http.StatusOK || body != "two" {
+			t.Fatalf("GET %s after losing an agent: %d %q", urls[0], code, body)
+		}
+	}
+}
+
+func TestE2EProxyProtocol(t *testing.T) {
+	s := startE2EServer(t)
+
+	defer publicProxyMode.Store(publicProxyMode.Load())
+	publicProxyMode.Store(int64(conn.ProxyRequire))
+
+	// a local service which answers with the client address the agent's
+	// PROXY protocol header tells
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				lc := conn.Wrap(c, "prv")
+				if err := conn.ReadProxyHeader(lc, conn.ProxyRequire); err != nil {
+					fmt.Fprintf(c, "error: %v\n", err)
+					return
+				}
+				fmt.Fprintf(c, "%s\n", lc.RemoteAddr())
+			}()
+		}
+	}()
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"proxied": {ProxyProtocol: true, Protocols: map[string]string{"tcp": l.Addr().String()}},
+	})
+	url := a.waitTunnels(t, 1)["tcp:tcp"]
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(url, "tcp://"))
+
+	dial := func(header string) string {
+		c, err := net.DialTimeout("tcp", "127.0.0.1:"+port, e2eTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(e2eTimeout))
+
+		c.Write([]byte(header))
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	// the load balancer's header reaches the local service
+	if got := dial("PROXY TCP4 203.0.113.7 127.0.0.1 40000 " + port + "\r\n"); got != "203.0.113.7:40000" {
+		t.Fatalf("local service saw client %q, expected 203.0.113.7:40000", got)
+	}
+
+	// connections without a header are rejected
+	if got := dial("hello\n"); got != "" {
+		t.Fatalf("connection without a PROXY protocol header got %q", got)
+	}
+}
+
+func TestE2ETcpPorts(t *testing.T) {
+	s := startE2EServer(t)
+
+	// a pool of two ports that were free a moment ago
+	var ports []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		ports = append(ports, port)
+		l.Close()
+	}
+	saved := tunnelPorts.Load()
+	t.Cleanup(func() { tunnelPorts.Store(saved) })
+	tunnelPorts.Store(newPortPool("127.0.0.1", strings.Join(ports, ","), ""))
+
+	request := func(req msg.ReqTunnel) *msg.NewTunnel {
+		a, resp := dialRawAgent(t, s, "", e2eToken)
+		if resp.Error != "" {
+			t.Fatal(resp.Error)
+		}
+		t.Cleanup(func() { a.Close() })
+		return a.request(t, &req)
+	}
+
+	// ports outside the pool are refused with the reason
+	if nt := request(msg.ReqTunnel{Protocol: "tcp", RemotePort: 1}); !strings.Contains(nt.Error, "not available for tunnels") {
+		t.Fatalf("port outside of the pool: got %q (%s)", nt.Url, nt.Error)
+	}
+
+	// the others get the pool's ports until none is left
+	got := make(map[string]bool)
+	for i := 0; i < len(ports); i++ {
+		nt := request(msg.ReqTunnel{Protocol: "tcp"})
+		if nt.Error != "" {
+			t.Fatal(nt.Error)
+		}
+		_, port, _ := net.SplitHostPort(strings.TrimPrefix(nt.Url, "tcp://"))
+		got[port] = true
+	}
+	if !got[ports[0]] || !got[ports[1]] {
+		t.Fatalf("tunnels got ports %v, expected %v", got, ports)
+	}
+	if nt := request(msg.ReqTunnel{Protocol: "tcp"}); !strings.Contains(nt.Error, "No free port") {
+		t.Fatalf("exhausted pool: got %q (%s)", nt.Url, nt.Error)
+	}
+}
+
+func TestE2EErrorPages(t *testing.T) {
+	s := startE2EServer(t)
+	localAddr := startLocalHttp(t)
+
+	// a local service that is gone
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"limited":  {Subdomain: "limited", Protocols: map[string]string{"http": localAddr}},
+		"down":     {Subdomain: "down", Protocols: map[string]string{"http": closedAddr}},
+		"password": {Subdomain: "password", HttpAuth: "user:pass", Protocols: map[string]string{"http": localAddr}},
+	})
+	a.waitTunnels(t, 1)
+	port := listeners["http"].Addr.(*net.TCPAddr).Port
+	url := func(subdomain string) string {
+		return fmt.Sprintf("http://%s.%s:%d/", subdomain, e2eDomain, port)
+	}
+	waitStatus(t, url("limited"), http.StatusOK)
+	waitStatus(t, url("down"), http.StatusBadGateway)
+	waitStatus(t, url("password"), http.StatusUnauthorized)
+
+	fetch := func(url, accept string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := e2eClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	for _, tt := range []struct {
+		url    string
+		status int
+		code   string
+	}{
+		{url("nobody"), http.StatusNotFound, errTunnelNotFound.code},
+		{url("down"), http.StatusBadGateway, errUpstreamUnreachable.code},
+		{url("password"), http.StatusUnauthorized, errAuthRequired.code},
+	} {
+		// browsers get the HTML page
+		resp, body := fetch(tt.url, "text/html,application/xhtml+xml,*/*;q=0.8")
+		id := resp.Header.Get("Ngrok-Request-Id")
+		if resp.StatusCode != tt.status || resp.Header.Get("Ngrok-Error-Code") != tt.code || id == "" {
+			t.Fatalf("GET %s: %d %v", tt.url, resp.StatusCode, resp.Header)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(body, tt.code) || !strings.Contains(body, id) {
+			t.Fatalf("GET %s: HTML page %q", tt.url, body)
+		}
+
+		// JSON clients a problem
+		resp, body = fetch(tt.url, "application/json")
+		var problem errorProblem
+		if err := json.Unmarshal([]byte(body), &problem); err != nil || resp.Header.Get("Content-Type") != "application/problem+json" {
+			t.Fatalf("GET %s: JSON problem %q: %v", tt.url, body, err)
+		}
+		if problem.Status != tt.status || problem.Code != tt.code || problem.RequestId == "" || problem.RequestId == id {
+			t.Fatalf("GET %s: problem %+v", tt.url, problem)
+		}
+	}
+
+	// error pages may be overridden
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tunnel-not-found.html"), []byte("custom {{ .Code }} {{ .Host }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pages, err := loadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorPages.Store(pages)
+	defer errorPages.Store(nil)
+
+	host := fmt.Sprintf("nobody.%s:%d", e2eDomain, port)
+	if _, body := fetch(url("nobody"), "text/html"); body != "custom "+errTunnelNotFound.code+" "+host {
+		t.Fatalf("overridden page %q", body)
+	}
+	if _, body := fetch(url("down"), "text/html"); !strings.Contains(body, "<!DOCTYPE html>") {
+		t.Fatalf("built-in page replaced: %q", body)
+	}
+
+	// tunnels over the rate limit
+	tunnelRateLimit.Store(2)
+	defer tunnelRateLimit.Store(0)
+	limited := 0
+	for i := 0; i < 5; i++ {
+		if resp, _ := fetch(url("limited"), "*/*"); resp.StatusCode == http.StatusTooManyRequests {
+			if resp.Header.Get("Retry-After") == "" {
+				t.Fatalf("rate limited without Retry-After: %v", resp.Header)
+			}
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Fatal("no request was rate limited")
+	}
+}
+
+func TestE2EHold(t *testing.T) {
+	s := startE2EServer(t)
+
+	defer holdSettings.Store(holdSettings.Load())
+	holdSettings.Store(&holdLimits{timeout: e2eTimeout, maxRequests: 10, maxBytes: 1 << 20, retryAfter: 7 * time.Second})
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	}))
+	t.Cleanup(local.Close)
+
+	a := startAgent(t, s, e2eToken, map[string]*client.TunnelConfiguration{
+		"hooks": {Subdomain: "hooks", Hold: true, Protocols: map[string]string{"http": local.Listener.Addr().String()}},
+	})
+	url := a.waitTunnels(t, 1)["http:http"]
+	waitStatus(t, url, http.StatusOK)
+
+	waitHeld := func() {
+		t.Helper()
+		deadline := time.Now().Add(e2eTimeout)
+		for tunnel := tunnelRegistry.Get(url); tunnel == nil || tunnel.hold.Load() == nil; tunnel = tunnelRegistry.Get(url) {
+			if time.Now().After(deadline) {
+				t.Fatal("tunnel wasn't held after its agent was lost")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// requests sent while the agent is gone are delivered once it's back
+	a.relay.cut()
+	waitHeld()
+	resp, err := e2eClient.Post(url, "text/plain", strings.NewReader("held"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "POST held" {
+		t.Fatalf("held request: %d %q", resp.StatusCode, body)
+	}
+
+	// agents which don't come back in time leave 503s and release the url
+	holdSettings.Store(&holdLimits{timeout: 500 * time.Millisecond, maxRequests: 10, maxBytes: 1 << 20, retryAfter: 7 * time.Second})
+	a.relay.close()
+	waitHeld()
+	resp, err = e2eClient.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "7" || resp.Header.Get("Ngrok-Error-Code") != errAgentOffline.code {
+		t.Fatalf("expired hold: %d %v", resp.StatusCode, resp.Header)
+	}
+	waitStatus(t, url, http.StatusNotFound)
+}
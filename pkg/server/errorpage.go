@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"ngrok/pkg/conn"
+	"ngrok/pkg/server/assets"
+	"ngrok/pkg/server/log"
+	"ngrok/pkg/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The errors ngrokd answers public http requests with when it can't pass
+// them on to a local service
+type errorKind struct {
+	// the template overriding the page is <name>.html in error_pages_dir
+	name   string
+	status int
+	code   string
+	title  string
+}
+
+var (
+	errTunnelNotFound      = &errorKind{"tunnel-not-found", http.StatusNotFound, "ERR_NGROKD_3200", "Tunnel not found"}
+	errAuthRequired        = &errorKind{"auth-required", http.StatusUnauthorized, "ERR_NGROKD_3201", "Authentication required"}
+	errRateLimited         = &errorKind{"rate-limited", http.StatusTooManyRequests, "ERR_NGROKD_3202", "Too many requests"}
+	errAgentOffline        = &errorKind{"agent-offline", http.StatusServiceUnavailable, "ERR_NGROKD_3203", "Agent offline"}
+	errUpstreamUnreachable = &errorKind{"upstream-unreachable", http.StatusBadGateway, "ERR_NGROKD_3204", "Upstream unreachable"}
+	errBadRequest          = &errorKind{"bad-request", http.StatusBadRequest, "ERR_NGROKD_3205", "Bad request"}
+
+	errorKinds = []*errorKind{errTunnelNotFound, errAuthRequired, errRateLimited, errAgentOffline, errUpstreamUnreachable, errBadRequest}
+)
+
+// The error page templates, see loadErrorPages
+var errorPages atomic.Pointer[errorTemplates]
+
+// The built-in page of every error
+var defaultErrorPage = template.Must(template.New("error.html").Parse(string(assets.MustAsset("assets/server/errors/error.html"))))
+
+type errorTemplates struct {
+	// by errorKind name, the ones without a template of their own use the
+	// default
+	pages    map[string]*template.Template
+	fallback *template.Template
+}
+
+// Loads the error pages of error_pages_dir: error.html replaces the
+// built-in page of every error and <name>.html, e.g. tunnel-not-found.html,
+// the page of one. The built-in page is used for the others.
+func loadErrorPages(dir string) (*errorTemplates, error) {
+	t := &errorTemplates{pages: make(map[string]*template.Template), fallback: defaultErrorPage}
+	if dir == "" {
+		return t, nil
+	}
+
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("Error pages path %s is not a directory", dir)
+	}
+
+	load := func(name string) (*template.Template, error) {
+		path := filepath.Join(dir, name+".html")
+		content, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return template.New(name).Parse(string(content))
+	}
+
+	fallback, err := load("error")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load error page: %v", err)
+	} else if fallback != nil {
+		t.fallback = fallback
+	}
+
+	for _, kind := range errorKinds {
+		page, err := load(kind.name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load error page %s: %v", kind.name, err)
+		} else if page != nil {
+			t.pages[kind.name] = page
+		}
+	}
+	return t, nil
+}
+
+func (t *errorTemplates) page(kind *errorKind) *template.Template {
+	if t == nil {
+		return defaultErrorPage
+	}
+	if page, ok := t.pages[kind.name]; ok {
+		return page
+	}
+	return t.fallback
+}
+
+// What the error pages tell about the public request they answer
+type publicRequest struct {
+	// unique, also logged with the error so that operators can find it
+	id     string
+	host   string
+	accept string
+}
+
+func newPublicRequest(host, accept string) *publicRequest {
+	return &publicRequest{id: util.RandId(8), host: host, accept: accept}
+}
+
+// The data of the error page templates
+type errorPage struct {
+	Status     int
+	StatusText string
+	Code       string
+	Title      string
+	Detail     string
+	Host       string
+	RequestId  string
+}
+
+// An RFC 9457 problem, the error page of JSON clients
+type errorProblem struct {
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Code      string `json:"error_code"`
+	RequestId string `json:"request_id"`
+}
+
+// Answers req on c with the error page of kind, or a JSON problem if the
+// request's Accept header prefers JSON to HTML. The response asks to close
+// the connection, which the caller does.
+func writeErrorPage(c conn.Conn, req *publicRequest, kind *errorKind, detail string) {
+	c.Info("Request %s failed with %s: %s", req.id, kind.code, detail)
+
+	page := errorPage{
+		Status:     kind.status,
+		StatusText: http.StatusText(kind.status),
+		Code:       kind.code,
+		Title:      kind.title,
+		Detail:     detail,
+		Host:       req.host,
+		RequestId:  req.id,
+	}
+
+	header := make(http.Header)
+	header.Set("Ngrok-Error-Code", kind.code)
+	header.Set("Ngrok-Request-Id", req.id)
+	switch kind {
+	case errAuthRequired:
+		header.Set("WWW-Authenticate", `Basic realm="ngrok"`)
+	case errRateLimited:
+		header.Set("Retry-After", "1")
+	case errAgentOffline:
+		if limits := holdSettings.Load(); limits != nil && limits.retryAfter > 0 {
+			header.Set("Retry-After", strconv.Itoa(int(limits.retryAfter.Seconds())))
+		}
+	}
+
+	var body bytes.Buffer
+	if prefersJSON(req.accept) {
+		header.Set("Content-Type", "application/problem+json")
+		json.NewEncoder(&body).Encode(&errorProblem{
+			Title:     page.Title,
+			Status:    page.Status,
+			Detail:    page.Detail,
+			Code:      page.Code,
+			RequestId: page.RequestId,
+		})
+	} else {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		if err := errorPages.Load().page(kind).Execute(&body, &page); err != nil {
+			log.Error("Failed to render error page %s, using the built-in one: %v", kind.name, err)
+			body.Reset()
+			defaultErrorPage.Execute(&body, &page)
+		}
+	}
+
+	resp := &http.Response{
+		StatusCode:    kind.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+	}
+	if err := resp.Write(c); err != nil {
+		c.Debug("Failed to write error page: %v", err)
+	}
+}
+
+// Whether JSON ranks higher than HTML among the media types of an Accept
+// header. Wildcards don't count, so that e.g. curl gets HTML.
+func prefersJSON(accept string) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/json", "application/problem+json":
+			jsonQ = max(jsonQ, q)
+		case "text/html", "application/xhtml+xml":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"ngrok/pkg/server/auth"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How long the readiness checks may take before they count as failed
+const readinessTimeout = 2 * time.Second
+
+// Number of tunnel listeners accepting control and proxy connections
+var servingTunnelListeners atomic.Int32
+
+// The health endpoint. /livez only tells that ngrokd is running, /readyz
+// that it can serve agents: its database answers and a tunnel listener is
+// accepting connections. /status is kept for existing probes.
+func healthHandler(handler *auth.Handler, db *gorm.DB) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, nil)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, readinessChecks(r.Context(), db))
+	})
+	mux.HandleFunc("/status", handler.Health)
+	return mux
+}
+
+// Runs the readiness checks, mapping each one to its error or "OK"
+func readinessChecks(ctx context.Context, db *gorm.DB) map[string]string {
+	checks := map[string]string{
+		"database":        "OK",
+		"tunnel_listener": "OK",
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	if sqlDB, err := db.DB(); err != nil {
+		checks["database"] = err.Error()
+	} else if err := sqlDB.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+	}
+
+	if servingTunnelListeners.Load() == 0 {
+		checks["tunnel_listener"] = "not accepting connections"
+	}
+
+	return checks
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]string) {
+	status, code := "OK", http.StatusOK
+	for _, result := range checks {
+		if result != "OK" {
+			status, code = "Unavailable", http.StatusServiceUnavailable
+		}
+	}
+
+	body := map[string]interface{}{"status": status}
+	if checks != nil {
+		body["checks"] = checks
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"ngrok/pkg/conn"
+	"ngrok/pkg/server/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// see setLimits
+var holdSettings atomic.Pointer[holdLimits]
+
+// How tunnels with hold queue requests while their agent is gone
+type holdLimits struct {
+	// 0 disables holding
+	timeout     time.Duration
+	maxRequests int
+	maxBytes    int64
+
+	// of the 503 answering the requests that couldn't be delivered
+	retryAfter time.Duration
+}
+
+func newHoldLimits(c *config.Config) *holdLimits {
+	return &holdLimits{
+		timeout:     time.Duration(c.HoldTimeout) * time.Second,
+		maxRequests: c.HoldMaxRequests,
+		maxBytes:    int64(c.HoldMaxBytes),
+		retryAfter:  time.Duration(c.HoldRetryAfter) * time.Second,
+	}
+}
+
+// The hold of a tunnel which lost its agent: the url stays registered and
+// public requests are queued until a tunnel of the same account takes the
+// url over, usually because the agent reconnected, or the hold times out.
+type tunnelHold struct {
+	sync.Mutex
+	requests int
+	bytes    int64
+
+	// closed when the hold ends, next is then the tunnel which took over
+	// or nil if the hold timed out
+	done  chan struct{}
+	next  *Tunnel
+	timer *time.Timer
+}
+
+// Whether the tunnel is held rather than removed when its agent is gone
+func (t *Tunnel) holds() bool {
+	limits := holdSettings.Load()
+	return t.req.Hold && t.pool == nil && limits != nil && limits.timeout > 0
+}
+
+// Starts holding the tunnel, its url is released when the hold times out
+func (t *Tunnel) startHold() {
+	timeout := holdSettings.Load().timeout
+	t.Info("Holding the url for %s until the agent reconnects", timeout)
+
+	h := &tunnelHold{done: make(chan struct{})}
+	h.timer = time.AfterFunc(timeout, func() {
+		if h.end(nil) {
+			t.Info("Agent didn't reconnect, releasing the url")
+			tunnelRegistry.Del(t.url, t)
+		}
+	})
+	t.hold.Store(h)
+}
+
+// Ends the hold, handing the queued requests to next. Returns false if it
+// had ended already.
+func (h *tunnelHold) end(next *Tunnel) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	select {
+	case <-h.done:
+		return false
+	default:
+	}
+
+	h.timer.Stop()
+	h.next = next
+	close(h.done)
+	return true
+}
+
+// Reads the request publicConn starts with and waits until the hold ends.
+// Returns the tunnel which took over and a connection to hand it, which
+// replays the bytes that were read. The request leaves the queue when this
+// returns, whether it is delivered or not.
+func (h *tunnelHold) wait(publicConn conn.Conn, limits *holdLimits) (*Tunnel, conn.Conn, error) {
+	h.Lock()
+	full := h.requests >= limits.maxRequests
+	if !full {
+		h.requests++
+	}
+	h.Unlock()
+	if full {
+		return nil, nil, fmt.Errorf("Already holding %d requests", limits.maxRequests)
+	}
+
+	var held int64
+	defer func() {
+		h.Lock()
+		h.requests--
+		h.bytes -= held
+		h.Unlock()
+	}()
+
+	// the whole request is read, so that its size counts towards the
+	// limit while it is queued
+	var read bytes.Buffer
+	publicConn.SetReadDeadline(time.Now().Add(connReadTimeout))
+	r := bufio.NewReader(io.TeeReader(io.LimitReader(publicConn, limits.maxBytes+1), &read))
+	req, err := http.ReadRequest(r)
+	if err == nil {
+		_, err = io.Copy(io.Discard, req.Body)
+	}
+	switch {
+	case int64(read.Len()) > limits.maxBytes:
+		return nil, nil, fmt.Errorf("Request is larger than %d bytes", limits.maxBytes)
+	case err != nil:
+		return nil, nil, fmt.Errorf("Failed to read request: %v", err)
+	}
+	publicConn.SetReadDeadline(time.Time{})
+
+	h.Lock()
+	full = h.bytes+int64(read.Len()) > limits.maxBytes
+	if !full {
+		held = int64(read.Len())
+		h.bytes += held
+	}
+	h.Unlock()
+	if full {
+		return nil, nil, fmt.Errorf("Already holding %d bytes of requests", limits.maxBytes)
+	}
+
+	<-h.done
+	if h.next == nil {
+		return nil, nil, fmt.Errorf("Agent didn't reconnect in time")
+	}
+	return h.next, conn.WithReader(publicConn, io.MultiReader(&read, publicConn)), nil
+}
+
+// Queues publicConn's request until the agent of the held tunnel is back,
+// then hands it to the tunnel which took over the url
+func (t *Tunnel) handleHeld(h *tunnelHold, publicConn conn.Conn, req *publicRequest) {
+	publicConn.Info("Holding request %s until the agent reconnects", req.id)
+	next, replayConn, err := h.wait(publicConn, holdSettings.Load())
+	if err != nil {
+		publicConn.Warn("Giving up on held request %s: %v", req.id, err)
+		writeErrorPage(publicConn, req, errAgentOffline, fmt.Sprintf("The agent of tunnel %s is not connected.", req.host))
+		return
+	}
+
+	publicConn.Info("Delivering held request %s", req.id)
+	next.HandlePublicConnection(replayConn, req)
+}
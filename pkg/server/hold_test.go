@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"ngrok/pkg/conn"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits in the hold for the request written by send
+func waitHeld(t *testing.T, h *tunnelHold, limits *holdLimits, send string) error {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write([]byte(send))
+		client.Close()
+	}()
+
+	_, _, err := h.wait(conn.Wrap(server, "pub"), limits)
+	return err
+}
+
+func TestHoldReleasesSlots(t *testing.T) {
+	limits := &holdLimits{timeout: time.Minute, maxRequests: 1, maxBytes: 100}
+	h := &tunnelHold{done: make(chan struct{}), timer: time.NewTimer(time.Minute)}
+
+	released := func() {
+		t.Helper()
+		h.Lock()
+		defer h.Unlock()
+		if h.requests != 0 || h.bytes != 0 {
+			t.Fatalf("holding %d requests of %d bytes", h.requests, h.bytes)
+		}
+	}
+
+	// requests which can't be held give their slot back
+	if err := waitHeld(t, h, limits, "GET / HTTP/1.1\r\nHost: a.test\r\n"+strings.Repeat("X-Pad: 1\r\n", 20)+"\r\n"); err == nil {
+		t.Fatal("oversized request held")
+	}
+	released()
+
+	if err := waitHeld(t, h, limits, "not http\r\n\r\n"); err == nil {
+		t.Fatal("malformed request held")
+	}
+	released()
+
+	// and so do the requests of a hold that times out
+	result := make(chan error)
+	go func() { result <- waitHeld(t, h, limits, "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n") }()
+	for {
+		h.Lock()
+		queued := h.bytes > 0
+		h.Unlock()
+		if queued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is full meanwhile
+	if err := waitHeld(t, h, limits, "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"); err == nil || !strings.Contains(err.Error(), "1 requests") {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+
+	h.end(nil)
+	if err := <-result; err == nil {
+		t.Fatal("request delivered after the hold timed out")
+	}
+	released()
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net/http"
+	"path"
 
 	vhost "github.com/inconshreveable/go-vhost"
 
@@ -13,32 +18,39 @@ import (
 	"time"
 )
 
-const (
-	NotAuthorized = `HTTP/1.0 401 Not Authorized
-WWW-Authenticate: Basic realm="ngrok"
-Content-Length: 23
-
-Authorization required
-`
-
-	NotFound = `HTTP/1.0 404 Not Found
-Content-Length: %d
+// Accepts control and proxy connections carried over websockets on the
+// public http(s) listeners
+type wsTunnelHandler struct {
+	path   string
+	handle func(conn.Conn)
+}
 
-Tunnel %s not found
-`
+// Whether a request is a websocket handshake for the tunnel path, which
+// is reserved on every hostname
+func (h *wsTunnelHandler) matches(req *http.Request) bool {
+	return h != nil && req.URL.Path == h.path && strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
 
-	BadRequest = `HTTP/1.0 400 Bad Request
-Content-Length: 12
+// Completes the websocket handshake and hands the connection off, returns
+// whether it did
+func (h *wsTunnelHandler) serve(c conn.Conn) bool {
+	wsConn, err := conn.AcceptWebsocket(c, "tun")
+	if err != nil {
+		c.Warn("Failed websocket handshake for tunnel connection: %v", err)
+		return false
+	}
 
-Bad Request
-`
-)
+	// handleTunnelConnection sets its own deadlines
+	wsConn.SetDeadline(time.Time{})
+	go h.handle(wsConn)
+	return true
+}
 
 // Listens for new http(s) connections from the public internet
-func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener) {
+func startHttpListener(addr string, tlsCfg *tls.Config, wsTunnel *wsTunnelHandler) (listener *conn.Listener) {
 	// bind/listen for incoming connections
 	var err error
-	if listener, err = conn.Listen(addr, "pub", tlsCfg); err != nil {
+	if listener, err = conn.Listen(addr, "pub", tlsCfg, conn.ProxyMode(publicProxyMode.Load())); err != nil {
 		panic(err)
 	}
 
@@ -50,7 +62,7 @@ func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener
 	log.Info("Listening for public %s connections on %v", proto, listener.Addr.String())
 	go func() {
 		for conn := range listener.Conns {
-			go httpHandler(conn, proto)
+			go httpHandler(conn, proto, wsTunnel)
 		}
 	}()
 
@@ -58,8 +70,14 @@ func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener
 }
 
 // Handles a new http connection from the public internet
-func httpHandler(c conn.Conn, proto string) {
-	defer c.Close()
+func httpHandler(c conn.Conn, proto string, wsTunnel *wsTunnelHandler) {
+	// tunnel connections outlive the handler
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			c.Close()
+		}
+	}()
 	defer func() {
 		// recover from failures
 		if r := recover(); r != nil {
@@ -74,13 +92,17 @@ func httpHandler(c conn.Conn, proto string) {
 	vhostConn, err := vhost.HTTP(c)
 	if err != nil {
 		c.Warn("Failed to read valid %s request: %v", proto, err)
-		c.Write([]byte(BadRequest))
+		writeErrorPage(c, newPublicRequest("", ""), errBadRequest, "The request could not be read.")
 		return
 	}
 
 	// read out the Host header and auth from the request
 	host := strings.ToLower(vhostConn.Host())
 	auth := vhostConn.Request.Header.Get("Authorization")
+	isWsTunnel := wsTunnel.matches(vhostConn.Request)
+	isUpgrade := vhostConn.Request.Header.Get("Upgrade") != ""
+	reqPath := path.Clean("/" + vhostConn.Request.URL.Path)
+	req := newPublicRequest(host, vhostConn.Request.Header.Get("Accept"))
 
 	// done reading mux data, free up the request memory
 	vhostConn.Free()
@@ -88,12 +110,24 @@ func httpHandler(c conn.Conn, proto string) {
 	// We need to read from the vhost conn now since it mucked around reading the stream
 	c = conn.Wrap(vhostConn, "pub")
 
+	// agent connections take precedence over tunnels, which must not
+	// receive the auth tokens in them
+	if isWsTunnel {
+		handedOff = wsTunnel.serve(c)
+		return
+	}
+
 	// multiplex to find the right backend host
 	c.Debug("Found hostname %s in request", host)
-	tunnel := tunnelRegistry.Get(fmt.Sprintf("%s://%s", proto, host))
+	tunnel, pathRouted := tunnelRegistry.Route(proto, host, reqPath)
 	if tunnel == nil {
 		c.Info("No tunnel found for hostname %s", host)
-		c.Write([]byte(fmt.Sprintf(NotFound, len(host)+18, host)))
+		writeErrorPage(c, req, errTunnelNotFound, fmt.Sprintf("Tunnel %s not found.", host))
+		return
+	}
+
+	if !tunnel.limiter.allow(tunnelRateLimit.Load()) {
+		writeErrorPage(c, req, errRateLimited, fmt.Sprintf("Tunnel %s received too many requests, try again shortly.", host))
 		return
 	}
 
@@ -102,13 +136,49 @@ func httpHandler(c conn.Conn, proto string) {
 	// request with basic authdeny the request
 	if tunnel.req.HttpAuth != "" && auth != tunnel.req.HttpAuth {
 		c.Info("Authentication failed: %s", auth)
-		c.Write([]byte(NotAuthorized))
+		writeErrorPage(c, req, errAuthRequired, fmt.Sprintf("Tunnel %s requires http basic authentication.", host))
 		return
 	}
 
+	// the next request on this connection could belong to another tunnel,
+	// upgraded connections don't carry any
+	if pathRouted && !isUpgrade {
+		if c, err = closeAfterRequest(c); err != nil {
+			c.Warn("Failed to read %s request: %v", proto, err)
+			return
+		}
+	}
+
 	// dead connections will now be handled by tunnel heartbeating and the client
 	c.SetDeadline(time.Time{})
 
 	// let the tunnel handle the connection now
-	tunnel.HandlePublicConnection(c)
+	tunnel.HandlePublicConnection(c, req)
+}
+
+// Hostnames with path routes are routed by the first request of a
+// connection, so it may only carry that one: the request is rewritten to
+// ask the local server to close the connection after its response.
+func closeAfterRequest(c conn.Conn) (conn.Conn, error) {
+	r := bufio.NewReader(c)
+	var head bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return c, err
+		}
+
+		if strings.TrimRight(line, "\r\n") == "" {
+			head.WriteString("Connection: close\r\n")
+			head.WriteString(line)
+			return conn.WithReader(c, io.MultiReader(&head, r)), nil
+		}
+
+		// keep-alive requests would otherwise keep the connection open
+		name, _, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Connection") || strings.EqualFold(name, "Keep-Alive") {
+			continue
+		}
+		head.WriteString(line)
+	}
 }
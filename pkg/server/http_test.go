@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"ngrok/pkg/conn"
+	"ngrok/pkg/msg"
+	"testing"
+	"time"
+)
+
+// A public connection which sends a request and records the response
+type requestConn struct {
+	rd io.Reader
+	wr bytes.Buffer
+}
+
+func (c *requestConn) Read(p []byte) (int, error)         { return c.rd.Read(p) }
+func (c *requestConn) Write(p []byte) (int, error)        { return c.wr.Write(p) }
+func (c *requestConn) Close() error                       { return nil }
+func (c *requestConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *requestConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *requestConn) SetDeadline(t time.Time) error      { return nil }
+func (c *requestConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *requestConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func FuzzHttpHandler(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: unknown.ngrok.test\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: auth.ngrok.test\r\nAuthorization: Basic Zm9vOmJhcg==\r\n\r\n"))
+	f.Add([]byte("GET /_ngrok/tunnel HTTP/1.1\r\nHost: ngrok.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.0\r\n\r\n"))
+	f.Add([]byte("\x16\x03\x01\x00\x05hello"))
+
+	if tunnelRegistry == nil {
+		tunnelRegistry = NewTunnelRegistry(registryCacheSize, "")
+	}
+	tunnelRegistry.Register("http://auth.ngrok.test", &Tunnel{req: &msg.ReqTunnel{HttpAuth: "Basic c2VjcmV0"}})
+
+	wsTunnel := &wsTunnelHandler{path: "/_ngrok/tunnel", handle: func(c conn.Conn) { c.Close() }}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := &requestConn{rd: bytes.NewReader(data)}
+		httpHandler(conn.Wrap(c, "pub"), "http", wsTunnel)
+
+		if resp := c.wr.Bytes(); len(resp) > 0 && !bytes.HasPrefix(resp, []byte("HTTP/1.")) {
+			t.Fatalf("wrote a response which isn't HTTP: %q", resp)
+		}
+	})
+}
@@ -11,30 +11,38 @@ var root log.Logger = make(log.Logger)
 func LogTo(level_name string) {
 	writer := log.NewConsoleLogWriter()
 	if writer != nil {
-		var level = log.DEBUG
-
-		switch level_name {
-		case "FINEST":
-			level = log.FINEST
-		case "FINE":
-			level = log.FINE
-		case "DEBUG":
-			level = log.DEBUG
-		case "TRACE":
-			level = log.TRACE
-		case "INFO":
-			level = log.INFO
-		case "WARNING":
-			level = log.WARNING
-		case "ERROR":
-			level = log.ERROR
-		case "CRITICAL":
-			level = log.CRITICAL
-		default:
-			level = log.DEBUG
-		}
-
-		root.AddFilter("log", level, writer)
+		root.AddFilter("log", parseLevel(level_name), writer)
+	}
+}
+
+// Changes the level of the log set up by LogTo, e.g. on a configuration
+// reload
+func SetLevel(level_name string) {
+	if filter, ok := root["log"]; ok {
+		filter.Level = parseLevel(level_name)
+	}
+}
+
+func parseLevel(level_name string) log.Level {
+	switch level_name {
+	case "FINEST":
+		return log.FINEST
+	case "FINE":
+		return log.FINE
+	case "DEBUG":
+		return log.DEBUG
+	case "TRACE":
+		return log.TRACE
+	case "INFO":
+		return log.INFO
+	case "WARNING":
+		return log.WARNING
+	case "ERROR":
+		return log.ERROR
+	case "CRITICAL":
+		return log.CRITICAL
+	default:
+		return log.DEBUG
 	}
 }
 
@@ -12,7 +12,10 @@ import (
 	log "ngrok/pkg/server/log"
 	"ngrok/pkg/util"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -26,6 +29,10 @@ var (
 	tunnelRegistry  *TunnelRegistry
 	controlRegistry *ControlRegistry
 
+	// how long agents have to send their first message, a time.Duration,
+	// see setLimits
+	connectionTimeout atomic.Int64
+
 	// XXX: kill these global variables - they're only used in tunnel.go for constructing forwarding URLs
 	listeners map[string]*conn.Listener
 )
@@ -59,30 +66,45 @@ func NewProxy(config *config.Config, pxyConn conn.Conn, regPxy *msg.RegProxy) {
 // TLS and running all connections over the same port, we can bust through
 // restrictive firewalls.
 func tunnelListener(ctx context.Context, config *config.Config, addr string, tlsConfig *tls.Config) {
-	listener, err := conn.Listen(addr, "tun", tlsConfig)
+	listener, err := conn.Listen(addr, "tun", tlsConfig, conn.ProxyNone)
 	if err != nil {
 		log.Error("Fatal error: failed to start listener on %s: %v", addr, err)
 		panic(err)
 	}
 
 	log.Info("Listening for control and proxy connections on %s", listener.Addr.String())
-	stopCh := make(chan struct{})
-
-	go func() {
-		<-ctx.Done() // Wait for shutdown signal
-		log.Info("Shutting down tunnel listener on %s", addr)
-		go func() {
-			for c := range listener.Conns { // close each channel individually
-				c.Warn("Server shutting down, closing connection %v", c.RemoteAddr())
-				_ = c.Close()
-			}
-		}()
-	}()
+	serveTunnelListener(ctx, config, addr, listener)
+}
+
+// Listen for control and proxy connections carried as streams of QUIC
+// sessions. Clients fall back to tunnelListener when UDP is blocked.
+func quicTunnelListener(ctx context.Context, config *config.Config, addr string, tlsConfig *tls.Config) {
+	listener, err := conn.ListenQuic(ctx, addr, "tun", tlsConfig)
+	if err != nil {
+		log.Error("Fatal error: failed to start QUIC listener on %s: %v", addr, err)
+		panic(err)
+	}
+
+	log.Info("Listening for QUIC control and proxy connections on %s", listener.Addr.String())
+	serveTunnelListener(ctx, config, addr, listener)
+}
+
+// Serves the listener until ctx is done. ngrokd isn't ready while none of
+// its tunnel listeners is serving, see readinessChecks.
+func serveTunnelListener(ctx context.Context, config *config.Config, addr string, listener *conn.Listener) {
+	servingTunnelListeners.Add(1)
+	defer servingTunnelListeners.Add(-1)
 
 	for {
 		select {
-		case <-stopCh:
-			log.Info("Tunnel listener stopped: %s", addr)
+		case <-ctx.Done():
+			log.Info("Shutting down tunnel listener on %s", addr)
+			go func() {
+				for c := range listener.Conns { // close each channel individually
+					c.Warn("Server shutting down, closing connection %v", c.RemoteAddr())
+					_ = c.Close()
+				}
+			}()
 			return
 		case c, ok := <-listener.Conns:
 			if !ok {
@@ -104,7 +126,7 @@ func handleTunnelConnection(ctx context.Context, config *config.Config, tunnelCo
 	}()
 
 	// Set an initial read deadline
-	tunnelConn.SetReadDeadline(time.Now().Add(connReadTimeout))
+	tunnelConn.SetReadDeadline(time.Now().Add(time.Duration(connectionTimeout.Load())))
 
 	log.Info("handleTunnelConnection: reading message")
 	// Read a message from the tunnel connection
@@ -129,18 +151,24 @@ func handleTunnelConnection(ctx context.Context, config *config.Config, tunnelCo
 	case *msg.RegProxy:
 		NewProxy(config, tunnelConn, m)
 
+	case *msg.RegConnect:
+		NewConnect(ctx, config, tunnelConn, m)
+
 	default:
 		tunnelConn.Close()
 	}
 }
 
 func Main() {
-	ctx := context.Background()
+	// ngrokd shuts down gracefully on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// parse options
 	config := config.InitConfig()
 
-	servingDomain = config.Domain
-	proxyMaxPoolSize = config.ProxyMaxPoolSize
+	servedDomains = config.ServedDomains()
+	setLimits(config)
 
 	// init logging
 	log.LogTo(config.LogLevel)
@@ -160,51 +188,104 @@ func Main() {
 	listeners = make(map[string]*conn.Listener)
 
 	// load tls configuration
-	tlsConfig, err := LoadTLSConfig(config.TLSCert, config.TLSKey)
+	certs, err := newCertStore(config.TLSCert, config.TLSKey, config.ServedDomains())
 	if err != nil {
 		panic(err)
 	}
+	tlsConfig := certs.TLSConfig()
+
+	// load the error pages of public http requests
+	pages, err := loadErrorPages(config.ErrorPagesDir)
+	if err != nil {
+		panic(err)
+	}
+	errorPages.Store(pages)
+
+	// control and proxy connections may also arrive as websockets on the
+	// public listeners, for clients behind L7 load balancers and firewalls
+	var wsTunnel *wsTunnelHandler
+	if config.TunnelWsPath != "" {
+		wsTunnel = &wsTunnelHandler{
+			path:   config.TunnelWsPath,
+			handle: func(c conn.Conn) { handleTunnelConnection(ctx, config, c) },
+		}
+	}
+
+	// behind an L4 load balancer, public connections tell the address of
+	// their client in a PROXY protocol header
+	proxyMode, err := conn.ParseProxyMode(config.ProxyProtocol)
+	if err != nil {
+		panic(err)
+	}
+	publicProxyMode.Store(int64(proxyMode))
 
 	// listen for http
 	if config.HttpAddr != "" {
-		listeners["http"] = startHttpListener(config.HttpAddr, nil)
+		listeners["http"] = startHttpListener(config.HttpAddr, nil, wsTunnel)
 	}
 
 	// listen for https
 	if config.HttpsAddr != "" {
-		listeners["https"] = startHttpListener(config.HttpsAddr, tlsConfig)
+		listeners["https"] = startHttpListener(config.HttpsAddr, tlsConfig, wsTunnel)
+	}
+
+	// the built-in CA issues agent certificates, which the tunnel listeners
+	// accept instead of auth tokens
+	ca, err := auth.LoadCA(ctx, config.Database)
+	if err != nil {
+		panic(err)
 	}
 
-	handler := auth.Handler{Config: config}
+	tunnelTLSConfig, err := ClientAuthTLSConfig(tlsConfig, config.TLSClientAuth, ca, config.Database)
+	if err != nil {
+		panic(err)
+	}
+
+	// admin, health and metrics each get their own listener, so that
+	// exposing one of them doesn't expose the others
+	handler := auth.Handler{Config: config, CA: ca}
+	var opsServers []*http.Server
+
 	if config.AdminAddr != "" {
-		// Admin endpoint
-		go func() {
-			http.HandleFunc("/", handler.HomePage)
-			http.HandleFunc("/keys", handler.GetAPIKeys)
-			http.HandleFunc("/add", handler.AddAPIKey)
-			http.HandleFunc("/del", handler.RemoveAPIKey)
-			http.HandleFunc("/static/", handler.ServeStaticFiles)
-
-			log.Info("Starting Web Admin endpoint on %s", config.AdminAddr)
-			if err := http.ListenAndServe(config.AdminAddr, nil); err != nil {
-				log.Error("Failed to start status server: %v", err)
-				os.Exit(1)
-			}
-		}()
+		adminTLSConfig, err := AdminTLSConfig(config.AdminTLSCert, config.AdminTLSKey, config.AdminClientCA)
+		if err != nil {
+			panic(err)
+		}
+
+		srv := newOpsServer(config.AdminAddr, adminHandler(&handler))
+		srv.TLSConfig = adminTLSConfig
+		serveOps("Web Admin", srv)
+		opsServers = append(opsServers, srv)
 	}
 
 	if config.HealthAddr != "" {
-		go func() {
-			http.HandleFunc("/status", handler.Health)
-			log.Info("Starting health endpoint on %s", config.HealthAddr)
-			if err := http.ListenAndServe(config.HealthAddr, nil); err != nil {
-				log.Error("Failed to start status server: %v", err)
-				os.Exit(1)
-			}
-		}()
+		srv := newOpsServer(config.HealthAddr, healthHandler(&handler, config.Database))
+		serveOps("health", srv)
+		opsServers = append(opsServers, srv)
 	}
 
-	// ngrok clients
-	tunnelListener(ctx, config, config.TunnelAddr, tlsConfig)
+	if config.MetricsAddr != "" {
+		srv := newOpsServer(config.MetricsAddr, metricsHandler())
+		serveOps("metrics", srv)
+		opsServers = append(opsServers, srv)
+	}
 
+	go reloadOnHangup(ctx, config, certs)
+
+	// ngrok clients
+	if config.TunnelQuicAddr != "" {
+		go quicTunnelListener(ctx, config, config.TunnelQuicAddr, tunnelTLSConfig)
+	}
+	tunnelListener(ctx, config, config.TunnelAddr, tunnelTLSConfig)
+
+	// the tunnel listeners stopped, give in-flight admin, health and
+	// metrics requests time to finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opsShutdownTimeout)
+	defer cancel()
+	for _, srv := range opsServers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Warn("Failed to shut down endpoint on %s: %v", srv.Addr, err)
+		}
+	}
+	log.Info("ngrokd stopped")
 }
@@ -44,6 +44,7 @@ type LocalMetrics struct {
 
 	tunnelMeter        gometrics.Meter
 	tcpTunnelMeter     gometrics.Meter
+	udpTunnelMeter     gometrics.Meter
 	httpTunnelMeter    gometrics.Meter
 	connMeter          gometrics.Meter
 	lostHeartbeatMeter gometrics.Meter
@@ -71,6 +72,7 @@ func NewLocalMetrics(reportInterval time.Duration) *LocalMetrics {
 
 		tunnelMeter:        gometrics.NewMeter(),
 		tcpTunnelMeter:     gometrics.NewMeter(),
+		udpTunnelMeter:     gometrics.NewMeter(),
 		httpTunnelMeter:    gometrics.NewMeter(),
 		connMeter:          gometrics.NewMeter(),
 		lostHeartbeatMeter: gometrics.NewMeter(),
@@ -109,6 +111,8 @@ func (m *LocalMetrics) OpenTunnel(t *Tunnel) {
 	switch t.req.Protocol {
 	case "tcp":
 		m.tcpTunnelMeter.Mark(1)
+	case "udp":
+		m.udpTunnelMeter.Mark(1)
 	case "http":
 		m.httpTunnelMeter.Mark(1)
 	}
@@ -131,21 +135,7 @@ func (m *LocalMetrics) Report() {
 
 	for {
 		time.Sleep(m.reportInterval)
-		buffer, err := json.Marshal(map[string]interface{}{
-			"windows":               m.windowsCounter.Count(),
-			"linux":                 m.linuxCounter.Count(),
-			"osx":                   m.osxCounter.Count(),
-			"other":                 m.otherCounter.Count(),
-			"httpTunnelMeter.count": m.httpTunnelMeter.Count(),
-			"tcpTunnelMeter.count":  m.tcpTunnelMeter.Count(),
-			"tunnelMeter.count":     m.tunnelMeter.Count(),
-			"tunnelMeter.m1":        m.tunnelMeter.Rate1(),
-			"connMeter.count":       m.connMeter.Count(),
-			"connMeter.m1":          m.connMeter.Rate1(),
-			"bytesIn.count":         m.bytesInCount.Count(),
-			"bytesOut.count":        m.bytesOutCount.Count(),
-		})
-
+		buffer, err := json.Marshal(m.values())
 		if err != nil {
 			m.Error("Failed to serialize metrics: %v", err)
 			continue
@@ -155,6 +145,51 @@ func (m *LocalMetrics) Report() {
 	}
 }
 
+func (m *LocalMetrics) values() map[string]interface{} {
+	return map[string]interface{}{
+		"windows":               m.windowsCounter.Count(),
+		"linux":                 m.linuxCounter.Count(),
+		"osx":                   m.osxCounter.Count(),
+		"other":                 m.otherCounter.Count(),
+		"httpTunnelMeter.count": m.httpTunnelMeter.Count(),
+		"tcpTunnelMeter.count":  m.tcpTunnelMeter.Count(),
+		"udpTunnelMeter.count":  m.udpTunnelMeter.Count(),
+		"tunnelMeter.count":     m.tunnelMeter.Count(),
+		"tunnelMeter.m1":        m.tunnelMeter.Rate1(),
+		"connMeter.count":       m.connMeter.Count(),
+		"connMeter.m1":          m.connMeter.Rate1(),
+		"bytesIn.count":         m.bytesInCount.Count(),
+		"bytesOut.count":        m.bytesOutCount.Count(),
+	}
+}
+
+// Serves the reported values as JSON, along with the number of tunnels and
+// control connections currently registered
+func (m *LocalMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	values := m.values()
+	values["tunnels"] = tunnelRegistry.Count()
+	values["controls"] = controlRegistry.Count()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(values)
+}
+
+// The metrics endpoint. Metrics sent to Keen IO aren't kept locally, so it
+// only serves them with the local reporter.
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		local, ok := metrics.(*LocalMetrics)
+		if !ok {
+			http.Error(w, "Metrics are reported to Keen IO", http.StatusNotFound)
+			return
+		}
+		local.ServeHTTP(w, r)
+	})
+	return mux
+}
+
 type KeenIoMetric struct {
 	Collection string
 	Event      interface{}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A pooled tunnel group: the tunnels of one account which asked for the
+// same url with the same group label. They share the url and public
+// connections are balanced across them.
+type tunnelPool struct {
+	group string
+
+	sync.Mutex
+	members []*Tunnel
+
+	// where the round-robin among equally busy members continues
+	next int
+}
+
+func newTunnelPool(t *Tunnel) *tunnelPool {
+	return &tunnelPool{group: t.req.Group, members: []*Tunnel{t}}
+}
+
+// Whether t may join the pool, the members must not differ in anything
+// that is checked before a public connection reaches one of them
+func (p *tunnelPool) accepts(t *Tunnel) error {
+	p.Lock()
+	defer p.Unlock()
+
+	first := p.members[0]
+	switch {
+	case t.req.Group != p.group:
+		return fmt.Errorf("The tunnel %s is already registered.", first.url)
+	case t.owner() != first.owner():
+		return fmt.Errorf("The tunnel %s is already registered by another account.", first.url)
+	case t.req.HttpAuth != first.req.HttpAuth:
+		return fmt.Errorf("The tunnels of pool %s must have the same http auth.", p.group)
+	}
+	return nil
+}
+
+func (p *tunnelPool) add(t *Tunnel) {
+	p.Lock()
+	defer p.Unlock()
+	p.members = append(p.members, t)
+}
+
+// Removes t from the pool, returns a remaining member or nil if t was the
+// last one
+func (p *tunnelPool) remove(t *Tunnel) *Tunnel {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, m := range p.members {
+		if m == t {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+
+	if len(p.members) == 0 {
+		return nil
+	}
+	return p.members[0]
+}
+
+func (p *tunnelPool) size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.members)
+}
+
+// The client ids of the members
+func (p *tunnelPool) clientIds() (ids []string) {
+	p.Lock()
+	defer p.Unlock()
+	for _, m := range p.members {
+		if m.ctl != nil {
+			ids = append(ids, m.ctl.id)
+		}
+	}
+	return
+}
+
+// Picks the member with the fewest active connections, going round-robin
+// among equally busy ones. Members in tried are skipped, and ones that
+// failed to provide a proxy connection recently are only picked when no
+// other one is left.
+func (p *tunnelPool) pick(tried map[*Tunnel]bool) *Tunnel {
+	p.Lock()
+	defer p.Unlock()
+
+	n := len(p.members)
+	recent := time.Now().Add(-time.Duration(pingTimeoutInterval.Load())).UnixNano()
+	for _, skipFailed := range []bool{true, false} {
+		picked := -1
+		for i := 0; i < n; i++ {
+			j := (p.next + i) % n
+			m := p.members[j]
+			if tried[m] || (skipFailed && m.failedAt.Load() > recent) {
+				continue
+			}
+			if picked < 0 || m.active.Load() < p.members[picked].active.Load() {
+				picked = j
+			}
+		}
+
+		if picked >= 0 {
+			p.next = (picked + 1) % n
+			return p.members[picked]
+		}
+	}
+	return nil
+}
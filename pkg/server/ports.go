@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"iter"
+	"math/rand"
+	"net"
+	"ngrok/pkg/server/config"
+	"sync/atomic"
+)
+
+// How many ports a tunnel tries to bind before giving up
+const maxPortAttempts = 64
+
+// The ports tcp and udp tunnels may listen on, see setLimits
+var tunnelPorts atomic.Pointer[portPool]
+
+type portPool struct {
+	// the IP tunnels listen on
+	bindIP net.IP
+
+	// empty for any port
+	ranges   config.PortRanges
+	excluded config.PortRanges
+}
+
+// The pool of the tcp_bind_addr, tcp_port_range and tcp_excluded_ports
+// settings, which config.Load validated
+func newPortPool(bindAddr, ranges, excluded string) *portPool {
+	p := &portPool{bindIP: net.ParseIP(bindAddr)}
+	p.ranges, _ = config.ParsePortRanges(ranges)
+	p.excluded, _ = config.ParsePortRanges(excluded)
+	return p
+}
+
+// Whether a tunnel may listen on port
+func (p *portPool) allows(port int) bool {
+	return (len(p.ranges) == 0 || p.ranges.Contains(port)) && !p.excluded.Contains(port)
+}
+
+// The ports tried for a tunnel that didn't ask for one: up to
+// maxPortAttempts of the pool's, going up from a random one. 0 stands for
+// a port the OS picks, in pools of any port.
+func (p *portPool) random() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		n := p.ranges.Count()
+		if n == 0 {
+			for i := 0; i < maxPortAttempts; i++ {
+				if !yield(0) {
+					return
+				}
+			}
+			return
+		}
+
+		start, tried := rand.Intn(n), 0
+		for i := 0; i < n && tried < maxPortAttempts; i++ {
+			port := p.ranges.Nth((start + i) % n)
+			if p.excluded.Contains(port) {
+				continue
+			}
+
+			tried++
+			if !yield(port) {
+				return
+			}
+		}
+	}
+}
+
+func (p *portPool) String() string {
+	s := "any port"
+	if len(p.ranges) > 0 {
+		s = p.ranges.String()
+	}
+	if len(p.excluded) > 0 {
+		s += " except " + p.excluded.String()
+	}
+	return fmt.Sprintf("%s on %s", s, p.bindIP)
+}
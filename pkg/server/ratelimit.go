@@ -0,0 +1,44 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Public http connections per second each tunnel accepts, 0 for no limit,
+// see setLimits
+var tunnelRateLimit atomic.Int64
+
+// A token bucket which refills at limit tokens per second and holds at most
+// limit of them, so that a tunnel may take a second's worth of connections
+// at once
+type rateLimiter struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Takes a token if there is one
+func (l *rateLimiter) allow(limit int64) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(limit)
+	} else {
+		l.tokens = min(float64(limit), l.tokens+now.Sub(l.last).Seconds()*float64(limit))
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -6,6 +6,8 @@ import (
 	"net"
 	"ngrok/pkg/cache"
 	"ngrok/pkg/server/log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,7 +24,12 @@ func (url cacheUrl) Size() int {
 
 // TunnelRegistry maps a tunnel URL to Tunnel structures
 type TunnelRegistry struct {
-	tunnels  map[string]*Tunnel
+	tunnels map[string]*Tunnel
+
+	// the http(s) tunnels by proto://host and then path prefix, "" for
+	// the tunnel serving the whole hostname
+	routes map[string]map[string]*Tunnel
+
 	affinity *cache.LRUCache
 	log.Logger
 	sync.RWMutex
@@ -31,6 +38,7 @@ type TunnelRegistry struct {
 func NewTunnelRegistry(cacheSize uint64, cacheFile string) *TunnelRegistry {
 	registry := &TunnelRegistry{
 		tunnels:  make(map[string]*Tunnel),
+		routes:   make(map[string]map[string]*Tunnel),
 		affinity: cache.NewLRUCache(cacheSize),
 		Logger:   log.NewPrefixLogger("registry", "tun"),
 	}
@@ -76,13 +84,55 @@ func (r *TunnelRegistry) SaveCacheThread(path string, interval time.Duration) {
 }
 
 // Register a tunnel with a specific url, returns an error
-// if a tunnel is already registered at that url
+// if a tunnel is already registered at that url, unless both
+// are of the same pooled tunnel group, see tunnelPool, or the
+// registered one is held, see tunnelHold
 func (r *TunnelRegistry) Register(url string, t *Tunnel) error {
 	r.Lock()
 	defer r.Unlock()
 
-	if r.tunnels[url] != nil {
-		return fmt.Errorf("The tunnel %s is already registered.", url)
+	if other := r.tunnels[url]; other != nil {
+		// a held tunnel leaves its url, and later its queued requests, to
+		// a tunnel of the same account, usually of its reconnected client
+		if h := other.hold.Load(); h != nil && other.owner() == t.owner() && t.req.Group == "" {
+			r.tunnels[url] = t
+			if host, path, ok := splitRoute(url); ok {
+				r.routes[host][path] = t
+			}
+			t.takenOver = h
+			r.Info("Tunnel %s took over the held url", url)
+			return nil
+		}
+
+		if other.pool == nil || t.req.Group == "" {
+			return fmt.Errorf("The tunnel %s is already registered.", url)
+		}
+		if err := other.pool.accepts(t); err != nil {
+			return err
+		}
+
+		other.pool.add(t)
+		t.pool = other.pool
+		r.Info("Tunnel %s joined pool %s of %d tunnels", url, t.pool.group, t.pool.size())
+		return nil
+	}
+
+	if t.req.Group != "" {
+		t.pool = newTunnelPool(t)
+	}
+
+	// the tunnels on a hostname may come from different clients, but only
+	// from ones of the same account
+	if host, path, ok := splitRoute(url); ok {
+		for _, other := range r.routes[host] {
+			if other.owner() != t.owner() {
+				return fmt.Errorf("The hostname %s is already used by another account.", strings.SplitN(host, "://", 2)[1])
+			}
+		}
+		if r.routes[host] == nil {
+			r.routes[host] = make(map[string]*Tunnel)
+		}
+		r.routes[host][path] = t
 	}
 
 	r.tunnels[url] = t
@@ -92,11 +142,19 @@ func (r *TunnelRegistry) Register(url string, t *Tunnel) error {
 }
 
 func (r *TunnelRegistry) cacheKeys(t *Tunnel) (ip string, id string) {
-	clientIp := t.ctl.conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	// control connections arrive over TCP or QUIC, so the address may be
+	// a *net.TCPAddr or a *net.UDPAddr
+	clientIp, _, _ := net.SplitHostPort(t.ctl.conn.RemoteAddr().String())
 	clientId := t.ctl.id
 
-	ipKey := fmt.Sprintf("client-ip-%s:%s", t.req.Protocol, clientIp)
-	idKey := fmt.Sprintf("client-id-%s:%s", t.req.Protocol, clientId)
+	// a url is only reused on the same domain
+	var domain string
+	if t.domain != nil {
+		domain = t.domain.Name
+	}
+
+	ipKey := fmt.Sprintf("client-ip-%s-%s:%s", t.req.Protocol, domain, clientIp)
+	idKey := fmt.Sprintf("client-id-%s-%s:%s", t.req.Protocol, domain, clientId)
 	return ipKey, idKey
 }
 
@@ -116,6 +174,30 @@ func (r *TunnelRegistry) GetCachedRegistration(t *Tunnel) (url string) {
 	return
 }
 
+// The affinity cache key of a tcp or udp port
+func portCacheKey(proto string, port int) string {
+	return fmt.Sprintf("port-%s:%d", proto, port)
+}
+
+// Reserves the port a tcp or udp tunnel listens on for its client, so that
+// other clients only get it when no other port of the pool is free. Like
+// urls, reservations are kept in the affinity cache and survive restarts
+// if it's saved to a file.
+func (r *TunnelRegistry) ReservePort(proto string, port int, t *Tunnel) {
+	_, idCacheKey := r.cacheKeys(t)
+	r.affinity.Set(portCacheKey(proto, port), cacheUrl(idCacheKey))
+}
+
+// Whether the port is reserved for another client than t's
+func (r *TunnelRegistry) PortReservedByOther(proto string, port int, t *Tunnel) bool {
+	v, ok := r.affinity.Get(portCacheKey(proto, port))
+	if !ok {
+		return false
+	}
+	_, idCacheKey := r.cacheKeys(t)
+	return string(v.(cacheUrl)) != idCacheKey
+}
+
 func (r *TunnelRegistry) RegisterAndCache(url string, t *Tunnel) (err error) {
 	if err = r.Register(url, t); err == nil {
 		// we successfully assigned a url, cache it
@@ -150,10 +232,38 @@ func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, t *Tunnel) (string,
 	return "", fmt.Errorf("Failed to assign a URL after %d attempts!", maxAttempts)
 }
 
-func (r *TunnelRegistry) Del(url string) {
+// Removes the tunnel t registered at url. A pooled tunnel leaves its pool,
+// the url stays registered to the other tunnels of the pool.
+func (r *TunnelRegistry) Del(url string, t *Tunnel) {
 	r.Lock()
 	defer r.Unlock()
+
+	var next *Tunnel
+	if t.pool != nil {
+		next = t.pool.remove(t)
+	}
+
+	// the url may be registered to another tunnel if t failed to register
+	if r.tunnels[url] != t {
+		return
+	}
+
+	if next != nil {
+		r.tunnels[url] = next
+		if host, path, ok := splitRoute(url); ok {
+			r.routes[host][path] = next
+		}
+		return
+	}
+
 	delete(r.tunnels, url)
+
+	if host, path, ok := splitRoute(url); ok {
+		delete(r.routes[host], path)
+		if len(r.routes[host]) == 0 {
+			delete(r.routes, host)
+		}
+	}
 }
 
 func (r *TunnelRegistry) Get(url string) *Tunnel {
@@ -162,6 +272,144 @@ func (r *TunnelRegistry) Get(url string) *Tunnel {
 	return r.tunnels[url]
 }
 
+func (r *TunnelRegistry) Count() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.tunnels)
+}
+
+// Finds the tunnel serving a request for path on host, which includes the
+// port if it isn't the default one. The exact hostname wins over wildcard
+// ones, the closest wildcard over the others, and on a hostname the
+// longest path prefix does. Also returns whether the hostnames looked at
+// have path routes, so that the next request on the same connection could
+// belong to another tunnel.
+func (r *TunnelRegistry) Route(proto, host, path string) (t *Tunnel, pathRouted bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, h := range routeHosts(host) {
+		paths := r.routes[proto+"://"+h]
+		if paths == nil {
+			continue
+		}
+
+		pathRouted = pathRouted || len(paths) > 1 || paths[""] == nil
+		if t = longestPrefix(paths, path); t != nil {
+			return
+		}
+	}
+	return nil, pathRouted
+}
+
+// A route of the public http(s) listeners
+type Route struct {
+	Url      string    `json:"url"`
+	Protocol string    `json:"protocol"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Wildcard bool      `json:"wildcard"`
+	ClientId string    `json:"client_id"`
+	Opened   time.Time `json:"opened"`
+
+	// for pooled tunnels, the group and the client ids of its tunnels
+	Group   string   `json:"group,omitempty"`
+	Members []string `json:"members,omitempty"`
+}
+
+// The route table, by hostname and then longest path prefix first
+func (r *TunnelRegistry) Routes() []Route {
+	r.RLock()
+	defer r.RUnlock()
+
+	routes := make([]Route, 0, len(r.routes))
+	for key, paths := range r.routes {
+		proto, host, _ := strings.Cut(key, "://")
+		for path, t := range paths {
+			route := Route{
+				Url:      key + path,
+				Protocol: proto,
+				Host:     host,
+				Path:     path,
+				Wildcard: strings.HasPrefix(host, "*."),
+				Opened:   t.start,
+			}
+			if route.Path == "" {
+				route.Path = "/"
+			}
+			if t.ctl != nil {
+				route.ClientId = t.ctl.id
+			}
+			if t.pool != nil {
+				route.Group, route.Members = t.pool.group, t.pool.clientIds()
+			}
+			routes = append(routes, route)
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return len(a.Path) > len(b.Path) || (len(a.Path) == len(b.Path) && a.Path < b.Path)
+	})
+	return routes
+}
+
+// Splits an http(s) tunnel url into its proto://host and path prefix, ok
+// is false for the urls of other protocols
+func splitRoute(url string) (host, path string, ok bool) {
+	proto, rest, found := strings.Cut(url, "://")
+	if !found || (proto != "http" && proto != "https") {
+		return "", "", false
+	}
+
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return proto + "://" + rest[:i], rest[i:], true
+	}
+	return url, "", true
+}
+
+// The hostnames whose tunnels may serve host, most specific first: host
+// itself, then the wildcards of its parent domains
+// (a.b.example.com: *.b.example.com, *.example.com, *.com)
+func routeHosts(host string) []string {
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, ":"+p
+	}
+
+	hosts := []string{host}
+	for rest := name; ; {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		rest = rest[i+1:]
+		hosts = append(hosts, "*."+rest+port)
+	}
+	return hosts
+}
+
+// The tunnel of the longest prefix of path, which only matches whole path
+// segments: /api matches /api and /api/users but not /apis
+func longestPrefix(paths map[string]*Tunnel, path string) (found *Tunnel) {
+	longest := -1
+	for prefix, t := range paths {
+		if len(prefix) <= longest {
+			continue
+		}
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			found, longest = t, len(prefix)
+		}
+	}
+	return
+}
+
 // ControlRegistry maps a client ID to Control structures
 type ControlRegistry struct {
 	controls map[string]*Control
@@ -182,6 +430,12 @@ func (r *ControlRegistry) Get(clientId string) *Control {
 	return r.controls[clientId]
 }
 
+func (r *ControlRegistry) Count() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.controls)
+}
+
 func (r *ControlRegistry) Add(clientId string, ctl *Control) (oldCtl *Control) {
 	r.Lock()
 	defer r.Unlock()
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"ngrok/pkg/server/config"
+	log "ngrok/pkg/server/log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Sets the settings which new controls, tunnels and connections read when
+// they start, so that a reload changes them without dropping any tunnel
+func setLimits(config *config.Config) {
+	proxyMaxPoolSize.Store(int64(config.ProxyMaxPoolSize))
+	udpIdleTimeout.Store(int64(time.Duration(config.UdpIdleTimeout) * time.Second))
+	connectionTimeout.Store(int64(time.Duration(config.ConnectionTimeout) * time.Second))
+	tunnelRateLimit.Store(int64(config.TunnelRateLimit))
+	holdSettings.Store(newHoldLimits(config))
+	tunnelPorts.Store(newPortPool(config.TCPBindAddr, config.TCPPortRange, config.TCPExcludedPorts))
+}
+
+// Reloads the configuration on SIGHUP. The TLS certificates, log level,
+// limits, tunnel ports and error pages take effect immediately. The other
+// settings, e.g. the listener addresses or the database, are only logged
+// if they changed since the last configuration applied, they need a
+// restart. A configuration that fails to load, certificates and error
+// pages included, is ignored entirely.
+func reloadOnHangup(ctx context.Context, config *config.Config, certs *certStore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		log.Info("Reloading configuration")
+		next, err := config.Reload()
+		if err != nil {
+			log.Error("Failed to reload configuration, keeping the current one: %v", err)
+			continue
+		}
+
+		loaded, err := newCertStore(next.TLSCert, next.TLSKey, next.ServedDomains())
+		if err != nil {
+			log.Error("Failed to load TLS certificate, keeping the current configuration: %v", err)
+			continue
+		}
+
+		pages, err := loadErrorPages(next.ErrorPagesDir)
+		if err != nil {
+			log.Error("Failed to load error pages, keeping the current configuration: %v", err)
+			continue
+		}
+
+		log.SetLevel(next.LogLevel)
+		setLimits(next)
+		certs.replace(loaded)
+		errorPages.Store(pages)
+
+		for _, key := range config.RestartRequired(next) {
+			log.Warn("Setting %s changed, it takes effect on restart", key)
+		}
+		log.Info("Reloaded configuration: %s", next)
+		config = next
+	}
+}
@@ -1,12 +1,110 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"ngrok/pkg/server/assets"
+	"ngrok/pkg/server/auth"
+	"ngrok/pkg/server/config"
 	"os"
+	"strings"
+	"sync/atomic"
+
+	"gorm.io/gorm"
 )
 
 func LoadTLSConfig(crtPath string, keyPath string) (tlsConfig *tls.Config, err error) {
+	certs, err := newCertStore(crtPath, keyPath, nil)
+	if err != nil {
+		return
+	}
+
+	return certs.TLSConfig(), nil
+}
+
+// Holds the certificates of the https and tunnel listeners, so that they
+// can be replaced on reload without restarting them
+type certStore struct {
+	cert    atomic.Pointer[tls.Certificate]
+	domains atomic.Pointer[[]domainCert]
+}
+
+// The certificate of a domain with its own TLS material
+type domainCert struct {
+	domain config.Domain
+	cert   *tls.Certificate
+}
+
+func newCertStore(crtPath string, keyPath string, domains []config.Domain) (*certStore, error) {
+	certs := new(certStore)
+	if err := certs.Load(crtPath, keyPath, domains); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Loads the default certificate and key, falling back to the built-in ones
+// if the paths are empty, and those of the domains which have their own.
+// The current certificates are kept if any fails to load.
+func (s *certStore) Load(crtPath string, keyPath string, domains []config.Domain) error {
+	cert, err := loadCertificate(crtPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	var dcerts []domainCert
+	for _, d := range domains {
+		if d.TLSCert == "" {
+			continue
+		}
+
+		dcert, err := loadCertificate(d.TLSCert, d.TLSKey)
+		if err != nil {
+			return fmt.Errorf("Failed to load TLS certificate of domain %s: %v", d.Name, err)
+		}
+		dcerts = append(dcerts, domainCert{domain: d, cert: dcert})
+	}
+
+	s.cert.Store(cert)
+	s.domains.Store(&dcerts)
+	return nil
+}
+
+// Serves the certificates of loaded from now on, so that a reload can load
+// all of them before applying any
+func (s *certStore) replace(loaded *certStore) {
+	s.cert.Store(loaded.cert.Load())
+	s.domains.Store(loaded.domains.Load())
+}
+
+// A TLS config serving the certificate of the domain the client asks for,
+// or the default one
+func (s *certStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := strings.ToLower(hello.ServerName)
+
+			var found *domainCert
+			if dcerts := s.domains.Load(); dcerts != nil {
+				for i, dc := range *dcerts {
+					matches := dc.domain.Contains(name) || name == dc.domain.TCPHostname
+					if matches && (found == nil || len(dc.domain.Name) > len(found.domain.Name)) {
+						found = &(*dcerts)[i]
+					}
+				}
+			}
+
+			if found != nil {
+				return found.cert, nil
+			}
+			return s.cert.Load(), nil
+		},
+	}
+}
+
+func loadCertificate(crtPath string, keyPath string) (*tls.Certificate, error) {
 	fileOrAsset := func(path string, default_path string) ([]byte, error) {
 		loadFn := os.ReadFile
 		if path == "" {
@@ -17,27 +115,91 @@ func LoadTLSConfig(crtPath string, keyPath string) (tlsConfig *tls.Config, err e
 		return loadFn(path)
 	}
 
-	var (
-		crt  []byte
-		key  []byte
-		cert tls.Certificate
-	)
+	crt, err := fileOrAsset(crtPath, "assets/server/tls/default.crt")
+	if err != nil {
+		return nil, err
+	}
 
-	if crt, err = fileOrAsset(crtPath, "assets/server/tls/default.crt"); err != nil {
-		return
+	key, err := fileOrAsset(keyPath, "assets/server/tls/default.key")
+	if err != nil {
+		return nil, err
 	}
 
-	if key, err = fileOrAsset(keyPath, "assets/server/tls/default.key"); err != nil {
-		return
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return nil, err
 	}
+	return &cert, nil
+}
 
-	if cert, err = tls.X509KeyPair(crt, key); err != nil {
-		return
+// Asks clients of the tunnel listeners for agent certificates issued by
+// ca. mode is "none", "optional" to verify certificates that clients
+// present or "require" to reject clients without one. Every handshake
+// checks the certificate's revocation status in the database.
+func ClientAuthTLSConfig(tlsConfig *tls.Config, mode string, ca *auth.CertAuthority, dbConn *gorm.DB) (*tls.Config, error) {
+	tlsConfig = tlsConfig.Clone()
+
+	switch mode {
+	case "none":
+		return tlsConfig, nil
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Invalid TLS client auth mode '%s', must be 'none', 'optional' or 'require'", mode)
+	}
+
+	tlsConfig.ClientCAs = ca.Pool()
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), connReadTimeout)
+		defer cancel()
+		_, err := auth.CheckClientCert(ctx, dbConn, cs.PeerCertificates[0])
+		return err
 	}
 
-	tlsConfig = &tls.Config{
+	return tlsConfig, nil
+}
+
+// TLS for the admin listener, nil to serve it in plain HTTP when no
+// certificate is configured. With clientCAPath set, only clients presenting
+// a certificate signed by one of the CAs in that PEM file are accepted.
+func AdminTLSConfig(crtPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	if crtPath == "" && keyPath == "" {
+		if clientCAPath != "" {
+			return nil, fmt.Errorf("Admin client certificates require ADMIN_TLS_CERT_PATH and ADMIN_TLS_KEY_PATH")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load admin TLS certificate: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAPath != "" {
+		caPEM, err := os.ReadFile(clientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read admin client CA: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No certificates found in admin client CA %s", clientCAPath)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
-	return
+	return tlsConfig, nil
 }
@@ -7,18 +7,28 @@ import (
 	"net"
 	"ngrok/pkg/conn"
 	"ngrok/pkg/msg"
+	"ngrok/pkg/server/config"
 	"ngrok/pkg/server/log"
-	"ngrok/pkg/util"
-	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 )
 
+// How long an agent may take to reach its local service, see
+// msg.ProxyResp
+const proxyRespTimeout = 30 * time.Second
+
 var (
-	servingDomain  string
-	defaultPortMap = map[string]int{
+	// the first one is the default, see config.Config.ServedDomains
+	servedDomains  []config.Domain
+	udpIdleTimeout atomic.Int64 // a time.Duration, see setLimits
+
+	// whether the connections of the public http, https and tcp listeners
+	// start with a PROXY protocol header
+	publicProxyMode atomic.Int64 // a conn.ProxyMode
+	defaultPortMap  = map[string]int{
 		"http":  80,
 		"https": 443,
 		"smtp":  25,
@@ -39,12 +49,40 @@ type Tunnel struct {
 	// public url
 	url string
 
+	// base domain of the url, nil for connect tunnels
+	domain *config.Domain
+
 	// tcp listener
 	listener *net.TCPListener
 
+	// udp listener
+	udpListener *conn.UDPListener
+
 	// control connection
 	ctl *Control
 
+	// the pooled tunnel group sharing the url, nil if the tunnel isn't
+	// pooled
+	pool *tunnelPool
+
+	// number of public connections being proxied, for the pool's balancing
+	active atomic.Int32
+
+	// when the tunnel last failed to provide a proxy connection, in unix
+	// nanoseconds, see tunnelPool.pick
+	failedAt atomic.Int64
+
+	// limits public http connections, see tunnelRateLimit
+	limiter rateLimiter
+
+	// set while the tunnel is held after losing its agent, see
+	// tunnelHold
+	hold atomic.Pointer[tunnelHold]
+
+	// the hold of the tunnel whose url this one took over, which hands
+	// its requests over once the client was told about the tunnel
+	takenOver *tunnelHold
+
 	// logger
 	log.Logger
 
@@ -54,47 +92,121 @@ type Tunnel struct {
 
 // Common functionality for registering virtually hosted protocols
 func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
-	vhost := os.Getenv("VHOST")
-	if vhost == "" {
-		vhost = fmt.Sprintf("%s:%d", servingDomain, servingPort)
-	}
-
-	// Canonicalize virtual host by removing default port (e.g. :80 on HTTP)
 	defaultPort, ok := defaultPortMap[protocol]
 	if !ok {
 		return fmt.Errorf("Couldn't find default port for protocol %s", protocol)
 	}
 
-	defaultPortSuffix := fmt.Sprintf(":%d", defaultPort)
-	if strings.HasSuffix(vhost, defaultPortSuffix) {
-		vhost = vhost[0 : len(vhost)-len(defaultPortSuffix)]
+	// Canonicalize virtual host by leaving out the default port (e.g. :80
+	// on HTTP)
+	vhost := t.domain.Name
+	if servingPort != defaultPort {
+		vhost = fmt.Sprintf("%s:%d", vhost, servingPort)
 	}
 
-	// Canonicalize by always using lower-case
-	vhost = strings.ToLower(vhost)
+	// the tunnel may only serve a path prefix of its hostname
+	prefix, err := routePath(t.req.Path)
+	if err != nil {
+		return
+	}
+
+	// the agents of a pool have to agree on the url beforehand
+	if t.req.Group != "" && t.req.Hostname == "" && t.req.Subdomain == "" {
+		return fmt.Errorf("Pooled tunnels need a hostname or subdomain")
+	}
 
-	// Register for specific hostname
+	// the other tunnels of a pool take the requests of a lost one
+	if t.req.Hold && t.req.Group != "" {
+		return fmt.Errorf("Pooled tunnels can't hold requests")
+	}
+
+	// Register for specific hostname, on the port we're serving on like
+	// the Host header of requests names it
 	hostname := strings.ToLower(strings.TrimSpace(t.req.Hostname))
 	if hostname != "" {
-		t.url = fmt.Sprintf("%s://%s", protocol, hostname)
+		name := hostname
+		if h, _, err := net.SplitHostPort(hostname); err == nil {
+			name = h
+		}
+
+		// hostnames under a served domain belong to that domain's tokens,
+		// others are custom hostnames CNAMEd to the server
+		d := domainOf(name)
+		if d != nil && !t.ctl.domainPolicy.Allows(d) {
+			return fmt.Errorf("Your auth token is not allowed to open tunnels on '%s'", d.Name)
+		}
+		if err = checkWildcard(name, d); err != nil {
+			return
+		}
+
+		if _, _, err := net.SplitHostPort(hostname); err != nil && servingPort != defaultPort {
+			hostname = fmt.Sprintf("%s:%d", hostname, servingPort)
+		}
+		t.url = fmt.Sprintf("%s://%s%s", protocol, hostname, prefix)
 		return tunnelRegistry.Register(t.url, t)
 	}
 
 	// Register for specific subdomain
 	subdomain := strings.ToLower(strings.TrimSpace(t.req.Subdomain))
 	if subdomain != "" {
-		t.url = fmt.Sprintf("%s://%s.%s", protocol, subdomain, vhost)
+		if err = checkWildcard(subdomain+"."+t.domain.Name, t.domain); err != nil {
+			return
+		}
+		t.url = fmt.Sprintf("%s://%s.%s%s", protocol, subdomain, vhost, prefix)
 		return tunnelRegistry.Register(t.url, t)
 	}
 
 	// Register for random URL
 	t.url, err = tunnelRegistry.RegisterRepeat(func() string {
-		return fmt.Sprintf("%s://%x.%s", protocol, rand.Int31(), vhost)
+		return fmt.Sprintf("%s://%x.%s%s", protocol, rand.Int31(), vhost, prefix)
 	}, t)
 
 	return
 }
 
+// Canonicalizes the path prefix a tunnel serves, "" for all of its hostname
+func routePath(prefix string) (string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#*% \t") {
+		return "", fmt.Errorf("Invalid path '%s', it must be a prefix like /api", prefix)
+	}
+	return strings.TrimSuffix(path.Clean(prefix), "/"), nil
+}
+
+// Wildcards may only be the first label of a hostname and must leave two
+// labels at least, like *.example.com. Under the served domain d they must
+// be below one of its subdomains, a wildcard of d itself would take over
+// all of it.
+func checkWildcard(name string, d *config.Domain) error {
+	rest, wildcard := strings.CutPrefix(name, "*.")
+	if strings.Contains(rest, "*") || (wildcard && !strings.Contains(rest, ".")) {
+		return fmt.Errorf("Invalid wildcard hostname '%s', only a first label of * is allowed, like *.example.com", name)
+	}
+	if wildcard && d != nil && rest == d.Name {
+		return fmt.Errorf("Wildcard hostnames must be below a subdomain of '%s', like *.feature.%s", d.Name, d.Name)
+	}
+	return nil
+}
+
+// The served domain that host is or is a subdomain of, the longest one if
+// domains are nested, nil if there is none
+func domainOf(host string) (found *config.Domain) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for i := range servedDomains {
+		d := &servedDomains[i]
+		if d.Contains(host) && (found == nil || len(d.Name) > len(found.Name)) {
+			found = d
+		}
+	}
+	return
+}
+
 // Create a new tunnel from a registration message received
 // on a control channel
 func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
@@ -106,61 +218,130 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 	}
 
 	proto := t.req.Protocol
+	if proto != "connect" {
+		if t.domain, err = ctl.domainPolicy.Resolve(servedDomains, m.Domain); err != nil {
+			return
+		}
+	}
+
+	if m.Hold && proto != "http" && proto != "https" {
+		err = fmt.Errorf("Only http tunnels can hold requests")
+		return
+	}
+
+	// pre-encode the http basic auth for fast comparisons later, and for
+	// pooled tunnels to compare theirs when registering
+	if m.HttpAuth != "" {
+		m.HttpAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(m.HttpAuth))
+	}
+
 	switch proto {
-	case "tcp":
-		bindTcp := func(port int) error {
-			if t.listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: port}); err != nil {
-				err = t.ctl.conn.Error("Error binding TCP listener: %v", err)
+	case "tcp", "udp":
+		ports := tunnelPorts.Load()
+
+		// listens on port, 0 for one the OS picks
+		bind := func(port int) error {
+			var addr net.Addr
+			if proto == "udp" {
+				if t.udpListener, err = conn.ListenUDP(&net.UDPAddr{IP: ports.bindIP, Port: port}, "pub", time.Duration(udpIdleTimeout.Load())); err != nil {
+					return err
+				}
+				addr = t.udpListener.Addr()
+			} else {
+				if t.listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ports.bindIP, Port: port}); err != nil {
+					return err
+				}
+				addr = t.listener.Addr()
+			}
+
+			// the OS may pick a port that isn't ours to take
+			_, portPart, _ := net.SplitHostPort(addr.String())
+			bound, _ := strconv.Atoi(portPart)
+			if port == 0 && (!ports.allows(bound) || tunnelRegistry.PortReservedByOther(proto, bound, t)) {
+				t.closeListeners()
+				err = fmt.Errorf("Port %d isn't free to take", bound)
 				return err
 			}
 
 			// create the url
-			addr := t.listener.Addr().(*net.TCPAddr)
-			t.url = fmt.Sprintf("tcp://%s:%d", servingDomain, addr.Port)
+			t.url = fmt.Sprintf("%s://%s:%s", proto, t.domain.TCPHost(), portPart)
 
 			// register it
 			if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
 				// This should never be possible because the OS will
 				// only assign available ports to us.
-				t.listener.Close()
-				err = fmt.Errorf("TCP listener bound, but failed to register %s", t.url)
+				t.closeListeners()
+				err = fmt.Errorf("%s listener bound, but failed to register %s", strings.ToUpper(proto), t.url)
 				return err
 			}
+			tunnelRegistry.ReservePort(proto, bound, t)
 
-			go t.listenTcp(t.listener)
+			if proto == "udp" {
+				go t.listenUdp(t.udpListener)
+			} else {
+				go t.listenTcp(t.listener)
+			}
 			return nil
 		}
 
 		// use the custom remote port you asked for
 		if t.req.RemotePort != 0 {
-			bindTcp(int(t.req.RemotePort))
+			port := int(t.req.RemotePort)
+			if !ports.allows(port) {
+				err = fmt.Errorf("Port %d is not available for tunnels, the server allows %s", port, ports)
+				return
+			}
+			if bind(port) != nil {
+				err = t.ctl.conn.Error("Error binding %s listener on port %d: %v", strings.ToUpper(proto), port, err)
+			}
 			return
 		}
 
 		// try to return to you the same port you had before
 		cachedUrl := tunnelRegistry.GetCachedRegistration(t)
 		if cachedUrl != "" {
-			var port int
 			parts := strings.Split(cachedUrl, ":")
 			portPart := parts[len(parts)-1]
-			port, err = strconv.Atoi(portPart)
-			if err != nil {
+			port, parseErr := strconv.Atoi(portPart)
+			switch {
+			case parseErr != nil:
 				t.ctl.conn.Error("Failed to parse cached url port as integer: %s", portPart)
-			} else {
-				// we have a valid, cached port, let's try to bind with it
-				if bindTcp(port) != nil {
-					t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
-				} else {
-					// success, we're done
+			case !ports.allows(port):
+				t.ctl.conn.Info("Cached port %d isn't available for tunnels anymore, trying a random one", port)
+			case bind(port) != nil:
+				t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
+			default:
+				// success, we're done
+				return
+			}
+		}
+
+		// Bind a random port of the pool, preferring the ones that aren't
+		// reserved for other clients
+		for _, reserved := range []bool{false, true} {
+			for port := range ports.random() {
+				if port != 0 && !reserved && tunnelRegistry.PortReservedByOther(proto, port, t) {
+					continue
+				}
+				if bind(port) == nil {
 					return
 				}
 			}
 		}
 
-		// Bind for TCP connections
-		bindTcp(0)
+		err = t.ctl.conn.Error("No free port to bind a %s listener on, the server allows %s", strings.ToUpper(proto), ports)
 		return
 
+	case "connect":
+		if !t.ctl.connectPolicy.Allows(m.RemoteAddr) {
+			err = fmt.Errorf("Your auth token is not allowed to connect to '%s'", m.RemoteAddr)
+			return
+		}
+
+		// nothing listens on the server, the client opens a connection for
+		// every connection it accepts, see NewConnect
+		t.url = "connect://" + m.RemoteAddr
+
 	case "http", "https":
 		l, ok := listeners[proto]
 		if !ok {
@@ -177,11 +358,6 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 		return
 	}
 
-	// pre-encode the http basic auth for fast comparisons later
-	if m.HttpAuth != "" {
-		m.HttpAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(m.HttpAuth))
-	}
-
 	t.AddLogPrefix(t.Id())
 	t.Info("Registered new tunnel on: %s", t.ctl.conn.Id())
 
@@ -195,13 +371,16 @@ func (t *Tunnel) Shutdown() {
 	// mark that we're shutting down
 	atomic.StoreInt32(&t.closing, 1)
 
-	// if we have a public listener (this is a raw TCP tunnel), shut it down
-	if t.listener != nil {
-		t.listener.Close()
-	}
+	// if we have a public listener (this is a raw TCP or UDP tunnel), shut it down
+	t.closeListeners()
 
-	// remove ourselves from the tunnel registry
-	tunnelRegistry.Del(t.url)
+	// remove ourselves from the tunnel registry, unless the url is held
+	// for the agent to come back
+	if t.holds() {
+		t.startHold()
+	} else {
+		tunnelRegistry.Del(t.url, t)
+	}
 
 	// let the control connection know we're shutting down
 	// currently, only the control connection shuts down tunnels,
@@ -211,10 +390,27 @@ func (t *Tunnel) Shutdown() {
 	metrics.CloseTunnel(t)
 }
 
+func (t *Tunnel) closeListeners() {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	if t.udpListener != nil {
+		t.udpListener.Close()
+	}
+}
+
 func (t *Tunnel) Id() string {
 	return t.url
 }
 
+// The account of the client that opened the tunnel
+func (t *Tunnel) owner() string {
+	if t.ctl == nil {
+		return ""
+	}
+	return t.ctl.owner
+}
+
 // Listens for new public tcp connections from the internet.
 func (t *Tunnel) listenTcp(listener *net.TCPListener) {
 	for {
@@ -237,15 +433,56 @@ func (t *Tunnel) listenTcp(listener *net.TCPListener) {
 			continue
 		}
 
-		conn := conn.Wrap(tcpConn, "pub")
-		conn.AddLogPrefix(t.Id())
-		conn.Info("New connection from %v", conn.RemoteAddr())
+		publicConn := conn.Wrap(tcpConn, "pub")
+		publicConn.AddLogPrefix(t.Id())
+
+		// waiting for the PROXY protocol header must not hold up other
+		// connections
+		go func() {
+			if err := conn.ReadProxyHeader(publicConn, conn.ProxyMode(publicProxyMode.Load())); err != nil {
+				publicConn.Warn("Rejecting connection from %v: %v", publicConn.RemoteAddr(), err)
+				publicConn.Close()
+				return
+			}
 
-		go t.HandlePublicConnection(conn)
+			publicConn.Info("New connection from %v", publicConn.RemoteAddr())
+			t.HandlePublicConnection(publicConn, nil)
+		}()
 	}
 }
 
-func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
+// Accepts new flows of datagrams from the internet. Each flow is proxied
+// over its own proxy connection, so datagrams from one remote address
+// always reach the same local socket.
+func (t *Tunnel) listenUdp(listener *conn.UDPListener) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("listenUdp failed with error %v", r)
+		}
+	}()
+
+	for {
+		flow, err := listener.Accept()
+		if err != nil {
+			// not an error, we're shutting down this tunnel
+			if atomic.LoadInt32(&t.closing) == 1 {
+				return
+			}
+
+			t.Error("Failed to accept new UDP flow: %v", err)
+			return
+		}
+
+		flow.AddLogPrefix(t.Id())
+		go t.HandlePublicConnection(flow, nil)
+	}
+}
+
+// Proxies publicConn to the tunnel's local service. req is the first
+// request of http connections, which are answered with an error page if
+// the tunnel's agent or local service can't take them, and nil for tcp
+// and udp connections.
+func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn, req *publicRequest) {
 	defer publicConn.Close()
 	defer func() {
 		if r := recover(); r != nil {
@@ -253,18 +490,102 @@ func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 		}
 	}()
 
+	// a held tunnel queues http requests until its agent is back
+	if h := t.hold.Load(); h != nil && req != nil {
+		t.handleHeld(h, publicConn, req)
+		return
+	}
+
 	startTime := time.Now()
 	metrics.OpenConnection(t, publicConn)
 
-	var proxyConn conn.Conn
-	var err error
-	for i := 0; i < (2 * proxyMaxPoolSize); i++ {
+	// a pooled tunnel hands the connection to a member of its pool
+	served, proxyConn, err := t.getProxy(publicConn)
+	if err != nil {
+		// the agent may have been lost while waiting for it
+		if h := t.hold.Load(); h != nil && req != nil {
+			t.handleHeld(h, publicConn, req)
+			return
+		}
+
+		publicConn.Warn("Giving up on the connection: %v", err)
+		if req != nil {
+			writeErrorPage(publicConn, req, errAgentOffline, fmt.Sprintf("The agent of tunnel %s is not responding.", req.host))
+		}
+		return
+	}
+	defer proxyConn.Close()
+
+	served.active.Add(1)
+	defer served.active.Add(-1)
+
+	// To reduce latency handling tunnel connections, we employ the following curde heuristic:
+	// Whenever we take a proxy connection from the pool, replace it with a new one
+	served.ctl.requestProxy()
+
+	// agents with the proxyresp capability tell whether they reached the
+	// local service, older ones write their own error page
+	if msg.HasCapability(served.ctl.caps, msg.CapProxyResp) {
+		proxyConn.SetReadDeadline(time.Now().Add(proxyRespTimeout))
+		var resp msg.ProxyResp
+		if err = msg.ReadMsgInto(proxyConn, &resp); err != nil {
+			proxyConn.Warn("Failed to read ProxyResp: %v", err)
+			resp.Error = err.Error()
+		}
+
+		if resp.Error != "" {
+			proxyConn.Warn("Agent failed to reach the local service: %s", resp.Error)
+			if req != nil {
+				writeErrorPage(publicConn, req, errUpstreamUnreachable, fmt.Sprintf("The agent of tunnel %s failed to reach its local service.", req.host))
+			}
+			return
+		}
+	}
+
+	// no timeouts while connections are joined
+	proxyConn.SetDeadline(time.Time{})
+
+	// join the public and proxy connections
+	bytesIn, bytesOut := conn.Join(publicConn, proxyConn)
+	metrics.CloseConnection(served, publicConn, startTime, bytesIn, bytesOut)
+}
+
+// Gets a proxy connection for publicConn from t or, if t is pooled, from
+// the member of its pool that tunnelPool.pick chooses, failing over to the
+// next one when a member can't provide one, e.g. because its agent lost
+// its heartbeats. Returns the tunnel that provided it.
+func (t *Tunnel) getProxy(publicConn conn.Conn) (*Tunnel, conn.Conn, error) {
+	if t.pool == nil {
+		proxyConn, err := t.startProxy(publicConn)
+		return t, proxyConn, err
+	}
+
+	tried := make(map[*Tunnel]bool)
+	for {
+		member := t.pool.pick(tried)
+		if member == nil {
+			return nil, nil, fmt.Errorf("No tunnel of pool %s could take the connection", t.pool.group)
+		}
+
+		proxyConn, err := member.startProxy(publicConn)
+		if err == nil {
+			return member, proxyConn, nil
+		}
+
+		member.Warn("Failing over to another tunnel of pool %s: %v", t.pool.group, err)
+		member.failedAt.Store(time.Now().UnixNano())
+		tried[member] = true
+	}
+}
+
+// Gets a proxy connection from the tunnel's control connection and tells
+// the client to proxy publicConn over it
+func (t *Tunnel) startProxy(publicConn conn.Conn) (proxyConn conn.Conn, err error) {
+	for i := 0; i < 2*int(proxyMaxPoolSize.Load()); i++ {
 		// get a proxy connection
 		if proxyConn, err = t.ctl.GetProxy(); err != nil {
-			t.Warn("Failed to get proxy connection: %v", err)
-			return
+			return nil, fmt.Errorf("Failed to get proxy connection: %v", err)
 		}
-		defer proxyConn.Close()
 		t.Info("Got proxy connection %s", proxyConn.Id())
 		proxyConn.AddLogPrefix(t.Id())
 
@@ -279,24 +600,10 @@ func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 			proxyConn.Close()
 		} else {
 			// success
-			break
+			return proxyConn, nil
 		}
 	}
 
-	if err != nil {
-		// give up
-		publicConn.Error("Too many failures starting proxy connection")
-		return
-	}
-
-	// To reduce latency handling tunnel connections, we employ the following curde heuristic:
-	// Whenever we take a proxy connection from the pool, replace it with a new one
-	util.PanicToError(func() { t.ctl.out <- &msg.ReqProxy{} })
-
-	// no timeouts while connections are joined
-	proxyConn.SetDeadline(time.Time{})
-
-	// join the public and proxy connections
-	bytesIn, bytesOut := conn.Join(publicConn, proxyConn)
-	metrics.CloseConnection(t, publicConn, startTime, bytesIn, bytesOut)
+	// give up
+	return nil, fmt.Errorf("Too many failures starting proxy connection")
 }
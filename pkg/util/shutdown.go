@@ -34,6 +34,11 @@ func (s *Shutdown) WaitBegin() {
 	<-s.begin
 }
 
+// Closed when the shutdown begins, for waiting on it in a select
+func (s *Shutdown) Begun() <-chan int {
+	return s.begin
+}
+
 func (s *Shutdown) Complete() {
 	close(s.complete)
 }
@@ -18,6 +18,9 @@ func Full() string {
 	return fmt.Sprintf("%s-%s.%s", Proto, Major, Minor)
 }
 
+// Whether a client speaking protocol version client can talk to the server.
+// Protocol changes since version 2 are negotiated with msg.Capabilities
+// instead, so that older clients keep working.
 func Compat(client string, server string) bool {
 	return client == server
 }